@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ключ контекста Gin со списком прав токена; у интерактивной сессии его нет
+const scopesKey = "scopes"
+
+// Префикс персональных токенов, по нему они отличаются от JWT
+const apiTokenPrefix = "et_"
+
+// Права персональных токенов
+const (
+	scopeExpensesRead  = "expenses:read"
+	scopeExpensesWrite = "expenses:write"
+	scopeStatsRead     = "stats:read"
+)
+
+var knownScopes = map[string]bool{
+	scopeExpensesRead:  true,
+	scopeExpensesWrite: true,
+	scopeStatsRead:     true,
+}
+
+// Как часто обновлять время последнего использования, чтобы не писать в базу на каждый запрос
+const apiTokenTouchInterval = time.Minute
+
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	Token      string     `json:"token,omitempty"`
+}
+
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name" binding:"required"`
+	Scopes        []string `json:"scopes" binding:"required,min=1"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+// Ищет действующий персональный токен и отмечает его использование
+func authenticateAPIToken(ctx context.Context, token string) (int, []string, error) {
+	var id, userID int
+	var scopesJSON []byte
+	err := db.QueryRowContext(ctx, "SELECT id, user_id, scopes FROM api_tokens WHERE token_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())",
+		hashSecretToken(token)).Scan(&id, &userID, &scopesJSON)
+	if err == sql.ErrNoRows {
+		return 0, nil, errInvalidToken
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var scopes []string
+	if err := json.Unmarshal(scopesJSON, &scopes); err != nil {
+		return 0, nil, err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE api_tokens SET last_used_at = NOW() WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - $2::interval)",
+		id, fmt.Sprintf("%d seconds", int(apiTokenTouchInterval.Seconds())))
+	if err != nil {
+		log.Printf("Error updating last use of API token %d: %v", id, err)
+	}
+	return userID, scopes, nil
+}
+
+// Есть ли у запроса право; интерактивной сессии разрешено все
+func hasScope(c *gin.Context, scope string) bool {
+	value, ok := c.Get(scopesKey)
+	if !ok {
+		return true
+	}
+	for _, s := range value.([]string) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Управлять токенами и домохозяйствами можно только из интерактивной сессии, не другим токеном
+func requireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get(scopesKey); ok {
+			respondWithError(c, http.StatusForbidden, "Personal access tokens cannot manage tokens or households")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func scanAPIToken(scan func(dest ...interface{}) error) (APIToken, error) {
+	var token APIToken
+	var scopesJSON []byte
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	if err := scan(&token.ID, &token.Name, &token.Prefix, &scopesJSON, &token.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt); err != nil {
+		return token, err
+	}
+	if err := json.Unmarshal(scopesJSON, &token.Scopes); err != nil {
+		return token, err
+	}
+	token.ExpiresAt = nullTimePtr(expiresAt)
+	token.LastUsedAt = nullTimePtr(lastUsedAt)
+	token.RevokedAt = nullTimePtr(revokedAt)
+	return token, nil
+}
+
+func getAPITokens(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT id, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at FROM api_tokens WHERE user_id = $1 ORDER BY id",
+		currentUserID(c))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		token, err := scanAPIToken(rows.Scan)
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		tokens = append(tokens, token)
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data:   tokens,
+	})
+}
+
+// Создает токен; его значение возвращается только в этом ответе
+func createAPIToken(c *gin.Context) {
+	var req CreateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		respondWithError(c, http.StatusBadRequest, "name is required")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !knownScopes[scope] {
+			respondWithError(c, http.StatusBadRequest, "Unknown scope: "+scope)
+			return
+		}
+	}
+	if req.ExpiresInDays < 0 {
+		respondWithError(c, http.StatusBadRequest, "expiresInDays must not be negative")
+		return
+	}
+
+	secret, _, err := newSecretToken()
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	plain := apiTokenPrefix + secret
+
+	scopesJSON, err := json.Marshal(req.Scopes)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Без срока действия expires_at остается NULL
+	row := db.QueryRowContext(ctx, "INSERT INTO api_tokens (user_id, name, prefix, token_hash, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, NOW() + make_interval(days => $6)) RETURNING id, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at",
+		currentUserID(c), strings.TrimSpace(req.Name), plain[:len(apiTokenPrefix)+6], hashSecretToken(plain), scopesJSON, nullInt(req.ExpiresInDays))
+	token, err := scanAPIToken(row.Scan)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	token.Token = plain
+
+	c.JSON(http.StatusCreated, Response{
+		Status:  "success",
+		Message: "Token created; copy it now, it will not be shown again",
+		Data:    token,
+	})
+}
+
+func revokeAPIToken(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "UPDATE api_tokens SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		c.Param("id"), currentUserID(c))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(c, http.StatusNotFound, "Token not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Token revoked successfully",
+	})
+}
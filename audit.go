@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ключ контекста Gin и заголовок с идентификатором запроса
+const (
+	requestIDKey    = "requestID"
+	requestIDHeader = "X-Request-ID"
+)
+
+// Действия и сущности журнала изменений
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+	// Возврат из корзины
+	auditRestore = "restore"
+
+	auditEntityCategory = "category"
+	auditEntityExpense  = "expense"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// Берет идентификатор запроса из заголовка клиента или прокси либо создает новый
+// и возвращает его в ответе, чтобы запись журнала можно было сопоставить с логами.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			raw := make([]byte, 16)
+			if _, err := rand.Read(raw); err == nil {
+				id = hex.EncodeToString(raw)
+			}
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Кто и в рамках какого запроса меняет данные домохозяйства
+type auditActor struct {
+	HouseholdID int
+	UserID      int
+	RequestID   string
+}
+
+func auditActorFrom(c *gin.Context) auditActor {
+	return auditActor{
+		HouseholdID: currentHouseholdID(c),
+		UserID:      currentUserID(c),
+		RequestID:   c.GetString(requestIDKey),
+	}
+}
+
+// Автор изменений подкоманды командной строки: пользователь из -user в своем основном домохозяйстве
+func lookupAuditActor(ctx context.Context, username string) (auditActor, error) {
+	userID, err := lookupUserID(ctx, username)
+	if err != nil {
+		return auditActor{}, err
+	}
+	householdID, err := lookupHouseholdID(ctx, username)
+	if err != nil {
+		return auditActor{}, err
+	}
+	return auditActor{HouseholdID: householdID, UserID: userID}, nil
+}
+
+// Пишет запись журнала в транзакции изменения: откат изменения откатывает и запись.
+// before и after сериализуются в JSON; nil означает отсутствие состояния.
+func recordAudit(ctx context.Context, tx *sql.Tx, actor auditActor, action, entity string, entityID int, before, after interface{}) error {
+	beforeJSON, err := auditJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := auditJSON(after)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO audit_log (household_id, actor_id, action, entity, entity_id, request_id, before, after) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		actor.HouseholdID, nullInt(actor.UserID), action, entity, entityID, nullString(actor.RequestID), beforeJSON, afterJSON)
+	return err
+}
+
+func auditJSON(v interface{}) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// Состояние категории для журнала, без вычисляемых полей
+func loadCategoryForAudit(ctx context.Context, tx *sql.Tx, id string, householdID int) (*Category, error) {
+	var cat Category
+	var monthlyStatsJSON []byte
+	err := tx.QueryRowContext(ctx, "SELECT id, name, description, monthly_stats, version FROM categories WHERE id = $1 AND household_id = $2 AND deleted_at IS NULL FOR UPDATE", id, householdID).
+		Scan(&cat.ID, &cat.Name, &cat.Description, &monthlyStatsJSON, &cat.Version)
+	if err != nil {
+		return nil, err
+	}
+	cat.MonthlyStats = make(map[string]float64)
+	if len(monthlyStatsJSON) > 0 {
+		if err := json.Unmarshal(monthlyStatsJSON, &cat.MonthlyStats); err != nil {
+			return nil, err
+		}
+	}
+	return &cat, nil
+}
+
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Action    string          `json:"action"`
+	Entity    string          `json:"entity"`
+	EntityID  int             `json:"entityId"`
+	ActorID   *int            `json:"actorId,omitempty"`
+	Actor     string          `json:"actor,omitempty"`
+	RequestID string          `json:"requestId,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// Фильтры журнала; from и to принимают дату или RFC 3339
+type AuditFilter struct {
+	Entity   string `form:"entity"`
+	EntityID int    `form:"entityId"`
+	ActorID  int    `form:"actorId"`
+	Action   string `form:"action"`
+	From     string `form:"from"`
+	To       string `form:"to"`
+	Limit    int    `form:"limit"`
+	Offset   int    `form:"offset"`
+}
+
+func parseAuditTime(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// Дата в to включает весь день
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func getAuditLog(c *gin.Context) {
+	var filter AuditFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultAuditLimit
+	}
+	if filter.Limit > maxAuditLimit || filter.Offset < 0 {
+		respondWithError(c, http.StatusBadRequest, fmt.Sprintf("limit must be at most %d and offset must not be negative", maxAuditLimit))
+		return
+	}
+
+	args := []interface{}{currentHouseholdID(c)}
+	conditions := []string{"a.household_id = $1"}
+	if filter.Entity != "" {
+		args = append(args, filter.Entity)
+		conditions = append(conditions, fmt.Sprintf("a.entity = $%d", len(args)))
+	}
+	if filter.EntityID != 0 {
+		args = append(args, filter.EntityID)
+		conditions = append(conditions, fmt.Sprintf("a.entity_id = $%d", len(args)))
+	}
+	if filter.ActorID != 0 {
+		args = append(args, filter.ActorID)
+		conditions = append(conditions, fmt.Sprintf("a.actor_id = $%d", len(args)))
+	}
+	if filter.Action != "" {
+		args = append(args, filter.Action)
+		conditions = append(conditions, fmt.Sprintf("a.action = $%d", len(args)))
+	}
+	if filter.From != "" {
+		from, err := parseAuditTime(filter.From, false)
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, "invalid from: "+filter.From)
+			return
+		}
+		args = append(args, from)
+		conditions = append(conditions, fmt.Sprintf("a.created_at >= $%d", len(args)))
+	}
+	if filter.To != "" {
+		to, err := parseAuditTime(filter.To, true)
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, "invalid to: "+filter.To)
+			return
+		}
+		args = append(args, to)
+		conditions = append(conditions, fmt.Sprintf("a.created_at < $%d", len(args)))
+	}
+	args = append(args, filter.Limit, filter.Offset)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := "SELECT a.id, a.action, a.entity, a.entity_id, a.actor_id, COALESCE(u.username, ''), COALESCE(a.request_id, ''), a.before, a.after, a.created_at FROM audit_log a LEFT JOIN users u ON u.id = a.actor_id WHERE " +
+		strings.Join(conditions, " AND ") + fmt.Sprintf(" ORDER BY a.id DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var actorID sql.NullInt64
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &e.Action, &e.Entity, &e.EntityID, &actorID, &e.Actor, &e.RequestID, &before, &after, &e.CreatedAt); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if actorID.Valid {
+			id := int(actorID.Int64)
+			e.ActorID = &id
+		}
+		e.Before = before
+		e.After = after
+		entries = append(entries, e)
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data:   entries,
+	})
+}
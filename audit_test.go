@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// Записи журнала домохозяйства: действие и сущность -> число записей
+func loadTestAudit(t *testing.T, ctx context.Context, q queryer, householdID, actorID int) map[string]int {
+	t.Helper()
+	rows, err := q.QueryContext(ctx, "SELECT action || ' ' || entity, COUNT(*) FROM audit_log WHERE household_id = $1 AND actor_id = $2 GROUP BY 1", householdID, actorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var n int
+		if err := rows.Scan(&key, &n); err != nil {
+			t.Fatal(err)
+		}
+		counts[key] = n
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return counts
+}
+
+func TestImportRecordsAudit(t *testing.T) {
+	ctx, tx := testTx(t)
+	user, householdID := createTestUser(t, ctx, tx)
+	food := createTestCategory(t, ctx, tx, householdID, "Food")
+	actor := auditActor{HouseholdID: householdID, UserID: user.ID, RequestID: "import-request"}
+
+	date := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+	rows := []ImportRow{
+		{Line: 1, Type: importTypeExpense, Expense: &Expense{CategoryID: food, Name: "Lunch", Amount: 500, Date: date}},
+		{Line: 2, Type: importTypeExpense, Expense: &Expense{CategoryID: food, Name: "Coffee", Amount: 150, Date: date}},
+		{Line: 3, Type: importTypeExpense, Expense: &Expense{CategoryID: food, Name: "Lunch", Amount: 500, Date: date}, Duplicate: true},
+		{Line: 4, Type: importTypeIncome, Income: &Income{Name: "Salary", Amount: 1000, Date: date}},
+	}
+	imported, err := importRowsWithTx(ctx, tx, actor, "csv", rows)
+	if err != nil {
+		t.Fatalf("importRowsWithTx: %v", err)
+	}
+	if imported != 3 {
+		t.Errorf("imported = %d, want 3", imported)
+	}
+
+	audit := loadTestAudit(t, ctx, tx, householdID, user.ID)
+	if len(audit) != 1 || audit[auditCreate+" "+auditEntityExpense] != 2 {
+		t.Errorf("audit = %v, want two expense creations", audit)
+	}
+	var requestID string
+	if err := tx.QueryRowContext(ctx, "SELECT request_id FROM audit_log WHERE household_id = $1 AND entity_id = $2", householdID, rows[0].Expense.ID).Scan(&requestID); err != nil {
+		t.Fatal(err)
+	}
+	if requestID != actor.RequestID {
+		t.Errorf("request_id = %q, want %q", requestID, actor.RequestID)
+	}
+	assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, tx, food), map[string]float64{"2024-01": 650})
+}
+
+func TestRestoreRecordsAudit(t *testing.T) {
+	var user *User
+	var householdID int
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, householdID = createTestUser(t, ctx, tx)
+	})
+	ctx := context.Background()
+
+	date := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+	backup := &Backup{
+		Version:    backupVersion,
+		Categories: []BackupCategory{{ID: 1, Name: "Food"}, {ID: 2, Name: "Transport"}},
+		Expenses: []BackupExpense{
+			{ID: 1, CategoryID: 1, Name: "Lunch", Amount: 500, Date: date},
+			{ID: 2, CategoryID: 2, Name: "Taxi", Amount: 300, Date: date},
+			{ID: 3, CategoryID: 2, Name: "Bus", Amount: 50, Date: date},
+		},
+	}
+	if _, err := restoreBackup(ctx, auditActor{HouseholdID: householdID, UserID: user.ID}, backup, true); err != nil {
+		t.Fatalf("restoreBackup: %v", err)
+	}
+
+	audit := loadTestAudit(t, ctx, db, householdID, user.ID)
+	want := map[string]int{
+		auditCreate + " " + auditEntityCategory: 2,
+		auditCreate + " " + auditEntityExpense:  3,
+	}
+	if len(audit) != len(want) {
+		t.Fatalf("audit = %v, want %v", audit, want)
+	}
+	for key, n := range want {
+		if audit[key] != n {
+			t.Errorf("audit[%s] = %d, want %d", key, audit[key], n)
+		}
+	}
+}
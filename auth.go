@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ключ контекста Gin с идентификатором аутентифицированного пользователя
+const userIDKey = "userID"
+
+// Срок действия токена по умолчанию
+const defaultTokenTTL = 24 * time.Hour
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+	errTokenRevoked = errors.New("token was revoked by a password change")
+	errUserExists   = errors.New("user already exists")
+)
+
+type User struct {
+	ID            int       `json:"id"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email,omitempty"`
+	EmailVerified bool      `json:"emailVerified"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Полезная нагрузка JWT. iat - дробное число секунд с точностью до миллисекунд,
+// чтобы токен, выпущенный в ту же секунду до смены пароля, тоже отзывался
+type tokenClaims struct {
+	Subject   string  `json:"sub"`
+	IssuedAt  float64 `json:"iat"`
+	ExpiresAt int64   `json:"exp"`
+}
+
+// Секрет подписи токенов из переменной окружения JWT_SECRET
+func jwtSecret() ([]byte, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if len(secret) < 32 {
+		return nil, errors.New("JWT_SECRET must be set to at least 32 characters")
+	}
+	return []byte(secret), nil
+}
+
+// Выпускает токен HS256 для пользователя
+func issueToken(userID int, ttl time.Duration) (string, error) {
+	secret, err := jwtSecret()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(tokenClaims{
+		Subject:   strconv.Itoa(userID),
+		IssuedAt:  float64(now.UnixMilli()) / 1000,
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + signToken(secret, signingInput), nil
+}
+
+func signToken(secret []byte, signingInput string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Проверяет подпись и срок действия токена и возвращает идентификатор пользователя и время выпуска
+func parseToken(token string) (int, time.Time, error) {
+	secret, err := jwtSecret()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, time.Time{}, errInvalidToken
+	}
+
+	// Принимаем только HS256, чтобы нельзя было подменить алгоритм
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, time.Time{}, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "HS256" {
+		return 0, time.Time{}, errInvalidToken
+	}
+
+	expected := signToken(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return 0, time.Time{}, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, time.Time{}, errInvalidToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return 0, time.Time{}, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return 0, time.Time{}, errTokenExpired
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || userID <= 0 {
+		return 0, time.Time{}, errInvalidToken
+	}
+	return userID, time.UnixMilli(int64(math.Round(claims.IssuedAt * 1000))), nil
+}
+
+// Требует заголовок Authorization: Bearer <token> и кладет пользователя в контекст.
+// Принимает JWT интерактивной сессии или персональный токен с ограниченными правами.
+func authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			respondWithError(c, http.StatusUnauthorized, "Authorization required")
+			c.Abort()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if strings.HasPrefix(token, apiTokenPrefix) {
+			userID, scopes, err := authenticateAPIToken(ctx, token)
+			if err == errInvalidToken {
+				respondWithError(c, http.StatusUnauthorized, err.Error())
+				c.Abort()
+				return
+			}
+			if err != nil {
+				respondWithError(c, http.StatusInternalServerError, err.Error())
+				c.Abort()
+				return
+			}
+			c.Set(userIDKey, userID)
+			c.Set(scopesKey, scopes)
+			if !resolveHousehold(c, ctx, userID) {
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+
+		userID, issuedAt, err := parseToken(token)
+		if err != nil {
+			respondWithError(c, http.StatusUnauthorized, err.Error())
+			c.Abort()
+			return
+		}
+
+		// Токен удаленного пользователя больше не действует, как и выпущенный до смены пароля.
+		// Время смены пароля отбрасывается до миллисекунд iat: токен той же миллисекунды тоже отзывается.
+		var passwordChangedAt sql.NullTime
+		err = db.QueryRowContext(ctx, "SELECT password_changed_at FROM users WHERE id = $1", userID).Scan(&passwordChangedAt)
+		if err == sql.ErrNoRows {
+			respondWithError(c, http.StatusUnauthorized, errInvalidToken.Error())
+			c.Abort()
+			return
+		}
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			c.Abort()
+			return
+		}
+		if passwordChangedAt.Valid && !issuedAt.After(passwordChangedAt.Time.Truncate(time.Millisecond)) {
+			respondWithError(c, http.StatusUnauthorized, errTokenRevoked.Error())
+			c.Abort()
+			return
+		}
+
+		c.Set(userIDKey, userID)
+		if !resolveHousehold(c, ctx, userID) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Идентификатор пользователя, установленный authMiddleware
+func currentUserID(c *gin.Context) int {
+	return c.GetInt(userIDKey)
+}
+
+// Создает пользователя без пароля (вход только по выданному токену)
+func createUser(ctx context.Context, username string) (*User, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user, err := createUserWithTx(ctx, tx, username, "", "")
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Создает пользователя и его личное домохозяйство; email и passwordHash необязательны.
+// Данные, накопленные до появления учетных записей, передает команда adopt-legacy-data.
+func createUserWithTx(ctx context.Context, tx *sql.Tx, username, email, passwordHash string) (*User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, errors.New("username is required")
+	}
+
+	user := User{Username: username, Email: email}
+	err := tx.QueryRowContext(ctx, "INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING id, created_at",
+		username, nullString(email), nullString(passwordHash)).Scan(&user.ID, &user.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, errUserExists
+		}
+		return nil, err
+	}
+
+	householdID, err := createHouseholdWithTx(ctx, tx, username, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET default_household_id = $1 WHERE id = $2", householdID, user.ID); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// Идентификатор пользователя по имени для подкоманд командной строки
+func lookupUserID(ctx context.Context, username string) (int, error) {
+	if username == "" {
+		return 0, errors.New("-user is required")
+	}
+	var id int
+	err := db.QueryRowContext(ctx, "SELECT id FROM users WHERE username = $1", username).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("user %q not found", username)
+	}
+	return id, nil
+}
+
+// Основное домохозяйство пользователя для подкоманд командной строки
+func lookupHouseholdID(ctx context.Context, username string) (int, error) {
+	userID, err := lookupUserID(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	var householdID sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT default_household_id FROM users WHERE id = $1", userID).Scan(&householdID); err != nil {
+		return 0, err
+	}
+	if !householdID.Valid {
+		return 0, fmt.Errorf("user %q has no default household", username)
+	}
+	return int(householdID.Int64), nil
+}
+
+// expense-tracker create-user -user <имя>
+func runCreateUserCommand(args []string) error {
+	fs := flag.NewFlagSet("create-user", flag.ExitOnError)
+	username := fs.String("user", "", "username")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user, err := createUser(ctx, *username)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created user %s (id %d)\n", user.Username, user.ID)
+	return nil
+}
+
+// expense-tracker issue-token -user <имя> [-ttl 24h]
+func runIssueTokenCommand(args []string) error {
+	fs := flag.NewFlagSet("issue-token", flag.ExitOnError)
+	username := fs.String("user", "", "username")
+	ttl := fs.Duration("ttl", defaultTokenTTL, "token lifetime")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, err := lookupUserID(ctx, *username)
+	if err != nil {
+		return err
+	}
+	token, err := issueToken(userID, *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testJWTSecret = "test-secret-test-secret-test-secret"
+
+func TestParseToken(t *testing.T) {
+	t.Setenv("JWT_SECRET", testJWTSecret)
+
+	before := time.Now().Unix()
+	token, err := issueToken(42, time.Hour)
+	if err != nil {
+		t.Fatalf("issueToken: %v", err)
+	}
+	userID, issuedAt, err := parseToken(token)
+	if err != nil {
+		t.Fatalf("parseToken: %v", err)
+	}
+	if userID != 42 {
+		t.Errorf("user = %d, want 42", userID)
+	}
+	if issuedAt.Unix() < before || issuedAt.Unix() > time.Now().Unix() {
+		t.Errorf("issued at %v, want now", issuedAt)
+	}
+
+	parts := strings.Split(token, ".")
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	expired, err := issueToken(42, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, bad := range map[string]string{
+		"tampered payload": parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1","iat":0,"exp":9999999999}`)) + "." + parts[2],
+		"alg none":         noneHeader + "." + parts[1] + ".",
+		"malformed":        "abc",
+		"expired":          expired,
+	} {
+		if _, _, err := parseToken(bad); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	t.Setenv("JWT_SECRET", strings.Repeat("x", len(testJWTSecret)))
+	if _, _, err := parseToken(token); err == nil {
+		t.Error("token signed with another secret accepted")
+	}
+}
+
+// Письма, отправленные за тест
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []sentEmail
+}
+
+type sentEmail struct {
+	to, subject string
+}
+
+func (n *recordingNotifier) Send(to, subject, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, sentEmail{to: to, subject: subject})
+	return nil
+}
+
+func useRecordingNotifier(t *testing.T) *recordingNotifier {
+	n := &recordingNotifier{}
+	previous := notifier
+	notifier = n
+	t.Cleanup(func() { notifier = previous })
+	return n
+}
+
+func authTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	auth := router.Group("/api/auth")
+	auth.POST("/register", register)
+	auth.POST("/login", login)
+	auth.POST("/password-reset/confirm", resetPassword)
+	api := router.Group("/api", authMiddleware())
+	api.GET("/me", func(c *gin.Context) {
+		c.JSON(http.StatusOK, Response{Status: "success", Data: currentUserID(c)})
+	})
+	return router
+}
+
+func getWithToken(router http.Handler, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPasswordResetRevokesSessions(t *testing.T) {
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	var user *User
+	var resetToken string
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, _ = createTestUser(t, ctx, tx)
+	})
+	router := authTestRouter()
+
+	session, err := issueToken(user.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiToken := apiTokenPrefix + uniqueName(t)
+	if _, err := db.Exec("INSERT INTO api_tokens (user_id, name, prefix, token_hash, scopes) VALUES ($1, 'script', $2, $3, $4)",
+		user.ID, apiToken[:len(apiTokenPrefix)+6], hashSecretToken(apiToken), `["`+scopeExpensesRead+`"]`); err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{"session": session, "API token": apiToken} {
+		if w := getWithToken(router, "/api/me", token); w.Code != http.StatusOK {
+			t.Fatalf("%s before reset: status = %d, want 200: %s", name, w.Code, w.Body)
+		}
+	}
+
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		var err error
+		resetToken, err = createAuthToken(ctx, tx, user.ID, tokenPurposeResetPassword, resetPasswordTokenTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	// Сброс в ту же секунду, что и выпуск сессии, тоже ее отзывает
+	w := doJSON(router, http.MethodPost, "/api/auth/password-reset/confirm", ResetPasswordRequest{Token: resetToken, Password: "new password 1"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("reset: status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	w = getWithToken(router, "/api/me", session)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), errTokenRevoked.Error()) {
+		t.Errorf("session after reset: status = %d, want 401 %q: %s", w.Code, errTokenRevoked, w.Body)
+	}
+	if w := getWithToken(router, "/api/me", apiToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("API token after reset: status = %d, want 401: %s", w.Code, w.Body)
+	}
+
+	fresh, err := issueToken(user.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := getWithToken(router, "/api/me", fresh); w.Code != http.StatusOK {
+		t.Errorf("session issued after reset: status = %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestRegisterDoesNotRevealTakenEmail(t *testing.T) {
+	sent := useRecordingNotifier(t)
+	var existing *User
+	email := uniqueName(t) + "@example.com"
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		var err error
+		existing, err = createUserWithTx(ctx, tx, uniqueName(t), email, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	router := authTestRouter()
+
+	fresh := doJSON(router, http.MethodPost, "/api/auth/register", RegisterRequest{
+		Username: uniqueName(t) + "-new", Email: uniqueName(t) + "-new@example.com", Password: "password 1",
+	})
+	if fresh.Code != http.StatusAccepted {
+		t.Fatalf("new email: status = %d, want 202: %s", fresh.Code, fresh.Body)
+	}
+
+	takenName := uniqueName(t) + "-taken"
+	taken := doJSON(router, http.MethodPost, "/api/auth/register", RegisterRequest{
+		Username: takenName, Email: strings.ToUpper(email), Password: "password 1",
+	})
+	if taken.Code != fresh.Code || taken.Body.String() != fresh.Body.String() {
+		t.Errorf("taken email: %d %s, want the same response as for a new email: %d %s", taken.Code, taken.Body, fresh.Code, fresh.Body)
+	}
+
+	var created bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)", takenName).Scan(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("user was created with an already registered email")
+	}
+
+	// Владелец адреса узнает о попытке из письма
+	var notified bool
+	for _, m := range sent.sent {
+		if m.to == email && m.subject == "Повторная регистрация" {
+			notified = true
+		}
+	}
+	if !notified {
+		t.Errorf("owner of %s was not notified: %v", email, sent.sent)
+	}
+
+	w := doJSON(router, http.MethodPost, "/api/auth/register", RegisterRequest{
+		Username: existing.Username, Email: uniqueName(t) + "-other@example.com", Password: "password 1",
+	})
+	if w.Code != http.StatusConflict {
+		t.Errorf("taken username: status = %d, want 409", w.Code)
+	}
+	var resp Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || strings.Contains(strings.ToLower(resp.Message), "email") {
+		t.Errorf("taken username response mentions email: %s", w.Body)
+	}
+}
+
+// Заблокированная учетная запись отвечает на неверный пароль так же, как несуществующая
+func TestLoginLockedAccountIsNotDisclosed(t *testing.T) {
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	name := uniqueName(t)
+	const password = "password 1"
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, err := createUserWithTx(ctx, tx, name, name+"@example.com", hashPassword(password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET email_verified = TRUE, locked_until = NOW() + interval '1 hour' WHERE id = $1", user.ID); err != nil {
+			t.Fatal(err)
+		}
+	})
+	router := authTestRouter()
+
+	unknown := doJSON(router, http.MethodPost, "/api/auth/login", LoginRequest{Login: name + "-unknown", Password: "wrong password"})
+	wrong := doJSON(router, http.MethodPost, "/api/auth/login", LoginRequest{Login: name, Password: "wrong password"})
+	if wrong.Code != http.StatusUnauthorized || wrong.Body.String() != unknown.Body.String() {
+		t.Errorf("locked account, wrong password: %d %s, want the response for an unknown login: %d %s", wrong.Code, wrong.Body, unknown.Code, unknown.Body)
+	}
+	if w := doJSON(router, http.MethodPost, "/api/auth/login", LoginRequest{Login: name, Password: password}); w.Code != http.StatusLocked {
+		t.Errorf("locked account, right password: status = %d, want 423: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Версия формата архива; увеличивается при несовместимых изменениях
+const backupVersion = 1
+
+// Максимальный размер загружаемого архива
+const maxBackupSize = 256 << 20
+
+type Backup struct {
+	Version    int              `json:"version"`
+	CreatedAt  time.Time        `json:"createdAt"`
+	Categories []BackupCategory `json:"categories"`
+	Expenses   []BackupExpense  `json:"expenses"`
+	Incomes    []BackupIncome   `json:"incomes"`
+	Rules      []CategoryRule   `json:"rules"`
+}
+
+type BackupCategory struct {
+	ID           int                `json:"id"`
+	Name         string             `json:"name"`
+	Description  string             `json:"description"`
+	MonthlyStats map[string]float64 `json:"monthlyStats"`
+}
+
+type BackupExpense struct {
+	ID          int       `json:"id"`
+	CategoryID  int       `json:"categoryId"`
+	Name        string    `json:"name"`
+	Amount      float64   `json:"amount"`
+	Date        time.Time `json:"date"`
+	Description string    `json:"description"`
+	Source      string    `json:"source,omitempty"`
+	ExternalID  string    `json:"externalId,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+}
+
+type BackupIncome struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Amount      float64   `json:"amount"`
+	Date        time.Time `json:"date"`
+	Description string    `json:"description"`
+	Source      string    `json:"source,omitempty"`
+	ExternalID  string    `json:"externalId,omitempty"`
+}
+
+// Итог восстановления; CategoryIDMap показывает, какие ID получили категории из архива
+type RestoreResult struct {
+	Categories    int         `json:"categories"`
+	Expenses      int         `json:"expenses"`
+	Incomes       int         `json:"incomes"`
+	Rules         int         `json:"rules"`
+	CategoryIDMap map[int]int `json:"categoryIdMap"`
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Снимок всех данных домохозяйства в одной транзакции, чтобы архив был согласованным
+func createBackup(ctx context.Context, householdID int) (*Backup, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	backup := &Backup{
+		Version:    backupVersion,
+		CreatedAt:  time.Now(),
+		Categories: []BackupCategory{},
+		Expenses:   []BackupExpense{},
+		Incomes:    []BackupIncome{},
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, name, COALESCE(description, ''), monthly_stats FROM categories WHERE household_id = $1 AND deleted_at IS NULL ORDER BY id", householdID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var cat BackupCategory
+		var monthlyStatsJSON []byte
+		if err := rows.Scan(&cat.ID, &cat.Name, &cat.Description, &monthlyStatsJSON); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		cat.MonthlyStats = make(map[string]float64)
+		if len(monthlyStatsJSON) > 0 {
+			if err := json.Unmarshal(monthlyStatsJSON, &cat.MonthlyStats); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("category %d: %v", cat.ID, err)
+			}
+		}
+		backup.Categories = append(backup.Categories, cat)
+	}
+	rows.Close()
+
+	rows, err = tx.QueryContext(ctx, "SELECT id, category_id, name, amount, date, COALESCE(description, ''), COALESCE(source, ''), COALESCE(external_id, ''), tags FROM expenses WHERE household_id = $1 AND deleted_at IS NULL ORDER BY id", householdID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var exp BackupExpense
+		var tagsJSON []byte
+		if err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &exp.Source, &exp.ExternalID, &tagsJSON); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		exp.Tags = decodeTags(tagsJSON)
+		backup.Expenses = append(backup.Expenses, exp)
+	}
+	rows.Close()
+
+	rows, err = tx.QueryContext(ctx, "SELECT id, name, amount, date, COALESCE(description, ''), COALESCE(source, ''), COALESCE(external_id, '') FROM incomes WHERE household_id = $1 ORDER BY id", householdID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var inc BackupIncome
+		if err := rows.Scan(&inc.ID, &inc.Name, &inc.Amount, &inc.Date, &inc.Description, &inc.Source, &inc.ExternalID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		backup.Incomes = append(backup.Incomes, inc)
+	}
+	rows.Close()
+
+	backup.Rules, err = queryRules(ctx, tx, householdID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return backup, nil
+}
+
+// Загружает архив в данные домохозяйства одной транзакцией. С remapIDs записи получают новые ID,
+// иначе сохраняются исходные, и любой конфликт откатывает восстановление целиком.
+// Созданные категории и расходы записываются в журнал изменений от имени actor.
+func restoreBackup(ctx context.Context, actor auditActor, backup *Backup, remapIDs bool) (*RestoreResult, error) {
+	householdID := actor.HouseholdID
+	if backup.Version < 1 || backup.Version > backupVersion {
+		return nil, fmt.Errorf("unsupported backup version: %d", backup.Version)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result := &RestoreResult{CategoryIDMap: make(map[int]int)}
+
+	// Статистика из архива не загружается: она могла устареть или считаться в другом
+	// часовом поясе и с другим началом месяца. Ее пересчитывают по восстановленным расходам.
+	for _, cat := range backup.Categories {
+		var id int
+		if remapIDs {
+			err = tx.QueryRowContext(ctx, "INSERT INTO categories (name, description, monthly_stats, household_id) VALUES ($1, $2, '{}', $3) RETURNING id",
+				cat.Name, cat.Description, householdID).Scan(&id)
+		} else {
+			err = tx.QueryRowContext(ctx, "INSERT INTO categories (id, name, description, monthly_stats, household_id) VALUES ($1, $2, $3, '{}', $4) RETURNING id",
+				cat.ID, cat.Name, cat.Description, householdID).Scan(&id)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("category %d: %v", cat.ID, err)
+		}
+		restored := Category{ID: id, Name: cat.Name, Description: cat.Description, MonthlyStats: map[string]float64{}}
+		if err := recordAudit(ctx, tx, actor, auditCreate, auditEntityCategory, id, nil, restored); err != nil {
+			return nil, err
+		}
+		result.CategoryIDMap[cat.ID] = id
+		result.Categories++
+	}
+
+	for _, exp := range backup.Expenses {
+		categoryID, ok := result.CategoryIDMap[exp.CategoryID]
+		if !ok {
+			return nil, fmt.Errorf("expense %d: category %d is not in the backup", exp.ID, exp.CategoryID)
+		}
+
+		var id int
+		if remapIDs {
+			err = tx.QueryRowContext(ctx, "INSERT INTO expenses (category_id, name, amount, date, description, source, external_id, tags, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+				categoryID, exp.Name, exp.Amount, exp.Date, exp.Description, nullString(exp.Source), nullString(exp.ExternalID), encodeTags(exp.Tags), householdID).Scan(&id)
+		} else {
+			err = tx.QueryRowContext(ctx, "INSERT INTO expenses (id, category_id, name, amount, date, description, source, external_id, tags, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id",
+				exp.ID, categoryID, exp.Name, exp.Amount, exp.Date, exp.Description, nullString(exp.Source), nullString(exp.ExternalID), encodeTags(exp.Tags), householdID).Scan(&id)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("expense %d: %v", exp.ID, err)
+		}
+		restored := Expense{ID: id, CategoryID: categoryID, Name: exp.Name, Amount: exp.Amount, Date: exp.Date, Description: exp.Description, Tags: exp.Tags}
+		if err := recordAudit(ctx, tx, actor, auditCreate, auditEntityExpense, id, nil, restored); err != nil {
+			return nil, err
+		}
+		result.Expenses++
+	}
+
+	for _, inc := range backup.Incomes {
+		if remapIDs {
+			_, err = tx.ExecContext(ctx, "INSERT INTO incomes (name, amount, date, description, source, external_id, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+				inc.Name, inc.Amount, inc.Date, inc.Description, nullString(inc.Source), nullString(inc.ExternalID), householdID)
+		} else {
+			_, err = tx.ExecContext(ctx, "INSERT INTO incomes (id, name, amount, date, description, source, external_id, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+				inc.ID, inc.Name, inc.Amount, inc.Date, inc.Description, nullString(inc.Source), nullString(inc.ExternalID), householdID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("income %d: %v", inc.ID, err)
+		}
+		result.Incomes++
+	}
+
+	for _, rule := range backup.Rules {
+		categoryID := 0
+		if rule.CategoryID != 0 {
+			var ok bool
+			categoryID, ok = result.CategoryIDMap[rule.CategoryID]
+			if !ok {
+				return nil, fmt.Errorf("rule %d: category %d is not in the backup", rule.ID, rule.CategoryID)
+			}
+		}
+
+		if remapIDs {
+			_, err = tx.ExecContext(ctx, "INSERT INTO category_rules (name, priority, name_contains, description_contains, pattern, min_amount, max_amount, payee, category_id, tags, enabled, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)",
+				rule.Name, rule.Priority, nullString(rule.NameContains), nullString(rule.DescriptionContains), nullString(rule.Pattern),
+				nullFloat(rule.MinAmount), nullFloat(rule.MaxAmount), nullString(rule.Payee), nullInt(categoryID), encodeTags(rule.Tags), rule.Enabled, householdID)
+		} else {
+			_, err = tx.ExecContext(ctx, "INSERT INTO category_rules (id, name, priority, name_contains, description_contains, pattern, min_amount, max_amount, payee, category_id, tags, enabled, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)",
+				rule.ID, rule.Name, rule.Priority, nullString(rule.NameContains), nullString(rule.DescriptionContains), nullString(rule.Pattern),
+				nullFloat(rule.MinAmount), nullFloat(rule.MaxAmount), nullString(rule.Payee), nullInt(categoryID), encodeTags(rule.Tags), rule.Enabled, householdID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", rule.ID, err)
+		}
+		result.Rules++
+	}
+
+	if err := recomputeMonthlyStatsWithTx(ctx, tx, householdID); err != nil {
+		return nil, err
+	}
+
+	// После вставки с явными ID последовательности нужно сдвинуть вперед
+	if !remapIDs {
+		for _, table := range householdTables {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE((SELECT MAX(id) FROM %s), 0) + 1, false)", table, table))
+			if err != nil {
+				return nil, fmt.Errorf("resetting %s sequence: %v", table, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// После массовой загрузки модель проще обучить заново
+	if err := trainClassifier(ctx); err != nil {
+		log.Printf("Error retraining category classifier: %v", err)
+	}
+
+	return result, nil
+}
+
+func readBackup(r io.Reader) (*Backup, error) {
+	var backup Backup
+	decoder := json.NewDecoder(io.LimitReader(r, maxBackupSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&backup); err != nil {
+		return nil, fmt.Errorf("invalid backup: %v", err)
+	}
+	return &backup, nil
+}
+
+func getBackup(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	backup, err := createBackup(ctx, currentHouseholdID(c))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	filename := fmt.Sprintf("expenses-backup-%s.json", backup.CreatedAt.Format("20060102-150405"))
+	extendWriteDeadline(c, 60*time.Second)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.JSON(http.StatusOK, backup)
+}
+
+func restoreFromBackup(c *gin.Context) {
+	backup, err := readBackup(c.Request.Body)
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	result, err := restoreBackup(ctx, auditActorFrom(c), backup, c.Query("remapIds") == "true")
+	if err != nil {
+		respondWithError(c, http.StatusConflict, "Restore rolled back: "+err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Backup restored successfully",
+		Data:    result,
+	})
+}
+
+// Подкоманда: expense-tracker backup -user NAME [-o file.json]
+func runBackupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	username := fs.String("user", "", "user whose default household is backed up")
+	output := fs.String("o", "", "output file (default stdout)")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	householdID, err := lookupHouseholdID(ctx, *username)
+	if err != nil {
+		return err
+	}
+
+	backup, err := createBackup(ctx, householdID)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(backup)
+}
+
+// Подкоманда: expense-tracker restore -user NAME [-remap-ids] file.json
+func runRestoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	username := fs.String("user", "", "user whose default household receives the data")
+	remapIDs := fs.Bool("remap-ids", false, "assign new IDs instead of keeping the archived ones")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: restore -user NAME [-remap-ids] file.json")
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	backup, err := readBackup(file)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	actor, err := lookupAuditActor(ctx, *username)
+	if err != nil {
+		return err
+	}
+
+	result, err := restoreBackup(ctx, actor, backup, *remapIDs)
+	if err != nil {
+		return fmt.Errorf("restore rolled back: %v", err)
+	}
+
+	fmt.Printf("Restored %d categories, %d expenses, %d incomes\n", result.Categories, result.Expenses, result.Incomes)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadBackupRejectsUnknownFields(t *testing.T) {
+	if _, err := readBackup(strings.NewReader(`{"version": 1, "categories": [], "users": []}`)); err == nil {
+		t.Error("backup with unknown fields was accepted")
+	}
+	backup, err := readBackup(strings.NewReader(`{"version": 1, "categories": [{"id": 1, "name": "Food", "monthlyStats": {"2024-01": 10}}]}`))
+	if err != nil {
+		t.Fatalf("readBackup: %v", err)
+	}
+	if len(backup.Categories) != 1 || backup.Categories[0].Name != "Food" {
+		t.Errorf("categories = %+v", backup.Categories)
+	}
+}
+
+// Статистика из архива не используется: ее пересчитывают по расходам
+// в часовом поясе и календаре домохозяйства, куда восстанавливают
+func TestRestoreBackupRecomputesMonthlyStats(t *testing.T) {
+	var user *User
+	var householdID int
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, householdID = createTestUser(t, ctx, tx)
+		if _, err := tx.ExecContext(ctx, "UPDATE households SET timezone = 'Asia/Vladivostok', month_start_day = 1 WHERE id = $1", householdID); err != nil {
+			t.Fatal(err)
+		}
+	})
+	ctx := context.Background()
+	actor := auditActor{HouseholdID: householdID, UserID: user.ID}
+
+	backup := &Backup{
+		Version: backupVersion,
+		Categories: []BackupCategory{
+			{ID: 1, Name: "Food", MonthlyStats: map[string]float64{"1999-01": 999, "2024-01": 150}},
+			{ID: 2, Name: "Empty", MonthlyStats: map[string]float64{"2024-01": 10}},
+		},
+		Expenses: []BackupExpense{
+			// В UTC оба расхода январские, но 31 января 15:00 UTC во Владивостоке - уже февраль
+			{ID: 1, CategoryID: 1, Name: "Lunch", Amount: 100, Date: time.Date(2024, time.January, 31, 15, 0, 0, 0, time.UTC)},
+			{ID: 2, CategoryID: 1, Name: "Bread", Amount: 50, Date: time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)},
+		},
+	}
+	result, err := restoreBackup(ctx, actor, backup, true)
+	if err != nil {
+		t.Fatalf("restoreBackup: %v", err)
+	}
+	if result.Categories != 2 || result.Expenses != 2 {
+		t.Fatalf("restored %+v", result)
+	}
+
+	assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, result.CategoryIDMap[1]), map[string]float64{"2024-01": 50, "2024-02": 100})
+	assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, result.CategoryIDMap[2]), map[string]float64{})
+}
+
+func TestRestoreBackupIsAtomic(t *testing.T) {
+	var user *User
+	var householdID int
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, householdID = createTestUser(t, ctx, tx)
+	})
+	ctx := context.Background()
+
+	backup := &Backup{
+		Version:    backupVersion,
+		Categories: []BackupCategory{{ID: 1, Name: "Food"}},
+		Expenses: []BackupExpense{
+			{ID: 1, CategoryID: 1, Name: "Lunch", Amount: 100, Date: time.Now()},
+			{ID: 2, CategoryID: 7, Name: "Orphan", Amount: 50, Date: time.Now()},
+		},
+	}
+	if _, err := restoreBackup(ctx, auditActor{HouseholdID: householdID, UserID: user.ID}, backup, true); err == nil {
+		t.Fatal("backup with an expense outside its categories was restored")
+	}
+
+	var categories int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM categories WHERE household_id = $1", householdID).Scan(&categories); err != nil {
+		t.Fatal(err)
+	}
+	if categories != 0 {
+		t.Errorf("failed restore left %d categories", categories)
+	}
+
+	if _, err := restoreBackup(ctx, auditActor{HouseholdID: householdID, UserID: user.ID}, &Backup{Version: backupVersion + 1}, true); err == nil {
+		t.Error("backup of a newer format was restored")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+type MergeCategoriesRequest struct {
+	SourceIDs []int `json:"sourceIds" binding:"required,min=1"`
+	TargetID  int   `json:"targetId" binding:"required"`
+}
+
+type MergeCategoriesResult struct {
+	Category      *Category `json:"category"`
+	MovedExpenses int       `json:"movedExpenses"`
+	UpdatedRules  int       `json:"updatedRules"`
+}
+
+// Заменяет теги с названиями исходных категорий названием целевой, без повторов
+func replaceCategoryTags(tags []string, sourceNames map[string]bool, targetName string) []string {
+	seen := make(map[string]bool, len(tags))
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if sourceNames[strings.ToLower(tag)] {
+			tag = targetName
+		}
+		if !seen[strings.ToLower(tag)] {
+			seen[strings.ToLower(tag)] = true
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// Сливает исходные категории в целевую одной транзакцией: переносит расходы (включая
+// лежащие в корзине), суммирует месячную статистику, перенаправляет правила, заменяет
+// теги с названиями исходных категорий и отправляет исходные категории в корзину.
+func mergeCategories(c *gin.Context) {
+	var req MergeCategoriesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	seen := map[int]bool{req.TargetID: true}
+	for _, id := range req.SourceIDs {
+		if seen[id] {
+			respondWithError(c, http.StatusBadRequest, "sourceIds must be unique and must not contain targetId")
+			return
+		}
+		seen[id] = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	householdID := currentHouseholdID(c)
+	target, err := loadCategoryForAudit(ctx, tx, strconv.Itoa(req.TargetID), householdID)
+	if err == sql.ErrNoRows {
+		respondWithError(c, http.StatusNotFound, "Category "+strconv.Itoa(req.TargetID)+" not found")
+		return
+	}
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	targetBefore := *target
+	targetBefore.MonthlyStats = make(map[string]float64, len(target.MonthlyStats))
+	for month, amount := range target.MonthlyStats {
+		targetBefore.MonthlyStats[month] = amount
+	}
+
+	sources := make([]*Category, 0, len(req.SourceIDs))
+	sourceNames := make(map[string]bool, len(req.SourceIDs))
+	var lowerNames []string
+	for _, id := range req.SourceIDs {
+		source, err := loadCategoryForAudit(ctx, tx, strconv.Itoa(id), householdID)
+		if err == sql.ErrNoRows {
+			respondWithError(c, http.StatusNotFound, "Category "+strconv.Itoa(id)+" not found")
+			return
+		}
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		sources = append(sources, source)
+		for month, amount := range source.MonthlyStats {
+			target.MonthlyStats[month] += amount
+		}
+		name := strings.ToLower(source.Name)
+		if !sourceNames[name] {
+			sourceNames[name] = true
+			lowerNames = append(lowerNames, name)
+		}
+	}
+
+	// Расходы исходных категорий и расходы с тегами-названиями исходных категорий
+	rows, err := tx.QueryContext(ctx, `SELECT id, category_id, name, amount, date, description, tags, deleted_at IS NOT NULL FROM expenses
+		WHERE household_id = $1 AND (category_id = ANY($2) OR EXISTS (SELECT 1 FROM jsonb_array_elements_text(COALESCE(tags, '[]'::jsonb)) t WHERE lower(t) = ANY($3)))
+		ORDER BY id FOR UPDATE`,
+		householdID, pq.Array(req.SourceIDs), pq.Array(lowerNames))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	type affectedExpense struct {
+		before  Expense
+		trashed bool
+	}
+	var affected []affectedExpense
+	for rows.Next() {
+		var a affectedExpense
+		var tagsJSON []byte
+		if err := rows.Scan(&a.before.ID, &a.before.CategoryID, &a.before.Name, &a.before.Amount, &a.before.Date, &a.before.Description, &tagsJSON, &a.trashed); err != nil {
+			rows.Close()
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		a.before.Tags = decodeTags(tagsJSON)
+		affected = append(affected, a)
+	}
+	rows.Close()
+
+	actor := auditActorFrom(c)
+	moved := 0
+	var reclassified []Expense
+	for _, a := range affected {
+		after := a.before
+		if seen[after.CategoryID] && after.CategoryID != target.ID {
+			after.CategoryID = target.ID
+			moved++
+		}
+		after.Tags = replaceCategoryTags(a.before.Tags, sourceNames, target.Name)
+		if after.CategoryID == a.before.CategoryID && equalTags(after.Tags, a.before.Tags) {
+			continue
+		}
+
+		_, err := tx.ExecContext(ctx, "UPDATE expenses SET category_id = $1, tags = $2, version = version + 1 WHERE id = $3", after.CategoryID, encodeTags(after.Tags), after.ID)
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := recordAudit(ctx, tx, actor, auditUpdate, auditEntityExpense, after.ID, a.before, after); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !a.trashed && after.CategoryID != a.before.CategoryID {
+			reclassified = append(reclassified, after)
+		}
+	}
+
+	// Правила исходных категорий и правила, добавляющие их названия тегами
+	ruleRows, err := tx.QueryContext(ctx, `SELECT id, category_id, tags FROM category_rules
+		WHERE household_id = $1 AND (category_id = ANY($2) OR EXISTS (SELECT 1 FROM jsonb_array_elements_text(COALESCE(tags, '[]'::jsonb)) t WHERE lower(t) = ANY($3)))
+		ORDER BY id FOR UPDATE`,
+		householdID, pq.Array(req.SourceIDs), pq.Array(lowerNames))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	type affectedRule struct {
+		id         int
+		categoryID int
+		tags       []string
+	}
+	var rules []affectedRule
+	for ruleRows.Next() {
+		var r affectedRule
+		var categoryID *int
+		var tagsJSON []byte
+		if err := ruleRows.Scan(&r.id, &categoryID, &tagsJSON); err != nil {
+			ruleRows.Close()
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if categoryID != nil {
+			r.categoryID = *categoryID
+		}
+		r.tags = decodeTags(tagsJSON)
+		rules = append(rules, r)
+	}
+	ruleRows.Close()
+
+	for _, r := range rules {
+		categoryID := r.categoryID
+		if seen[categoryID] {
+			categoryID = target.ID
+		}
+		_, err := tx.ExecContext(ctx, "UPDATE category_rules SET category_id = $1, tags = $2 WHERE id = $3",
+			nullInt(categoryID), encodeTags(replaceCategoryTags(r.tags, sourceNames, target.Name)), r.id)
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	statsJSON, err := json.Marshal(target.MonthlyStats)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.QueryRowContext(ctx, "UPDATE categories SET monthly_stats = $1, version = version + 1 WHERE id = $2 RETURNING version", statsJSON, target.ID).Scan(&target.Version); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := recordAudit(ctx, tx, actor, auditUpdate, auditEntityCategory, target.ID, targetBefore, target); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Статистика исходных категорий уже учтена в целевой, поэтому в корзину они уходят пустыми
+	for _, source := range sources {
+		if _, err := tx.ExecContext(ctx, "UPDATE categories SET monthly_stats = '{}', deleted_at = NOW(), version = version + 1 WHERE id = $1", source.ID); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := recordAudit(ctx, tx, actor, auditDelete, auditEntityCategory, source.ID, source, nil); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, source := range sources {
+		classifier.RemoveCategory(householdID, source.ID)
+	}
+	for i := range reclassified {
+		classifier.Add(householdID, &reclassified[i])
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: fmt.Sprintf("%d categories merged into %s", len(sources), target.Name),
+		Data: MergeCategoriesResult{
+			Category:      target,
+			MovedExpenses: moved,
+			UpdatedRules:  len(rules),
+		},
+	})
+}
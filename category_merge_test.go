@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReplaceCategoryTags(t *testing.T) {
+	sources := map[string]bool{"cafe": true, "groceries": true}
+	tests := []struct {
+		tags []string
+		want []string
+	}{
+		{nil, []string{}},
+		{[]string{"lunch"}, []string{"lunch"}},
+		{[]string{"Cafe", "lunch"}, []string{"Food", "lunch"}},
+		{[]string{"cafe", "GROCERIES"}, []string{"Food"}},
+		{[]string{"food", "Cafe"}, []string{"food"}},
+	}
+	for _, tt := range tests {
+		if got := replaceCategoryTags(tt.tags, sources, "Food"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("replaceCategoryTags(%v) = %v, want %v", tt.tags, got, tt.want)
+		}
+	}
+}
+
+type mergeResponse struct {
+	Data MergeCategoriesResult `json:"data"`
+}
+
+func TestMergeCategories(t *testing.T) {
+	var user *User
+	var householdID, food, cafe, groceries, other int
+	var trashed, tagged Expense
+	var cafeRule, tagRule int
+	january := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+	february := time.Date(2024, time.February, 10, 12, 0, 0, 0, time.UTC)
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, householdID = createTestUser(t, ctx, tx)
+		if _, err := tx.ExecContext(ctx, "UPDATE households SET timezone = 'UTC', month_start_day = 1 WHERE id = $1", householdID); err != nil {
+			t.Fatal(err)
+		}
+		food = createTestCategory(t, ctx, tx, householdID, "Food")
+		cafe = createTestCategory(t, ctx, tx, householdID, "Cafe")
+		groceries = createTestCategory(t, ctx, tx, householdID, "Groceries")
+		other = createTestCategory(t, ctx, tx, householdID, "Other")
+
+		createTestExpense(t, ctx, tx, householdID, food, "Bread", 50, january)
+		createTestExpense(t, ctx, tx, householdID, cafe, "Latte", 200, january)
+		createTestExpense(t, ctx, tx, householdID, groceries, "Market", 300, february)
+		// Расход в корзине уже вычтен из статистики, но тоже переезжает в целевую категорию
+		trashed = createTestExpense(t, ctx, tx, householdID, groceries, "Old market", 100, january)
+		if _, err := tx.ExecContext(ctx, "UPDATE expenses SET deleted_at = NOW() WHERE id = $1", trashed.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := updateMonthlyStatsWithTx(ctx, tx, groceries, -trashed.Amount, trashed.Date); err != nil {
+			t.Fatal(err)
+		}
+		tagged = createTestExpense(t, ctx, tx, householdID, other, "Snacks", 70, january)
+		if _, err := tx.ExecContext(ctx, `UPDATE expenses SET tags = '["cafe", "snacks"]' WHERE id = $1`, tagged.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tx.QueryRowContext(ctx, "INSERT INTO category_rules (name, name_contains, category_id, household_id) VALUES ('Coffee', 'coffee', $1, $2) RETURNING id",
+			cafe, householdID).Scan(&cafeRule); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.QueryRowContext(ctx, `INSERT INTO category_rules (name, name_contains, category_id, tags, household_id) VALUES ('Shop', 'shop', $1, '["Groceries"]', $2) RETURNING id`,
+			other, householdID).Scan(&tagRule); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	router := testRouter(user.ID, householdID)
+	router.POST("/api/categories/merge", mergeCategories)
+	ctx := context.Background()
+
+	t.Run("invalid requests change nothing", func(t *testing.T) {
+		for _, req := range []MergeCategoriesRequest{
+			{SourceIDs: []int{food}, TargetID: food},
+			{SourceIDs: []int{cafe, cafe}, TargetID: food},
+			{SourceIDs: []int{cafe, -1}, TargetID: food},
+			{SourceIDs: []int{cafe}, TargetID: -1},
+		} {
+			w := doJSON(router, http.MethodPost, "/api/categories/merge", req)
+			if w.Code != http.StatusBadRequest && w.Code != http.StatusNotFound {
+				t.Errorf("merge %+v: status = %d, want 400 or 404: %s", req, w.Code, w.Body)
+			}
+		}
+
+		var deleted bool
+		if err := db.QueryRowContext(ctx, "SELECT deleted_at IS NOT NULL FROM categories WHERE id = $1", cafe).Scan(&deleted); err != nil {
+			t.Fatal(err)
+		}
+		if deleted {
+			t.Fatal("failed merge moved the source category to the trash")
+		}
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), map[string]float64{"2024-01": 50})
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		targetVersion := loadTestCategoryVersion(t, ctx, db, food)
+		w := doJSON(router, http.MethodPost, "/api/categories/merge", MergeCategoriesRequest{SourceIDs: []int{cafe, groceries}, TargetID: food})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+		var resp mergeResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data.MovedExpenses != 3 || resp.Data.UpdatedRules != 2 {
+			t.Errorf("moved %d expenses and %d rules, want 3 and 2", resp.Data.MovedExpenses, resp.Data.UpdatedRules)
+		}
+		if resp.Data.Category == nil || resp.Data.Category.Version != targetVersion+1 {
+			t.Fatalf("target = %+v, want version %d", resp.Data.Category, targetVersion+1)
+		}
+
+		// Статистика целевой категории совпадает с пересчетом по ее расходам
+		want := map[string]float64{"2024-01": 250, "2024-02": 300}
+		assertMonthlyStats(t, resp.Data.Category.MonthlyStats, want)
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), want)
+
+		var left int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM expenses WHERE category_id = ANY(ARRAY[$1, $2]::int[])", cafe, groceries).Scan(&left); err != nil {
+			t.Fatal(err)
+		}
+		if left != 0 {
+			t.Errorf("%d expenses, including trashed, left in source categories", left)
+		}
+		var trashedCategory int
+		var trashedStill bool
+		if err := db.QueryRowContext(ctx, "SELECT category_id, deleted_at IS NOT NULL FROM expenses WHERE id = $1", trashed.ID).Scan(&trashedCategory, &trashedStill); err != nil {
+			t.Fatal(err)
+		}
+		if trashedCategory != food || !trashedStill {
+			t.Errorf("trashed expense: category %d, in trash %v; want %d, true", trashedCategory, trashedStill, food)
+		}
+
+		var tagsJSON []byte
+		if err := db.QueryRowContext(ctx, "SELECT tags FROM expenses WHERE id = $1", tagged.ID).Scan(&tagsJSON); err != nil {
+			t.Fatal(err)
+		}
+		if tags := decodeTags(tagsJSON); !reflect.DeepEqual(tags, []string{"Food", "snacks"}) {
+			t.Errorf("tags = %v, want [Food snacks]", tags)
+		}
+
+		var ruleCategory int
+		if err := db.QueryRowContext(ctx, "SELECT category_id FROM category_rules WHERE id = $1", cafeRule).Scan(&ruleCategory); err != nil {
+			t.Fatal(err)
+		}
+		if ruleCategory != food {
+			t.Errorf("rule category = %d, want %d", ruleCategory, food)
+		}
+		if err := db.QueryRowContext(ctx, "SELECT category_id, tags FROM category_rules WHERE id = $1", tagRule).Scan(&ruleCategory, &tagsJSON); err != nil {
+			t.Fatal(err)
+		}
+		if tags := decodeTags(tagsJSON); ruleCategory != other || !reflect.DeepEqual(tags, []string{"Food"}) {
+			t.Errorf("tag rule: category %d, tags %v; want %d, [Food]", ruleCategory, tags, other)
+		}
+
+		for _, id := range []int{cafe, groceries} {
+			var deleted bool
+			if err := db.QueryRowContext(ctx, "SELECT deleted_at IS NOT NULL FROM categories WHERE id = $1", id).Scan(&deleted); err != nil {
+				t.Fatal(err)
+			}
+			if !deleted {
+				t.Errorf("source category %d is not in the trash", id)
+			}
+			assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, id), map[string]float64{})
+		}
+
+		var audited int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_log WHERE household_id = $1 AND entity = $2 AND entity_id = ANY(ARRAY[$3, $4, $5]::int[])",
+			householdID, auditEntityCategory, food, cafe, groceries).Scan(&audited); err != nil {
+			t.Fatal(err)
+		}
+		if audited != 3 {
+			t.Errorf("audit entries for merged categories = %d, want 3", audited)
+		}
+	})
+
+	t.Run("trashed source", func(t *testing.T) {
+		w := doJSON(router, http.MethodPost, "/api/categories/merge", MergeCategoriesRequest{SourceIDs: []int{cafe}, TargetID: other})
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("status = %d, want 404: %s", w.Code, w.Body)
+		}
+	})
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Максимальное число подсказок в ответе
+const maxCategorySuggestions = 5
+
+// Наивный байесовский классификатор категорий по словам из названия и описания расхода
+// и порядку суммы. У каждого домохозяйства своя модель со своим словарем.
+type categoryClassifier struct {
+	mu          sync.RWMutex
+	docs        map[int]int
+	tokens      map[int]map[string]int
+	tokenTotals map[int]int
+	vocabulary  map[string]int
+	totalDocs   int
+}
+
+type CategorySuggestion struct {
+	CategoryID   int     `json:"categoryId"`
+	CategoryName string  `json:"categoryName"`
+	Confidence   float64 `json:"confidence"`
+}
+
+type SuggestCategoryRequest struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+// Модели классификатора по домохозяйствам. Обучаются на таблице expenses при старте
+// и дообучаются при изменениях.
+type householdClassifiers struct {
+	mu     sync.RWMutex
+	models map[int]*categoryClassifier
+}
+
+var classifier = newHouseholdClassifiers()
+
+func newHouseholdClassifiers() *householdClassifiers {
+	return &householdClassifiers{models: make(map[int]*categoryClassifier)}
+}
+
+// Модель домохозяйства; создается при первом обращении
+func (h *householdClassifiers) model(householdID int) *categoryClassifier {
+	h.mu.RLock()
+	cl := h.models[householdID]
+	h.mu.RUnlock()
+	if cl != nil {
+		return cl
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cl = h.models[householdID]; cl == nil {
+		cl = newCategoryClassifier()
+		h.models[householdID] = cl
+	}
+	return cl
+}
+
+func (h *householdClassifiers) Add(householdID int, exp *Expense) {
+	h.model(householdID).Add(exp)
+}
+
+func (h *householdClassifiers) Remove(householdID int, exp *Expense) {
+	h.model(householdID).Remove(exp)
+}
+
+func (h *householdClassifiers) Replace(householdID int, oldExp, newExp *Expense) {
+	h.model(householdID).Replace(oldExp, newExp)
+}
+
+func (h *householdClassifiers) RemoveCategory(householdID, categoryID int) {
+	h.model(householdID).RemoveCategory(categoryID)
+}
+
+func (h *householdClassifiers) Predict(householdID int, name, description string, amount float64, categories map[int]string) []CategorySuggestion {
+	h.mu.RLock()
+	cl := h.models[householdID]
+	h.mu.RUnlock()
+	if cl == nil {
+		return nil
+	}
+	return cl.Predict(name, description, amount, categories)
+}
+
+func newCategoryClassifier() *categoryClassifier {
+	return &categoryClassifier{
+		docs:        make(map[int]int),
+		tokens:      make(map[int]map[string]int),
+		tokenTotals: make(map[int]int),
+		vocabulary:  make(map[string]int),
+	}
+}
+
+// Признаки расхода: слова длиннее одного символа и корзина суммы по порядку величины
+func expenseFeatures(name, description string, amount float64) []string {
+	words := strings.FieldsFunc(strings.ToLower(name+" "+description), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	features := make([]string, 0, len(words)+1)
+	for _, word := range words {
+		if len([]rune(word)) > 1 {
+			features = append(features, word)
+		}
+	}
+	if amount > 0 {
+		// Полшага по десятичному логарифму: 1-3, 3-10, 10-30 и т.д.
+		features = append(features, fmt.Sprintf("#amount:%d", int(math.Floor(math.Log10(amount)*2))))
+	}
+	return features
+}
+
+func (cl *categoryClassifier) update(categoryID int, features []string, delta int) {
+	if categoryID == 0 {
+		return
+	}
+
+	cl.docs[categoryID] += delta
+	cl.totalDocs += delta
+	if cl.tokens[categoryID] == nil {
+		cl.tokens[categoryID] = make(map[string]int)
+	}
+	for _, f := range features {
+		cl.tokens[categoryID][f] += delta
+		cl.tokenTotals[categoryID] += delta
+		cl.vocabulary[f] += delta
+		if cl.tokens[categoryID][f] <= 0 {
+			delete(cl.tokens[categoryID], f)
+		}
+		if cl.vocabulary[f] <= 0 {
+			delete(cl.vocabulary, f)
+		}
+	}
+	if cl.docs[categoryID] <= 0 {
+		cl.totalDocs -= cl.docs[categoryID]
+		delete(cl.docs, categoryID)
+		delete(cl.tokens, categoryID)
+		delete(cl.tokenTotals, categoryID)
+	}
+}
+
+// Учитывает новый расход
+func (cl *categoryClassifier) Add(exp *Expense) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.update(exp.CategoryID, expenseFeatures(exp.Name, exp.Description, exp.Amount), 1)
+}
+
+// Забывает удаленный или измененный расход
+func (cl *categoryClassifier) Remove(exp *Expense) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.update(exp.CategoryID, expenseFeatures(exp.Name, exp.Description, exp.Amount), -1)
+}
+
+// Переобучение после изменения расхода: старая версия забывается, новая учитывается
+func (cl *categoryClassifier) Replace(oldExp, newExp *Expense) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.update(oldExp.CategoryID, expenseFeatures(oldExp.Name, oldExp.Description, oldExp.Amount), -1)
+	cl.update(newExp.CategoryID, expenseFeatures(newExp.Name, newExp.Description, newExp.Amount), 1)
+}
+
+// Удаляет категорию из модели целиком
+func (cl *categoryClassifier) RemoveCategory(categoryID int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for f, count := range cl.tokens[categoryID] {
+		cl.vocabulary[f] -= count
+		if cl.vocabulary[f] <= 0 {
+			delete(cl.vocabulary, f)
+		}
+	}
+	cl.totalDocs -= cl.docs[categoryID]
+	delete(cl.docs, categoryID)
+	delete(cl.tokens, categoryID)
+	delete(cl.tokenTotals, categoryID)
+}
+
+// Вероятности категорий по убыванию среди переданных (неудаленные категории домохозяйства);
+// сглаживание Лапласа, нормировка через softmax
+func (cl *categoryClassifier) Predict(name, description string, amount float64, categories map[int]string) []CategorySuggestion {
+	features := expenseFeatures(name, description, amount)
+
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+
+	totalDocs := 0
+	for categoryID := range categories {
+		totalDocs += cl.docs[categoryID]
+	}
+	if totalDocs == 0 {
+		return nil
+	}
+
+	vocabularySize := float64(len(cl.vocabulary) + 1)
+	scores := make(map[int]float64, len(categories))
+	maxScore := math.Inf(-1)
+	for categoryID := range categories {
+		docs := cl.docs[categoryID]
+		if docs == 0 {
+			continue
+		}
+		score := math.Log(float64(docs) / float64(totalDocs))
+		denominator := float64(cl.tokenTotals[categoryID]) + vocabularySize
+		for _, f := range features {
+			score += math.Log((float64(cl.tokens[categoryID][f]) + 1) / denominator)
+		}
+		scores[categoryID] = score
+		if score > maxScore {
+			maxScore = score
+		}
+	}
+
+	var sum float64
+	suggestions := make([]CategorySuggestion, 0, len(scores))
+	for categoryID, score := range scores {
+		p := math.Exp(score - maxScore)
+		sum += p
+		suggestions = append(suggestions, CategorySuggestion{CategoryID: categoryID, CategoryName: categories[categoryID], Confidence: p})
+	}
+	for i := range suggestions {
+		suggestions[i].Confidence = math.Round(suggestions[i].Confidence/sum*1000) / 1000
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Confidence != suggestions[j].Confidence {
+			return suggestions[i].Confidence > suggestions[j].Confidence
+		}
+		return suggestions[i].CategoryID < suggestions[j].CategoryID
+	})
+	return suggestions
+}
+
+// Полное обучение на существующих расходах
+func trainClassifier(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "SELECT household_id, category_id, name, COALESCE(description, ''), amount FROM expenses WHERE category_id IS NOT NULL AND household_id IS NOT NULL AND deleted_at IS NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	models := make(map[int]*categoryClassifier)
+	count := 0
+	for rows.Next() {
+		var householdID int
+		var exp Expense
+		if err := rows.Scan(&householdID, &exp.CategoryID, &exp.Name, &exp.Description, &exp.Amount); err != nil {
+			return err
+		}
+		model := models[householdID]
+		if model == nil {
+			model = newCategoryClassifier()
+			models[householdID] = model
+		}
+		model.update(exp.CategoryID, expenseFeatures(exp.Name, exp.Description, exp.Amount), 1)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	classifier.mu.Lock()
+	classifier.models = models
+	classifier.mu.Unlock()
+
+	log.Printf("Category classifier trained on %d expenses in %d households", count, len(models))
+	return nil
+}
+
+func suggestCategory(c *gin.Context) {
+	var req SuggestCategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" && strings.TrimSpace(req.Description) == "" {
+		respondWithError(c, http.StatusBadRequest, "name or description is required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Подсказки только среди категорий домохозяйства
+	householdID := currentHouseholdID(c)
+	rows, err := db.QueryContext(ctx, "SELECT id, name FROM categories WHERE household_id = $1 AND deleted_at IS NULL", householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	names := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		names[id] = name
+	}
+	rows.Close()
+
+	suggestions := classifier.Predict(householdID, req.Name, req.Description, req.Amount, names)
+	if len(suggestions) > maxCategorySuggestions {
+		suggestions = suggestions[:maxCategorySuggestions]
+	}
+	if suggestions == nil {
+		suggestions = []CategorySuggestion{}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data:   suggestions,
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpenseFeatures(t *testing.T) {
+	tests := []struct {
+		name, description string
+		amount            float64
+		want              []string
+	}{
+		{name: "Пятёрочка, продукты", amount: 250, want: []string{"пятёрочка", "продукты", "#amount:4"}},
+		{name: "AZS-42 a", description: "Fuel", amount: 1500, want: []string{"azs", "42", "fuel", "#amount:6"}},
+		{name: "Taxi", amount: 2.9, want: []string{"taxi", "#amount:0"}},
+		{name: "Taxi", amount: 3.2, want: []string{"taxi", "#amount:1"}},
+		{name: "x", want: []string{}},
+	}
+	for _, tt := range tests {
+		got := expenseFeatures(tt.name, tt.description, tt.amount)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expenseFeatures(%q, %q, %v) = %q, want %q", tt.name, tt.description, tt.amount, got, tt.want)
+		}
+	}
+}
+
+// Счетчики модели после Add/Remove должны совпадать с моделью, обученной с нуля
+func assertClassifierCounts(t *testing.T, got *categoryClassifier, expenses ...Expense) {
+	t.Helper()
+	want := newCategoryClassifier()
+	for i := range expenses {
+		want.Add(&expenses[i])
+	}
+	if got.totalDocs != want.totalDocs || !reflect.DeepEqual(got.docs, want.docs) || !reflect.DeepEqual(got.tokens, want.tokens) ||
+		!reflect.DeepEqual(got.tokenTotals, want.tokenTotals) || !reflect.DeepEqual(got.vocabulary, want.vocabulary) {
+		t.Errorf("model = docs %v tokens %v totals %v vocabulary %v (%d docs), want docs %v tokens %v totals %v vocabulary %v (%d docs)",
+			got.docs, got.tokens, got.tokenTotals, got.vocabulary, got.totalDocs,
+			want.docs, want.tokens, want.tokenTotals, want.vocabulary, want.totalDocs)
+	}
+}
+
+func TestClassifierBookkeeping(t *testing.T) {
+	bread := Expense{CategoryID: 1, Name: "Bread", Amount: 50}
+	milk := Expense{CategoryID: 1, Name: "Milk", Description: "Bread shop", Amount: 80}
+	taxi := Expense{CategoryID: 2, Name: "Taxi", Amount: 500}
+	uncategorized := Expense{Name: "Something", Amount: 10}
+
+	cl := newCategoryClassifier()
+	cl.Add(&bread)
+	cl.Add(&milk)
+	cl.Add(&taxi)
+	cl.Add(&uncategorized)
+	assertClassifierCounts(t, cl, bread, milk, taxi)
+	if cl.vocabulary["bread"] != 2 || cl.tokens[1]["bread"] != 2 || cl.tokenTotals[1] != 6 {
+		t.Errorf("counts for bread: vocabulary %d, category %d, category total %d", cl.vocabulary["bread"], cl.tokens[1]["bread"], cl.tokenTotals[1])
+	}
+
+	cl.Remove(&milk)
+	assertClassifierCounts(t, cl, bread, taxi)
+
+	// Изменение расхода: старая версия забывается, новая учитывается
+	moved := taxi
+	moved.CategoryID = 1
+	moved.Name = "Bread delivery"
+	cl.Replace(&taxi, &moved)
+	assertClassifierCounts(t, cl, bread, moved)
+	if _, ok := cl.docs[2]; ok {
+		t.Errorf("category 2 without expenses is still in the model: %v", cl.docs)
+	}
+
+	cl.Add(&taxi)
+	cl.RemoveCategory(1)
+	assertClassifierCounts(t, cl, taxi)
+
+	cl.RemoveCategory(2)
+	assertClassifierCounts(t, cl)
+	if len(cl.vocabulary) != 0 {
+		t.Errorf("vocabulary = %v, want empty", cl.vocabulary)
+	}
+}
+
+func TestClassifierPredict(t *testing.T) {
+	cl := newCategoryClassifier()
+	for _, exp := range []Expense{
+		{CategoryID: 1, Name: "Пятёрочка", Amount: 300},
+		{CategoryID: 1, Name: "Пятёрочка продукты", Amount: 700},
+		{CategoryID: 1, Name: "Магнит", Amount: 400},
+		{CategoryID: 2, Name: "Такси", Amount: 500},
+		{CategoryID: 3, Name: "Пятёрочка", Amount: 300},
+	} {
+		exp := exp
+		cl.Add(&exp)
+	}
+
+	got := cl.Predict("Пятёрочка", "", 350, map[int]string{1: "Продукты", 2: "Транспорт", 4: "Пустая"})
+	if len(got) != 2 || got[0].CategoryID != 1 || got[0].CategoryName != "Продукты" || got[1].CategoryID != 2 {
+		t.Fatalf("suggestions = %+v, want Продукты then Транспорт", got)
+	}
+	if got[0].Confidence <= got[1].Confidence || got[0].Confidence+got[1].Confidence < 0.999 {
+		t.Errorf("confidences = %v and %v", got[0].Confidence, got[1].Confidence)
+	}
+
+	// Категории вне переданного набора не предлагаются, даже если подходят лучше
+	got = cl.Predict("Пятёрочка", "", 300, map[int]string{2: "Транспорт", 3: "Чужая"})
+	if len(got) != 2 || got[0].CategoryID != 3 {
+		t.Errorf("suggestions = %+v, want category 3 first", got)
+	}
+	got = cl.Predict("Пятёрочка", "", 350, map[int]string{2: "Транспорт"})
+	if len(got) != 1 || got[0].CategoryID != 2 || got[0].Confidence != 1 {
+		t.Errorf("suggestions = %+v, want only category 2", got)
+	}
+	if got := cl.Predict("Пятёрочка", "", 350, map[int]string{4: "Пустая"}); got != nil {
+		t.Errorf("suggestions for categories without expenses = %+v, want none", got)
+	}
+}
+
+func TestHouseholdClassifiers(t *testing.T) {
+	h := newHouseholdClassifiers()
+	h.Add(1, &Expense{CategoryID: 10, Name: "Bakery", Amount: 100})
+	h.Add(1, &Expense{CategoryID: 11, Name: "Taxi", Amount: 100})
+	h.Add(2, &Expense{CategoryID: 20, Name: "Bakery", Amount: 100})
+	h.Add(2, &Expense{CategoryID: 20, Name: "Rye bread", Amount: 100})
+
+	// Словарь у каждого домохозяйства свой
+	if got := h.model(1).vocabulary; !reflect.DeepEqual(got, map[string]int{"bakery": 1, "taxi": 1, "#amount:4": 2}) {
+		t.Errorf("household 1 vocabulary = %v", got)
+	}
+	if got := h.model(2).vocabulary; !reflect.DeepEqual(got, map[string]int{"bakery": 1, "rye": 1, "bread": 1, "#amount:4": 2}) {
+		t.Errorf("household 2 vocabulary = %v", got)
+	}
+
+	// Даже при переданном чужом ID категории модель домохозяйства о ней не знает
+	got := h.Predict(1, "Bakery", "", 100, map[int]string{10: "Food", 11: "Transport", 20: "Foreign"})
+	if len(got) != 2 || got[0].CategoryID != 10 {
+		t.Errorf("household 1 suggestions = %+v", got)
+	}
+	if got := h.Predict(3, "Bakery", "", 100, map[int]string{10: "Food"}); got != nil {
+		t.Errorf("suggestions for a household without a model = %+v", got)
+	}
+
+	h.RemoveCategory(2, 20)
+	h.Remove(1, &Expense{CategoryID: 11, Name: "Taxi", Amount: 100})
+	if got := h.model(2).vocabulary; len(got) != 0 {
+		t.Errorf("household 2 vocabulary after removing its category = %v", got)
+	}
+	if got := h.model(1).vocabulary; !reflect.DeepEqual(got, map[string]int{"bakery": 1, "#amount:4": 1}) {
+		t.Errorf("household 1 vocabulary = %v", got)
+	}
+}
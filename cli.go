@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Выполнение подкоманды командной строки: expense-tracker <команда> [флаги]
+func runCommand(args []string) error {
+	switch args[0] {
+	case "import-ofx":
+		return runImportOFXCommand(args[1:])
+	case "backup":
+		return runBackupCommand(args[1:])
+	case "restore":
+		return runRestoreCommand(args[1:])
+	case "create-user":
+		return runCreateUserCommand(args[1:])
+	case "issue-token":
+		return runIssueTokenCommand(args[1:])
+	case "adopt-legacy-data":
+		return runAdoptLegacyDataCommand(args[1:])
+	case "send-test-email":
+		return runSendTestEmailCommand(args[1:])
+	case "purge-trash":
+		return runPurgeTrashCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// Краткий отчет об импорте файла, включая строки с ошибками
+func printImportResult(path string, result *ImportResult) {
+	mode := "imported"
+	if result.DryRun {
+		mode = "dry run"
+	}
+	fmt.Printf("%s (%s): total %d, imported %d, duplicates %d, errors %d\n",
+		path, mode, result.Total, result.Imported, result.Duplicates, result.Errors)
+
+	for _, row := range result.Rows {
+		if row.Error != "" {
+			fmt.Printf("  line %d: %s\n", row.Line, row.Error)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Требовать ли версию при изменении расходов и категорий. По умолчанию да;
+// REQUIRE_IF_MATCH=false оставляет проверку только для клиентов, которые версию прислали.
+func ifMatchRequired() bool {
+	required, err := strconv.ParseBool(os.Getenv("REQUIRE_IF_MATCH"))
+	if err != nil {
+		return true
+	}
+	return required
+}
+
+// Сильный ETag строки: версия меняется при каждом изменении
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+func setVersionETag(c *gin.Context, version int) {
+	c.Header("ETag", versionETag(version))
+}
+
+// Совпадает ли If-Match с текущей версией. Слабые метки в If-Match не подходят (RFC 9110).
+func ifMatchAllows(header string, current int) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == versionETag(current) {
+			return true
+		}
+	}
+	return false
+}
+
+// Проверяет предусловие PUT, PATCH и DELETE для строки с версией current. Версию берет
+// из If-Match, а для клиентов без заголовков - из тела (bodyVersion) или параметра version.
+// При ошибке отвечает 428 или 412 и возвращает false.
+func checkVersion(c *gin.Context, bodyVersion, current int) bool {
+	if header := c.GetHeader("If-Match"); header != "" {
+		if ifMatchAllows(header, current) {
+			return true
+		}
+		return versionMismatch(c, current)
+	}
+
+	expected := bodyVersion
+	if v := c.Query("version"); v != "" && expected == 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			respondWithError(c, http.StatusBadRequest, "Invalid version: "+v)
+			return false
+		}
+		expected = n
+	}
+	if expected == 0 {
+		if ifMatchRequired() {
+			respondWithError(c, http.StatusPreconditionRequired, "If-Match header or version is required")
+			return false
+		}
+		return true
+	}
+	if expected != current {
+		return versionMismatch(c, current)
+	}
+	return true
+}
+
+func versionMismatch(c *gin.Context, current int) bool {
+	setVersionETag(c, current)
+	respondWithError(c, http.StatusPreconditionFailed, fmt.Sprintf("Resource was modified by someone else: current version is %d", current))
+	return false
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckVersion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const current = 3
+
+	tests := []struct {
+		name        string
+		ifMatch     string
+		query       string
+		bodyVersion int
+		required    string
+		wantOK      bool
+		wantStatus  int
+	}{
+		{name: "matching If-Match", ifMatch: `"3"`, wantOK: true},
+		{name: "If-Match list", ifMatch: `"1", "3"`, wantOK: true},
+		{name: "If-Match any", ifMatch: "*", wantOK: true},
+		{name: "stale If-Match", ifMatch: `"2"`, wantStatus: http.StatusPreconditionFailed},
+		{name: "weak If-Match", ifMatch: `W/"3"`, wantStatus: http.StatusPreconditionFailed},
+		{name: "If-Match wins over body", ifMatch: `"2"`, bodyVersion: current, wantStatus: http.StatusPreconditionFailed},
+		{name: "body version", bodyVersion: current, wantOK: true},
+		{name: "stale body version", bodyVersion: 2, wantStatus: http.StatusPreconditionFailed},
+		{name: "query version", query: "version=3", wantOK: true},
+		{name: "invalid query version", query: "version=abc", wantStatus: http.StatusBadRequest},
+		{name: "no version", wantStatus: http.StatusPreconditionRequired},
+		{name: "no version when not required", required: "false", wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("REQUIRE_IF_MATCH", tt.required)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPut, "/api/expenses/1?"+tt.query, nil)
+			if tt.ifMatch != "" {
+				c.Request.Header.Set("If-Match", tt.ifMatch)
+			}
+
+			if ok := checkVersion(c, tt.bodyVersion, current); ok != tt.wantOK {
+				t.Fatalf("checkVersion = %v, want %v", ok, tt.wantOK)
+			}
+			if tt.wantOK {
+				return
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusPreconditionFailed && w.Header().Get("ETag") != versionETag(current) {
+				t.Errorf("ETag = %q, want %q", w.Header().Get("ETag"), versionETag(current))
+			}
+		})
+	}
+}
+
+type categoryResponse struct {
+	Data Category `json:"data"`
+}
+
+// Запись расходов меняет статистику категории, но не ее версию: иначе клиенты,
+// державшие ETag категории, получали бы 412 без изменений с чужой стороны
+func TestCategoryVersionIgnoresMonthlyStats(t *testing.T) {
+	var user *User
+	var householdID, food int
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, householdID = createTestUser(t, ctx, tx)
+		if _, err := tx.ExecContext(ctx, "UPDATE households SET timezone = 'UTC', month_start_day = 1 WHERE id = $1", householdID); err != nil {
+			t.Fatal(err)
+		}
+		food = createTestCategory(t, ctx, tx, householdID, "Food")
+	})
+	ctx := context.Background()
+	version := loadTestCategoryVersion(t, ctx, db, food)
+
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		createTestExpense(t, ctx, tx, householdID, food, "Lunch", 100, time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC))
+	})
+	if v := loadTestCategoryVersion(t, ctx, db, food); v != version {
+		t.Fatalf("category version = %d after an expense write, want %d", v, version)
+	}
+
+	router := testRouter(user.ID, householdID)
+	router.PUT("/api/categories/:id", updateCategory)
+	w := doJSON(router, http.MethodPut, "/api/categories/"+strconv.Itoa(food), Category{
+		Name:         "Groceries",
+		MonthlyStats: map[string]float64{"1999-01": 1000000},
+		Version:      version,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp categoryResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.Name != "Groceries" || resp.Data.Version != version+1 {
+		t.Errorf("updated category = %+v, want Groceries at version %d", resp.Data, version+1)
+	}
+	if w.Header().Get("ETag") != versionETag(version+1) {
+		t.Errorf("ETag = %q, want %q", w.Header().Get("ETag"), versionETag(version+1))
+	}
+
+	// Присланная клиентом статистика игнорируется
+	want := map[string]float64{"2024-01": 100}
+	assertMonthlyStats(t, resp.Data.MonthlyStats, want)
+	assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), want)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Интеграционные тесты работают с отдельной базой Postgres. Их включает TEST_DB_NAME,
+// остальные параметры подключения берутся из DB_HOST, DB_PORT, DB_USER и DB_PASSWORD.
+// Без TEST_DB_NAME такие тесты пропускаются.
+var testDBOnce sync.Once
+
+func requireTestDB(t *testing.T) {
+	t.Helper()
+	name := os.Getenv("TEST_DB_NAME")
+	if name == "" {
+		t.Skip("TEST_DB_NAME is not set")
+	}
+	testDBOnce.Do(func() {
+		os.Setenv("DB_NAME", name)
+		initDB()
+		initPreparedStatements()
+	})
+}
+
+// Транзакция, которая откатывается после теста
+func testTx(t *testing.T) (context.Context, *sql.Tx) {
+	t.Helper()
+	requireTestDB(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		cancel()
+		t.Fatalf("begin: %v", err)
+	}
+	t.Cleanup(func() {
+		tx.Rollback()
+		cancel()
+	})
+	return ctx, tx
+}
+
+// Имя, не повторяющееся между запусками на одной базе
+func uniqueName(t *testing.T) string {
+	name := strings.NewReplacer("/", "-", " ", "-").Replace(t.Name())
+	return fmt.Sprintf("%s-%d", name, time.Now().UnixNano())
+}
+
+// Пользователь с личным домохозяйством; возвращает его и id домохозяйства
+func createTestUser(t *testing.T, ctx context.Context, tx *sql.Tx) (*User, int) {
+	t.Helper()
+	user, err := createUserWithTx(ctx, tx, uniqueName(t), "", "")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	var householdID int
+	if err := tx.QueryRowContext(ctx, "SELECT default_household_id FROM users WHERE id = $1", user.ID).Scan(&householdID); err != nil {
+		t.Fatalf("default household: %v", err)
+	}
+	return user, householdID
+}
+
+// Выполняет fn в транзакции и фиксирует ее: для данных, которые читают обработчики
+func commitTestTx(t *testing.T, fn func(ctx context.Context, tx *sql.Tx)) {
+	t.Helper()
+	requireTestDB(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	defer tx.Rollback()
+	fn(ctx, tx)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+}
+
+func createTestCategory(t *testing.T, ctx context.Context, tx *sql.Tx, householdID int, name string) int {
+	t.Helper()
+	var id int
+	err := tx.QueryRowContext(ctx, "INSERT INTO categories (name, description, monthly_stats, household_id) VALUES ($1, '', '{}', $2) RETURNING id",
+		name, householdID).Scan(&id)
+	if err != nil {
+		t.Fatalf("create category: %v", err)
+	}
+	return id
+}
+
+// Расход вместе с его вкладом в месячную статистику, как при POST /api/expenses
+func createTestExpense(t *testing.T, ctx context.Context, tx *sql.Tx, householdID, categoryID int, name string, amount float64, date time.Time) Expense {
+	t.Helper()
+	exp := Expense{CategoryID: categoryID, Name: name, Amount: amount, Date: date}
+	err := tx.QueryRowContext(ctx, "INSERT INTO expenses (category_id, name, amount, date, description, household_id) VALUES ($1, $2, $3, $4, '', $5) RETURNING id, version",
+		categoryID, name, amount, date, householdID).Scan(&exp.ID, &exp.Version)
+	if err != nil {
+		t.Fatalf("create expense: %v", err)
+	}
+	if err := updateMonthlyStatsWithTx(ctx, tx, categoryID, amount, date); err != nil {
+		t.Fatalf("update monthly stats: %v", err)
+	}
+	return exp
+}
+
+func loadTestMonthlyStats(t *testing.T, ctx context.Context, q queryer, categoryID int) map[string]float64 {
+	t.Helper()
+	var statsJSON []byte
+	if err := q.QueryRowContext(ctx, "SELECT monthly_stats FROM categories WHERE id = $1", categoryID).Scan(&statsJSON); err != nil {
+		t.Fatalf("load monthly stats: %v", err)
+	}
+	stats := make(map[string]float64)
+	if len(statsJSON) > 0 {
+		if err := json.Unmarshal(statsJSON, &stats); err != nil {
+			t.Fatalf("parse monthly stats: %v", err)
+		}
+	}
+	return stats
+}
+
+func loadTestCategoryVersion(t *testing.T, ctx context.Context, q queryer, categoryID int) int {
+	t.Helper()
+	var version int
+	if err := q.QueryRowContext(ctx, "SELECT version FROM categories WHERE id = $1", categoryID).Scan(&version); err != nil {
+		t.Fatalf("load category version: %v", err)
+	}
+	return version
+}
+
+func assertMonthlyStats(t *testing.T, got, want map[string]float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("monthly stats = %v, want %v", got, want)
+		return
+	}
+	for month, amount := range want {
+		if v, ok := got[month]; !ok || roundAmount(v) != amount {
+			t.Errorf("monthly stats = %v, want %v", got, want)
+			return
+		}
+	}
+}
+
+// Роутер, в котором запросы выполняются от имени пользователя в домохозяйстве,
+// как после authMiddleware и requireAccess
+func testRouter(userID, householdID int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set(userIDKey, userID)
+		c.Set(householdIDKey, householdID)
+	})
+	return router
+}
+
+func doJSON(router http.Handler, method, target string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, target, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
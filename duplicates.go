@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Параметры поиска дубликатов по умолчанию
+const (
+	defaultDuplicateDays       = 3
+	defaultDuplicateSimilarity = 0.6
+)
+
+// Группа предположительно одинаковых расходов
+type DuplicateGroup struct {
+	Amount   float64   `json:"amount"`
+	Expenses []Expense `json:"expenses"`
+}
+
+// Versions - версии всех объединяемых расходов по id, как If-Match у PUT и DELETE
+type MergeExpensesRequest struct {
+	KeepID   int         `json:"keepId" binding:"required"`
+	MergeIDs []int       `json:"mergeIds" binding:"required,min=1"`
+	Versions map[int]int `json:"versions"`
+}
+
+// Название без регистра, пунктуации и лишних пробелов
+func normalizeExpenseName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// Похожесть названий от 0 до 1 по расстоянию Левенштейна
+func nameSimilarity(a, b string) float64 {
+	ra, rb := []rune(normalizeExpenseName(a)), []rune(normalizeExpenseName(b))
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return 1 - float64(prev[len(rb)])/float64(max(len(ra), len(rb)))
+}
+
+// Группирует расходы с одинаковой суммой, близкими датами и похожими названиями.
+// Связи транзитивны: если A похож на B, а B на C, все трое попадут в одну группу.
+func findDuplicateGroups(expenses []Expense, days int, similarity float64) []DuplicateGroup {
+	byAmount := make(map[int64][]int)
+	for i, exp := range expenses {
+		cents := int64(math.Round(exp.Amount * 100))
+		byAmount[cents] = append(byAmount[cents], i)
+	}
+
+	parent := make([]int, len(expenses))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	window := time.Duration(days) * 24 * time.Hour
+	for _, idx := range byAmount {
+		sort.Slice(idx, func(i, j int) bool { return expenses[idx[i]].Date.Before(expenses[idx[j]].Date) })
+		for i := range idx {
+			for j := i + 1; j < len(idx); j++ {
+				if expenses[idx[j]].Date.Sub(expenses[idx[i]].Date) > window {
+					break
+				}
+				if nameSimilarity(expenses[idx[i]].Name, expenses[idx[j]].Name) >= similarity {
+					parent[find(idx[j])] = find(idx[i])
+				}
+			}
+		}
+	}
+
+	members := make(map[int][]Expense)
+	for i, exp := range expenses {
+		root := find(i)
+		members[root] = append(members[root], exp)
+	}
+
+	groups := []DuplicateGroup{}
+	for _, list := range members {
+		if len(list) < 2 {
+			continue
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if !list[i].Date.Equal(list[j].Date) {
+				return list[i].Date.Before(list[j].Date)
+			}
+			return list[i].ID < list[j].ID
+		})
+		groups = append(groups, DuplicateGroup{Amount: list[0].Amount, Expenses: list})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Expenses[0].Date.After(groups[j].Expenses[0].Date)
+	})
+	return groups
+}
+
+func getDuplicateExpenses(c *gin.Context) {
+	var filter ExpenseFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.HouseholdID = currentHouseholdID(c)
+
+	days := defaultDuplicateDays
+	if v := c.Query("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respondWithError(c, http.StatusBadRequest, "days must be a non-negative integer")
+			return
+		}
+		days = n
+	}
+	similarity := defaultDuplicateSimilarity
+	if v := c.Query("similarity"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			respondWithError(c, http.StatusBadRequest, "similarity must be a number between 0 and 1")
+			return
+		}
+		similarity = f
+	}
+
+	where, args, err := filter.whereClause("")
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT id, category_id, name, amount, date, description, tags, version FROM expenses"+where, args...)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	var expenses []Expense
+	for rows.Next() {
+		var exp Expense
+		var tagsJSON []byte
+		if err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &exp.Version); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		exp.Tags = decodeTags(tagsJSON)
+		expenses = append(expenses, exp)
+	}
+	if err := rows.Err(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data:   findDuplicateGroups(expenses, days, similarity),
+	})
+}
+
+// Оставляет один расход из группы, остальные удаляет вместе с их вкладом в статистику.
+// Теги удаляемых расходов переносятся в оставленный.
+func mergeExpenses(c *gin.Context) {
+	var req MergeExpensesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	seen := map[int]bool{req.KeepID: true}
+	for _, id := range req.MergeIDs {
+		if seen[id] {
+			respondWithError(c, http.StatusBadRequest, "mergeIds must be unique and must not contain keepId")
+			return
+		}
+		seen[id] = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	householdID := currentHouseholdID(c)
+	ids := append([]int{req.KeepID}, req.MergeIDs...)
+	rows, err := tx.QueryContext(ctx, "SELECT id, category_id, name, amount, date, description, tags, version FROM expenses WHERE id = ANY($1) AND household_id = $2 AND deleted_at IS NULL FOR UPDATE", pq.Array(ids), householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	found := make(map[int]Expense, len(ids))
+	for rows.Next() {
+		var exp Expense
+		var tagsJSON []byte
+		if err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &exp.Version); err != nil {
+			rows.Close()
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		exp.Tags = decodeTags(tagsJSON)
+		found[exp.ID] = exp
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for _, id := range ids {
+		exp, ok := found[id]
+		if !ok {
+			respondWithError(c, http.StatusNotFound, "Expense "+strconv.Itoa(id)+" not found")
+			return
+		}
+		expected := req.Versions[id]
+		if expected == 0 && ifMatchRequired() {
+			respondWithError(c, http.StatusPreconditionRequired, "versions of all merged expenses are required")
+			return
+		}
+		if expected != 0 && expected != exp.Version {
+			respondWithError(c, http.StatusPreconditionFailed, fmt.Sprintf("Expense %d was modified by someone else: current version is %d", id, exp.Version))
+			return
+		}
+	}
+
+	kept := found[req.KeepID]
+	keptBefore := kept
+	actor := auditActorFrom(c)
+	removed := make([]Expense, 0, len(req.MergeIDs))
+	for _, id := range req.MergeIDs {
+		exp := found[id]
+		kept.Tags = mergeTags(kept.Tags, exp.Tags)
+
+		if _, err := tx.ExecContext(ctx, "UPDATE expenses SET deleted_at = NOW(), version = version + 1 WHERE id = $1", id); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := updateMonthlyStatsWithTx(ctx, tx, exp.CategoryID, -exp.Amount, exp.Date); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := recordAudit(ctx, tx, actor, auditDelete, auditEntityExpense, exp.ID, exp, nil); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		removed = append(removed, exp)
+	}
+
+	if err := tx.QueryRowContext(ctx, "UPDATE expenses SET tags = $1, version = version + 1 WHERE id = $2 RETURNING version", encodeTags(kept.Tags), kept.ID).Scan(&kept.Version); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := recordAudit(ctx, tx, actor, auditUpdate, auditEntityExpense, kept.ID, keptBefore, kept); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for i := range removed {
+		classifier.Remove(householdID, &removed[i])
+	}
+
+	setVersionETag(c, kept.Version)
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Expenses merged successfully",
+		Data:    kept,
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNameSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{a: "Пятёрочка", b: "Пятёрочка", want: 1},
+		{a: "  PYATEROCHKA #123 ", b: "pyaterochka 123", want: 1},
+		{a: "Coffee, Shop!", b: "coffee shop", want: 1},
+		{a: "", b: "!!!", want: 1},
+		{a: "abc", b: "", want: 0},
+		{a: "kitten", b: "sitting", want: 1 - 3.0/7},
+		{a: "Магнит", b: "Магнат", want: 1 - 1.0/6},
+		{a: "Taxi", b: "Bakery", want: 1 - 5.0/6},
+	}
+	for _, tt := range tests {
+		got := nameSimilarity(tt.a, tt.b)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("nameSimilarity(%q, %q) = %.4f, want %.4f", tt.a, tt.b, got, tt.want)
+		}
+		if back := nameSimilarity(tt.b, tt.a); math.Abs(back-got) > 1e-9 {
+			t.Errorf("nameSimilarity is not symmetric for %q and %q: %.4f vs %.4f", tt.a, tt.b, got, back)
+		}
+	}
+}
+
+func TestFindDuplicateGroups(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, time.January, d, 12, 0, 0, 0, time.UTC) }
+	expenses := []Expense{
+		{ID: 1, Name: "Coffee Shop", Amount: 250, Date: day(10)},
+		{ID: 2, Name: "coffee shop!", Amount: 250.001, Date: day(12)},
+		// Связан с 1 только через 2: дата за окном от 1, но в окне от 2
+		{ID: 3, Name: "Coffee Shp", Amount: 250, Date: day(15)},
+		// Та же сумма и дата, другое название
+		{ID: 4, Name: "Pharmacy", Amount: 250, Date: day(10)},
+		// Похожее название, другая сумма
+		{ID: 5, Name: "Coffee Shop", Amount: 260, Date: day(10)},
+		{ID: 6, Name: "Taxi", Amount: 500, Date: day(20)},
+		{ID: 7, Name: "Taxi", Amount: 500, Date: day(20)},
+		// Слишком поздно для окна в три дня
+		{ID: 8, Name: "Taxi", Amount: 500, Date: day(24)},
+	}
+
+	ids := func(groups []DuplicateGroup) [][]int {
+		var result [][]int
+		for _, g := range groups {
+			var group []int
+			for _, exp := range g.Expenses {
+				group = append(group, exp.ID)
+			}
+			result = append(result, group)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name       string
+		days       int
+		similarity float64
+		want       [][]int
+	}{
+		// Группы упорядочены от новых к старым, расходы внутри - по дате
+		{name: "defaults", days: 3, similarity: 0.6, want: [][]int{{6, 7}, {1, 2, 3}}},
+		{name: "same day only", days: 0, similarity: 0.6, want: [][]int{{6, 7}}},
+		{name: "wide window", days: 4, similarity: 0.6, want: [][]int{{6, 7, 8}, {1, 2, 3}}},
+		{name: "exact names", days: 3, similarity: 1, want: [][]int{{6, 7}, {1, 2}}},
+		{name: "any name", days: 0, similarity: 0, want: [][]int{{6, 7}, {1, 4}}},
+	}
+	for _, tt := range tests {
+		got := ids(findDuplicateGroups(expenses, tt.days, tt.similarity))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: groups = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if groups := findDuplicateGroups(nil, 3, 0.6); groups == nil || len(groups) != 0 {
+		t.Errorf("no expenses: groups = %#v, want an empty list", groups)
+	}
+}
+
+func TestMergeExpenses(t *testing.T) {
+	t.Setenv("REQUIRE_IF_MATCH", "true")
+	var user *User
+	var householdID, categoryID int
+	var keep, dup Expense
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, householdID = createTestUser(t, ctx, tx)
+		categoryID = createTestCategory(t, ctx, tx, householdID, "Food")
+		date := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+		keep = createTestExpense(t, ctx, tx, householdID, categoryID, "Coffee", 250, date)
+		dup = createTestExpense(t, ctx, tx, householdID, categoryID, "Coffee", 250, date)
+	})
+	router := testRouter(user.ID, householdID)
+	router.POST("/expenses/merge", mergeExpenses)
+	router.PUT("/expenses/:id", updateExpense)
+
+	req := MergeExpensesRequest{KeepID: keep.ID, MergeIDs: []int{dup.ID}, Versions: map[int]int{keep.ID: keep.Version}}
+	if w := doJSON(router, http.MethodPost, "/expenses/merge", req); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("missing version: status = %d, want 428: %s", w.Code, w.Body)
+	}
+	req.Versions[dup.ID] = dup.Version + 1
+	if w := doJSON(router, http.MethodPost, "/expenses/merge", req); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale version: status = %d, want 412: %s", w.Code, w.Body)
+	}
+
+	req.Versions[dup.ID] = dup.Version
+	w := doJSON(router, http.MethodPost, "/expenses/merge", req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("merge: status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Data Expense `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	if err := db.QueryRow("SELECT version FROM expenses WHERE id = $1", keep.ID).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.Version != version || version == keep.Version {
+		t.Fatalf("merged expense version = %d, stored %d (was %d)", resp.Data.Version, version, keep.Version)
+	}
+	if etag := w.Header().Get("ETag"); etag != versionETag(version) {
+		t.Errorf("ETag = %q, want %q", etag, versionETag(version))
+	}
+	assertMonthlyStats(t, loadTestMonthlyStats(t, context.Background(), db, categoryID), map[string]float64{"2024-01": 250})
+
+	// Версия из ответа сразу годится для следующего изменения
+	next := resp.Data
+	next.Name = "Coffee shop"
+	put := doJSON(router, http.MethodPut, fmt.Sprintf("/expenses/%d", keep.ID), next)
+	if put.Code != http.StatusOK {
+		t.Errorf("update with the returned version: status = %d, want 200: %s", put.Code, put.Body)
+	}
+}
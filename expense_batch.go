@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Сколько операций принимает один пакет; больше - несколькими запросами
+const maxBatchOperations = 1000
+
+// Операции пакета
+const (
+	batchCreate       = "create"
+	batchUpdate       = "update"
+	batchDelete       = "delete"
+	batchRecategorize = "recategorize"
+)
+
+// Операция пакета. Для update и delete нужны id и version (как If-Match у PUT и DELETE),
+// для recategorize - фильтр и категория, куда переносятся подходящие расходы.
+type BatchOperation struct {
+	Op         string         `json:"op" binding:"required,oneof=create update delete recategorize"`
+	ID         int            `json:"id"`
+	Version    int            `json:"version"`
+	Expense    *Expense       `json:"expense"`
+	Filter     *ExpenseFilter `json:"filter"`
+	CategoryID int            `json:"categoryId"`
+}
+
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations" binding:"required,min=1,dive"`
+}
+
+// Результат операции; Status - HTTP-код, который вернул бы отдельный запрос
+type BatchResult struct {
+	Index   int      `json:"index"`
+	Op      string   `json:"op"`
+	Status  int      `json:"status"`
+	Error   string   `json:"error,omitempty"`
+	Expense *Expense `json:"expense,omitempty"`
+	// Сколько расходов перенесла перекатегоризация
+	Updated int `json:"updated,omitempty"`
+}
+
+// Ошибка отдельной операции: пакет откатывается, но остальные операции еще проверяются
+type batchOpError struct {
+	status  int
+	message string
+}
+
+func (e *batchOpError) Error() string {
+	return e.message
+}
+
+func batchOpFailed(status int, format string, args ...interface{}) error {
+	return &batchOpError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// Состояние пакета в транзакции. Статистика копится в deltas и записывается
+// один раз на категорию, модель обучается только после фиксации.
+type expenseBatch struct {
+	ctx         context.Context
+	tx          *sql.Tx
+	householdID int
+	actor       auditActor
+	deltas      statsDeltas
+	categories  map[int]bool
+	rules       []CategoryRule
+	rulesLoaded bool
+	learn       []func()
+}
+
+func (b *expenseBatch) requireCategory(id int) error {
+	ok, cached := b.categories[id]
+	if !cached {
+		var err error
+		ok, err = categoryInHousehold(b.ctx, b.tx, b.householdID, id)
+		if err != nil {
+			return err
+		}
+		b.categories[id] = ok
+	}
+	if !ok {
+		return batchOpFailed(http.StatusBadRequest, "Category %d not found", id)
+	}
+	return nil
+}
+
+func (b *expenseBatch) checkVersion(expected, current int) error {
+	if expected == 0 {
+		if ifMatchRequired() {
+			return batchOpFailed(http.StatusPreconditionRequired, "version is required")
+		}
+		return nil
+	}
+	if expected != current {
+		return batchOpFailed(http.StatusPreconditionFailed, "Expense was modified by someone else: current version is %d", current)
+	}
+	return nil
+}
+
+// Действующий расход домохозяйства с блокировкой до конца транзакции
+func (b *expenseBatch) lockExpense(id int) (*Expense, error) {
+	var exp Expense
+	var tagsJSON []byte
+	err := b.tx.QueryRowContext(b.ctx, "SELECT id, category_id, name, amount, date, description, tags, version FROM expenses WHERE id = $1 AND household_id = $2 AND deleted_at IS NULL FOR UPDATE", id, b.householdID).
+		Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &exp.Version)
+	if err == sql.ErrNoRows {
+		return nil, batchOpFailed(http.StatusNotFound, "Expense %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	exp.Tags = decodeTags(tagsJSON)
+	return &exp, nil
+}
+
+func (b *expenseBatch) apply(op BatchOperation) (BatchResult, error) {
+	switch op.Op {
+	case batchCreate:
+		return b.create(op)
+	case batchUpdate:
+		return b.update(op)
+	case batchDelete:
+		return b.delete(op)
+	default:
+		return b.recategorize(op)
+	}
+}
+
+func (b *expenseBatch) create(op BatchOperation) (BatchResult, error) {
+	if op.Expense == nil {
+		return BatchResult{}, batchOpFailed(http.StatusBadRequest, "expense is required")
+	}
+	exp := *op.Expense
+	exp.ID, exp.Version = 0, 0
+	if exp.Date.IsZero() {
+		exp.Date = time.Now()
+	}
+
+	// Как и в createExpense, без категории ее подбирают правила
+	if exp.CategoryID == 0 {
+		if !b.rulesLoaded {
+			rules, err := loadRules(b.ctx, b.tx, b.householdID)
+			if err != nil {
+				return BatchResult{}, err
+			}
+			b.rules, b.rulesLoaded = rules, true
+		}
+		applyRules(b.rules, &exp, false)
+		if exp.CategoryID == 0 {
+			return BatchResult{}, batchOpFailed(http.StatusBadRequest, "categoryId is required: no categorization rule matched")
+		}
+	}
+	if err := b.requireCategory(exp.CategoryID); err != nil {
+		return BatchResult{}, err
+	}
+
+	err := b.tx.QueryRowContext(b.ctx, "INSERT INTO expenses (category_id, name, amount, date, description, tags, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, version",
+		exp.CategoryID, exp.Name, exp.Amount, exp.Date, exp.Description, encodeTags(exp.Tags), b.householdID).Scan(&exp.ID, &exp.Version)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	b.deltas.add(exp.CategoryID, exp.Amount, exp.Date)
+
+	if err := recordAudit(b.ctx, b.tx, b.actor, auditCreate, auditEntityExpense, exp.ID, nil, exp); err != nil {
+		return BatchResult{}, err
+	}
+	b.learn = append(b.learn, func() { classifier.Add(b.householdID, &exp) })
+	return BatchResult{Status: http.StatusCreated, Expense: &exp}, nil
+}
+
+func (b *expenseBatch) update(op BatchOperation) (BatchResult, error) {
+	if op.ID == 0 || op.Expense == nil {
+		return BatchResult{}, batchOpFailed(http.StatusBadRequest, "id and expense are required")
+	}
+	oldExp, err := b.lockExpense(op.ID)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	version := op.Version
+	if version == 0 {
+		version = op.Expense.Version
+	}
+	if err := b.checkVersion(version, oldExp.Version); err != nil {
+		return BatchResult{}, err
+	}
+
+	exp := *op.Expense
+	if err := b.requireCategory(exp.CategoryID); err != nil {
+		return BatchResult{}, err
+	}
+
+	exp.ID = oldExp.ID
+	err = b.tx.QueryRowContext(b.ctx, "UPDATE expenses SET category_id = $1, name = $2, amount = $3, date = $4, description = $5, tags = $6, version = version + 1 WHERE id = $7 RETURNING version",
+		exp.CategoryID, exp.Name, exp.Amount, exp.Date, exp.Description, encodeTags(exp.Tags), exp.ID).Scan(&exp.Version)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	b.deltas.add(oldExp.CategoryID, -oldExp.Amount, oldExp.Date)
+	b.deltas.add(exp.CategoryID, exp.Amount, exp.Date)
+
+	if err := recordAudit(b.ctx, b.tx, b.actor, auditUpdate, auditEntityExpense, exp.ID, oldExp, exp); err != nil {
+		return BatchResult{}, err
+	}
+	b.learn = append(b.learn, func() { classifier.Replace(b.householdID, oldExp, &exp) })
+	return BatchResult{Status: http.StatusOK, Expense: &exp}, nil
+}
+
+func (b *expenseBatch) delete(op BatchOperation) (BatchResult, error) {
+	if op.ID == 0 {
+		return BatchResult{}, batchOpFailed(http.StatusBadRequest, "id is required")
+	}
+	exp, err := b.lockExpense(op.ID)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	if err := b.checkVersion(op.Version, exp.Version); err != nil {
+		return BatchResult{}, err
+	}
+
+	// Как и DELETE, пакет отправляет расход в корзину
+	if _, err := b.tx.ExecContext(b.ctx, "UPDATE expenses SET deleted_at = NOW(), version = version + 1 WHERE id = $1", exp.ID); err != nil {
+		return BatchResult{}, err
+	}
+	b.deltas.add(exp.CategoryID, -exp.Amount, exp.Date)
+
+	if err := recordAudit(b.ctx, b.tx, b.actor, auditDelete, auditEntityExpense, exp.ID, exp, nil); err != nil {
+		return BatchResult{}, err
+	}
+	b.learn = append(b.learn, func() { classifier.Remove(b.householdID, exp) })
+	return BatchResult{Status: http.StatusOK}, nil
+}
+
+// Переносит в категорию все расходы, подходящие под фильтр
+func (b *expenseBatch) recategorize(op BatchOperation) (BatchResult, error) {
+	if op.Filter == nil || op.CategoryID == 0 {
+		return BatchResult{}, batchOpFailed(http.StatusBadRequest, "filter and categoryId are required")
+	}
+	filter := *op.Filter
+	filter.HouseholdID = b.householdID
+	// Пустой фильтр перенес бы все расходы домохозяйства
+	if filter.CategoryID == 0 && filter.From == "" && filter.To == "" {
+		return BatchResult{}, batchOpFailed(http.StatusBadRequest, "filter must set categoryId, from or to")
+	}
+	where, args, err := filter.whereClause("")
+	if err != nil {
+		return BatchResult{}, batchOpFailed(http.StatusBadRequest, "%s", err.Error())
+	}
+	if err := b.requireCategory(op.CategoryID); err != nil {
+		return BatchResult{}, err
+	}
+
+	args = append(args, op.CategoryID)
+	rows, err := b.tx.QueryContext(b.ctx, "SELECT id, category_id, name, amount, date, description, tags, version FROM expenses"+where+
+		fmt.Sprintf(" AND category_id <> $%d ORDER BY id FOR UPDATE", len(args)), args...)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	var expenses []Expense
+	for rows.Next() {
+		var exp Expense
+		var tagsJSON []byte
+		if err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &exp.Version); err != nil {
+			rows.Close()
+			return BatchResult{}, err
+		}
+		exp.Tags = decodeTags(tagsJSON)
+		expenses = append(expenses, exp)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return BatchResult{}, err
+	}
+	if len(expenses) == 0 {
+		return BatchResult{Status: http.StatusOK}, nil
+	}
+
+	ids := make([]int, len(expenses))
+	for i, exp := range expenses {
+		ids[i] = exp.ID
+	}
+	if _, err := b.tx.ExecContext(b.ctx, "UPDATE expenses SET category_id = $1, version = version + 1 WHERE id = ANY($2)", op.CategoryID, pq.Array(ids)); err != nil {
+		return BatchResult{}, err
+	}
+
+	for i := range expenses {
+		before := expenses[i]
+		after := before
+		after.CategoryID = op.CategoryID
+		after.Version++
+		b.deltas.add(before.CategoryID, -before.Amount, before.Date)
+		b.deltas.add(after.CategoryID, after.Amount, after.Date)
+		if err := recordAudit(b.ctx, b.tx, b.actor, auditUpdate, auditEntityExpense, after.ID, before, after); err != nil {
+			return BatchResult{}, err
+		}
+		b.learn = append(b.learn, func() { classifier.Replace(b.householdID, &before, &after) })
+	}
+	return BatchResult{Status: http.StatusOK, Updated: len(expenses)}, nil
+}
+
+// Применяет пакет операций одной транзакцией: либо все, либо ничего.
+// Если какая-то операция не прошла, в ответе 422 и результаты всех операций с ошибками.
+func batchExpenses(c *gin.Context) {
+	var req BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Operations) > maxBatchOperations {
+		respondWithError(c, http.StatusBadRequest, fmt.Sprintf("A batch may contain at most %d operations", maxBatchOperations))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	batch := &expenseBatch{
+		ctx:         ctx,
+		tx:          tx,
+		householdID: currentHouseholdID(c),
+		actor:       auditActorFrom(c),
+		deltas:      statsDeltas{},
+		categories:  make(map[int]bool),
+	}
+
+	results := make([]BatchResult, len(req.Operations))
+	failed := 0
+	for i, op := range req.Operations {
+		result, err := batch.apply(op)
+		if opErr, ok := err.(*batchOpError); ok {
+			result = BatchResult{Status: opErr.status, Error: opErr.message}
+			failed++
+		} else if err != nil {
+			respondWithError(c, http.StatusInternalServerError, fmt.Sprintf("operation %d: %v", i, err))
+			return
+		}
+		result.Index = i
+		result.Op = op.Op
+		results[i] = result
+	}
+
+	if failed > 0 {
+		c.JSON(http.StatusUnprocessableEntity, Response{
+			Status:  "error",
+			Message: fmt.Sprintf("%d of %d operations failed, no changes were applied", failed, len(results)),
+			Data:    results,
+		})
+		return
+	}
+
+	if err := batch.deltas.applyWithTx(ctx, tx); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, learn := range batch.learn {
+		learn()
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: fmt.Sprintf("%d operations applied", len(results)),
+		Data:    results,
+	})
+}
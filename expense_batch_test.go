@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStatsDeltasAdd(t *testing.T) {
+	moment := time.Date(2024, time.January, 31, 15, 0, 0, 0, time.UTC)
+	d := statsDeltas{}
+	d.add(1, 100, moment)
+	d.add(1, 50, moment.In(time.FixedZone("MSK", 3*60*60)))
+	d.add(2, 30, moment)
+	d.add(2, -30, moment)
+
+	if got := d[1][moment.Unix()]; got != 150 {
+		t.Errorf("category 1 delta = %v, want 150: the same instant in another zone must add up", got)
+	}
+	if len(d[2]) != 1 || d[2][moment.Unix()] != 0 {
+		t.Errorf("category 2 deltas = %v, want a single zero", d[2])
+	}
+}
+
+func TestStatsDeltasApplyWithTx(t *testing.T) {
+	ctx, tx := testTx(t)
+	_, householdID := createTestUser(t, ctx, tx)
+	if _, err := tx.ExecContext(ctx, "UPDATE households SET timezone = 'Asia/Vladivostok', month_start_day = 1 WHERE id = $1", householdID); err != nil {
+		t.Fatal(err)
+	}
+	food := createTestCategory(t, ctx, tx, householdID, "Food")
+	transport := createTestCategory(t, ctx, tx, householdID, "Transport")
+	if _, err := tx.ExecContext(ctx, `UPDATE categories SET monthly_stats = '{"2024-01": 10}' WHERE id = $1`, food); err != nil {
+		t.Fatal(err)
+	}
+	foodVersion := loadTestCategoryVersion(t, ctx, tx, food)
+
+	d := statsDeltas{}
+	// 31 января 15:00 UTC - уже февраль во Владивостоке
+	d.add(food, 100, time.Date(2024, time.January, 31, 15, 0, 0, 0, time.UTC))
+	d.add(food, 50, time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC))
+	d.add(transport, 30, time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC))
+	d.add(transport, -30, time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC))
+	if err := d.applyWithTx(ctx, tx); err != nil {
+		t.Fatalf("applyWithTx: %v", err)
+	}
+
+	assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, tx, food), map[string]float64{"2024-01": 60, "2024-02": 100})
+	assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, tx, transport), map[string]float64{"2024-03": 0})
+	// Пересчет статистики не должен менять ETag категории
+	if v := loadTestCategoryVersion(t, ctx, tx, food); v != foodVersion {
+		t.Errorf("category version = %d after stats update, want %d", v, foodVersion)
+	}
+
+	if err := (statsDeltas{-1: {0: 1}}).applyWithTx(ctx, tx); err == nil {
+		t.Error("applyWithTx accepted a missing category")
+	}
+}
+
+type batchResponse struct {
+	Status  string        `json:"status"`
+	Message string        `json:"message"`
+	Data    []BatchResult `json:"data"`
+}
+
+func TestBatchExpenses(t *testing.T) {
+	t.Setenv("REQUIRE_IF_MATCH", "true")
+
+	var user *User
+	var householdID, food, transport int
+	var lunch, taxi Expense
+	january := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+	february := time.Date(2024, time.February, 10, 12, 0, 0, 0, time.UTC)
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, householdID = createTestUser(t, ctx, tx)
+		if _, err := tx.ExecContext(ctx, "UPDATE households SET timezone = 'UTC', month_start_day = 1 WHERE id = $1", householdID); err != nil {
+			t.Fatal(err)
+		}
+		food = createTestCategory(t, ctx, tx, householdID, "Food")
+		transport = createTestCategory(t, ctx, tx, householdID, "Transport")
+		lunch = createTestExpense(t, ctx, tx, householdID, food, "Lunch", 500, january)
+		taxi = createTestExpense(t, ctx, tx, householdID, transport, "Taxi", 300, january)
+	})
+
+	router := testRouter(user.ID, householdID)
+	router.POST("/api/expenses/batch", batchExpenses)
+	ctx := context.Background()
+
+	expenseCount := func() int {
+		t.Helper()
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM expenses WHERE household_id = $1 AND deleted_at IS NULL", householdID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	t.Run("failed operation rolls back the whole batch", func(t *testing.T) {
+		w := doJSON(router, http.MethodPost, "/api/expenses/batch", BatchRequest{Operations: []BatchOperation{
+			{Op: batchCreate, Expense: &Expense{CategoryID: food, Name: "Dinner", Amount: 700, Date: january}},
+			{Op: batchUpdate, ID: lunch.ID, Version: lunch.Version + 1, Expense: &Expense{CategoryID: food, Name: "Lunch", Amount: 1, Date: january}},
+			{Op: batchDelete, ID: taxi.ID, Version: taxi.Version},
+			{Op: batchDelete, ID: -1, Version: 1},
+			{Op: batchCreate, Expense: &Expense{CategoryID: -1, Name: "Nowhere", Amount: 1, Date: january}},
+		}})
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("status = %d, want 422: %s", w.Code, w.Body)
+		}
+		var resp batchResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		wantStatuses := []int{http.StatusCreated, http.StatusPreconditionFailed, http.StatusOK, http.StatusNotFound, http.StatusBadRequest}
+		if len(resp.Data) != len(wantStatuses) {
+			t.Fatalf("results = %+v", resp.Data)
+		}
+		for i, want := range wantStatuses {
+			if resp.Data[i].Index != i || resp.Data[i].Status != want {
+				t.Errorf("result %d = %+v, want status %d", i, resp.Data[i], want)
+			}
+		}
+
+		if n := expenseCount(); n != 2 {
+			t.Errorf("expenses after failed batch = %d, want 2", n)
+		}
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), map[string]float64{"2024-01": 500})
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, transport), map[string]float64{"2024-01": 300})
+	})
+
+	t.Run("missing version is rejected", func(t *testing.T) {
+		w := doJSON(router, http.MethodPost, "/api/expenses/batch", BatchRequest{Operations: []BatchOperation{
+			{Op: batchDelete, ID: taxi.ID},
+		}})
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("status = %d, want 422: %s", w.Code, w.Body)
+		}
+		if n := expenseCount(); n != 2 {
+			t.Errorf("expenses = %d, want 2", n)
+		}
+	})
+
+	t.Run("successful batch applies operations and aggregated stats", func(t *testing.T) {
+		w := doJSON(router, http.MethodPost, "/api/expenses/batch", BatchRequest{Operations: []BatchOperation{
+			{Op: batchCreate, Expense: &Expense{CategoryID: food, Name: "Dinner", Amount: 700, Date: february}},
+			{Op: batchCreate, Expense: &Expense{CategoryID: food, Name: "Coffee", Amount: 150.5, Date: february}},
+			{Op: batchUpdate, ID: lunch.ID, Version: lunch.Version, Expense: &Expense{CategoryID: transport, Name: "Lunch", Amount: 450, Date: february}},
+			{Op: batchDelete, ID: taxi.ID, Version: taxi.Version},
+		}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+		var resp batchResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Data) != 4 || resp.Data[0].Expense == nil || resp.Data[0].Expense.ID == 0 {
+			t.Fatalf("results = %+v", resp.Data)
+		}
+		if updated := resp.Data[2].Expense; updated == nil || updated.Version != lunch.Version+1 {
+			t.Errorf("updated expense = %+v, want version %d", updated, lunch.Version+1)
+		}
+
+		if n := expenseCount(); n != 3 {
+			t.Errorf("expenses = %d, want 3", n)
+		}
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), map[string]float64{"2024-01": 0, "2024-02": 850.5})
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, transport), map[string]float64{"2024-01": 0, "2024-02": 450})
+
+		// Повтор с уже устаревшей версией отклоняется
+		w = doJSON(router, http.MethodPost, "/api/expenses/batch", BatchRequest{Operations: []BatchOperation{
+			{Op: batchUpdate, ID: lunch.ID, Version: lunch.Version, Expense: &Expense{CategoryID: food, Name: "Lunch", Amount: 1, Date: february}},
+		}})
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("stale version: status = %d, want 422: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("recategorize requires a filter", func(t *testing.T) {
+		w := doJSON(router, http.MethodPost, "/api/expenses/batch", BatchRequest{Operations: []BatchOperation{
+			{Op: batchRecategorize, Filter: &ExpenseFilter{}, CategoryID: food},
+		}})
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("status = %d, want 422: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("recategorize moves matching expenses", func(t *testing.T) {
+		w := doJSON(router, http.MethodPost, "/api/expenses/batch", BatchRequest{Operations: []BatchOperation{
+			{Op: batchRecategorize, Filter: &ExpenseFilter{CategoryID: transport}, CategoryID: food},
+		}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+		var resp batchResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Data) != 1 || resp.Data[0].Updated != 1 {
+			t.Fatalf("results = %+v, want one moved expense", resp.Data)
+		}
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), map[string]float64{"2024-01": 0, "2024-02": 1300.5})
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, transport), map[string]float64{"2024-01": 0, "2024-02": 0})
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Количество строк, после которого выгрузка сбрасывается клиенту
+const exportFlushEvery = 500
+
+// Сколько может длиться выгрузка: и запрос к базе, и передача файла
+const exportTimeout = 60 * time.Second
+
+// Заголовки колонок выгрузки расходов
+var exportExpenseHeader = []string{"ID", "Дата", "Категория", "Название", "Сумма", "Описание"}
+
+// Строка выгрузки расходов
+type exportExpenseRow struct {
+	ID          int
+	Date        time.Time
+	Category    string
+	Name        string
+	Amount      float64
+	Description string
+}
+
+// Разбирает фильтры списка расходов и отвечает ошибкой, если они некорректны
+func bindExportFilter(c *gin.Context) (string, []interface{}, bool) {
+	var filter ExpenseFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return "", nil, false
+	}
+	filter.HouseholdID = currentHouseholdID(c)
+
+	where, args, err := filter.whereClause("e")
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return "", nil, false
+	}
+	return where, args, true
+}
+
+// Даты выгружаются как местное время домохозяйства
+func queryExportExpenses(ctx context.Context, where string, args []interface{}) (*sql.Rows, error) {
+	return db.QueryContext(ctx, "SELECT e.id, e.date AT TIME ZONE "+householdTimezoneSQL+", c.name, e.name, e.amount, e.description FROM expenses e LEFT JOIN categories c ON c.id = e.category_id"+
+		where+" ORDER BY e.date, e.id", args...)
+}
+
+func scanExportExpense(rows *sql.Rows) (exportExpenseRow, error) {
+	var row exportExpenseRow
+	var category, description sql.NullString
+	if err := rows.Scan(&row.ID, &row.Date, &category, &row.Name, &row.Amount, &description); err != nil {
+		return row, err
+	}
+	row.Category = category.String
+	row.Description = description.String
+	return row, nil
+}
+
+// Общий WriteTimeout сервера короче выгрузок: продлевает срок записи для одного ответа
+func extendWriteDeadline(c *gin.Context, timeout time.Duration) {
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		log.Printf("Error extending write deadline: %v", err)
+	}
+}
+
+// Отдает файл для скачивания; после этого ошибки можно только записать в лог
+func startDownload(c *gin.Context, contentType, filename string) {
+	extendWriteDeadline(c, exportTimeout)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+}
+
+func exportExpensesCSV(c *gin.Context) {
+	where, args, ok := bindExportFilter(c)
+	if !ok {
+		return
+	}
+
+	// Для русской локали Excel ожидает точку с запятой
+	delimiter := ','
+	if d := c.Query("delimiter"); d != "" {
+		r, size := utf8.DecodeRuneInString(d)
+		if size != len(d) {
+			respondWithError(c, http.StatusBadRequest, "Delimiter must be a single character")
+			return
+		}
+		delimiter = r
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	rows, err := queryExportExpenses(ctx, where, args)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	startDownload(c, "text/csv; charset=utf-8", "expenses.csv")
+
+	// BOM нужен Excel, чтобы распознать UTF-8
+	c.Writer.WriteString("\ufeff")
+	w := csv.NewWriter(c.Writer)
+	w.Comma = delimiter
+	w.Write(exportExpenseHeader)
+
+	count := 0
+	for rows.Next() {
+		row, err := scanExportExpense(rows)
+		if err != nil {
+			log.Printf("Error exporting expenses to CSV: %v", err)
+			return
+		}
+
+		w.Write([]string{
+			strconv.Itoa(row.ID),
+			row.Date.Format("2006-01-02"),
+			row.Category,
+			row.Name,
+			strconv.FormatFloat(row.Amount, 'f', 2, 64),
+			row.Description,
+		})
+
+		count++
+		if count%exportFlushEvery == 0 {
+			w.Flush()
+			c.Writer.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error exporting expenses to CSV: %v", err)
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("Error writing CSV export: %v", err)
+	}
+}
+
+func exportExpensesXLSX(c *gin.Context) {
+	where, args, ok := bindExportFilter(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	rows, err := queryExportExpenses(ctx, where, args)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	startDownload(c, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "expenses.xlsx")
+
+	x := newXLSXWriter(c.Writer)
+	x.StartSheet("Расходы")
+	header := make([]interface{}, len(exportExpenseHeader))
+	for i, h := range exportExpenseHeader {
+		header[i] = h
+	}
+	x.WriteRow(header...)
+
+	for rows.Next() {
+		row, err := scanExportExpense(rows)
+		if err != nil {
+			log.Printf("Error exporting expenses to XLSX: %v", err)
+			return
+		}
+		if err := x.WriteRow(row.ID, row.Date, row.Category, row.Name, row.Amount, row.Description); err != nil {
+			log.Printf("Error writing XLSX export: %v", err)
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error exporting expenses to XLSX: %v", err)
+	}
+
+	if err := x.Close(); err != nil {
+		log.Printf("Error writing XLSX export: %v", err)
+	}
+}
+
+// Статистика в XLSX: лист с итогами по месяцам и по листу на каждую категорию
+func exportStatisticsXLSX(c *gin.Context) {
+	where, args, ok := bindExportFilter(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	type monthTotal struct {
+		Month  string
+		Amount float64
+		Count  int
+	}
+
+	totalRows, err := db.QueryContext(ctx, "SELECT to_char(e.date AT TIME ZONE "+householdTimezoneSQL+", 'YYYY-MM') AS month, SUM(e.amount), COUNT(*) FROM expenses e"+
+		where+" GROUP BY month ORDER BY month", args...)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var totals []monthTotal
+	for totalRows.Next() {
+		var t monthTotal
+		if err := totalRows.Scan(&t.Month, &t.Amount, &t.Count); err != nil {
+			totalRows.Close()
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		totals = append(totals, t)
+	}
+	totalRows.Close()
+
+	rows, err := db.QueryContext(ctx, "SELECT c.id, c.name, to_char(e.date AT TIME ZONE "+householdTimezoneSQL+", 'YYYY-MM') AS month, SUM(e.amount), COUNT(*) FROM expenses e JOIN categories c ON c.id = e.category_id"+
+		where+" GROUP BY c.id, c.name, month ORDER BY c.name, c.id, month", args...)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	startDownload(c, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "statistics.xlsx")
+
+	x := newXLSXWriter(c.Writer)
+	x.StartSheet("Итоги по месяцам")
+	x.WriteRow("Месяц", "Сумма", "Количество")
+	var grandTotal float64
+	var grandCount int
+	for _, t := range totals {
+		x.WriteRow(t.Month, t.Amount, t.Count)
+		grandTotal += t.Amount
+		grandCount += t.Count
+	}
+	x.WriteRow("Итого", grandTotal, grandCount)
+
+	currentID := 0
+	var catTotal float64
+	var catCount int
+	for rows.Next() {
+		var id int
+		var name string
+		var t monthTotal
+		if err := rows.Scan(&id, &name, &t.Month, &t.Amount, &t.Count); err != nil {
+			log.Printf("Error exporting statistics to XLSX: %v", err)
+			return
+		}
+
+		if id != currentID {
+			if currentID != 0 {
+				x.WriteRow("Итого", catTotal, catCount)
+			}
+			currentID, catTotal, catCount = id, 0, 0
+			x.StartSheet(name)
+			x.WriteRow("Месяц", "Сумма", "Количество")
+		}
+
+		x.WriteRow(t.Month, t.Amount, t.Count)
+		catTotal += t.Amount
+		catCount += t.Count
+	}
+	if currentID != 0 {
+		x.WriteRow("Итого", catTotal, catCount)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error exporting statistics to XLSX: %v", err)
+	}
+
+	if err := x.Close(); err != nil {
+		log.Printf("Error writing XLSX export: %v", err)
+	}
+}
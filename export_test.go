@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Выгрузка, которая пишет дольше WriteTimeout сервера, доходит до клиента целиком
+func TestStartDownloadOutlivesWriteTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const writeTimeout = 100 * time.Millisecond
+
+	router := gin.New()
+	slowExport := func(c *gin.Context) {
+		c.Writer.WriteString("id\n")
+		c.Writer.Flush()
+		time.Sleep(3 * writeTimeout)
+		c.Writer.WriteString("1\n")
+	}
+	router.GET("/export", func(c *gin.Context) {
+		startDownload(c, "text/csv; charset=utf-8", "expenses.csv")
+		slowExport(c)
+	})
+	router.GET("/plain", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		slowExport(c)
+	})
+
+	server := httptest.NewUnstartedServer(router)
+	server.Config.WriteTimeout = writeTimeout
+	server.Start()
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/export")
+	if err != nil {
+		t.Fatalf("GET /export: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "id\n1\n" {
+		t.Fatalf("export body = %q (%v), want the whole file", body, err)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="expenses.csv"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	// Без продления тот же ответ обрывается: значит, тест действительно упирается в WriteTimeout
+	resp, err = server.Client().Get(server.URL + "/plain")
+	if err == nil {
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil && string(body) == "id\n1\n" {
+		t.Skip("server did not enforce WriteTimeout")
+	}
+}
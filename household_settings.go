@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+	// База часовых поясов в бинарнике: в контейнере без tzdata LoadLocation иначе не работает
+	_ "time/tzdata"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Часовой пояс домохозяйства в SQL-запросах, где $1 - id домохозяйства
+const householdTimezoneSQL = "(SELECT timezone FROM households WHERE id = $1)"
+
+// Настройки домохозяйства. Timezone - имя IANA (Europe/Moscow): в нем считаются
+// дни, недели и месяцы статистики и интерпретируются даты без времени.
+// Остальные поля задают границы периодов; неделя - 1 (понедельник) ... 7 (воскресенье).
+// В PUT незаданные поля сохраняют текущие значения.
+type HouseholdSettings struct {
+	Timezone             string `json:"timezone"`
+	MonthStartDay        int    `json:"monthStartDay" binding:"omitempty,min=1,max=28"`
+	WeekStartDay         int    `json:"weekStartDay" binding:"omitempty,min=1,max=7"`
+	FiscalYearStartMonth int    `json:"fiscalYearStartMonth" binding:"omitempty,min=1,max=12"`
+}
+
+func loadHouseholdSettings(ctx context.Context, q queryer, householdID int) (HouseholdSettings, error) {
+	var settings HouseholdSettings
+	err := q.QueryRowContext(ctx, "SELECT timezone, month_start_day, week_start_day, fiscal_year_start_month FROM households WHERE id = $1", householdID).
+		Scan(&settings.Timezone, &settings.MonthStartDay, &settings.WeekStartDay, &settings.FiscalYearStartMonth)
+	return settings, err
+}
+
+// Календарь периодов по настройкам
+func (s HouseholdSettings) calendar() (periodCalendar, error) {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return periodCalendar{}, err
+	}
+	return periodCalendar{
+		Location:             loc,
+		MonthStartDay:        s.MonthStartDay,
+		WeekStartDay:         time.Weekday(s.WeekStartDay % 7),
+		FiscalYearStartMonth: time.Month(s.FiscalYearStartMonth),
+	}, nil
+}
+
+// Часовой пояс новых домохозяйств; DEFAULT_TIMEZONE задает его для всей установки
+func defaultHouseholdTimezone() string {
+	if tz := os.Getenv("DEFAULT_TIMEZONE"); tz != "" {
+		if _, err := time.LoadLocation(tz); err == nil && tz != "Local" {
+			return tz
+		}
+		log.Printf("Invalid DEFAULT_TIMEZONE %q, using UTC", tz)
+	}
+	return "UTC"
+}
+
+func householdCalendar(ctx context.Context, q queryer, householdID int) (periodCalendar, error) {
+	settings, err := loadHouseholdSettings(ctx, q, householdID)
+	if err != nil {
+		return periodCalendar{}, err
+	}
+	return settings.calendar()
+}
+
+func householdLocation(ctx context.Context, q queryer, householdID int) (*time.Location, error) {
+	cal, err := householdCalendar(ctx, q, householdID)
+	if err != nil {
+		return nil, err
+	}
+	return cal.Location, nil
+}
+
+// Пересчитывает месячную статистику категорий домохозяйства по его часовому поясу и началу месяца
+func recomputeMonthlyStatsWithTx(ctx context.Context, tx *sql.Tx, householdID int) error {
+	cal, err := householdCalendar(ctx, tx, householdID)
+	if err != nil {
+		return err
+	}
+
+	// Сдвиг на MonthStartDay-1 дней переводит финансовый месяц в календарный, в котором он начался
+	rows, err := tx.QueryContext(ctx, `SELECT c.id, to_char((e.date AT TIME ZONE `+householdTimezoneSQL+`) - ($2::int - 1) * INTERVAL '1 day', 'YYYY-MM'), SUM(e.amount)
+		FROM categories c LEFT JOIN expenses e ON e.category_id = c.id AND e.deleted_at IS NULL
+		WHERE c.household_id = $1 AND c.deleted_at IS NULL GROUP BY 1, 2 ORDER BY 1`, householdID, cal.MonthStartDay)
+	if err != nil {
+		return err
+	}
+	stats := make(map[int]map[string]float64)
+	var categoryIDs []int
+	for rows.Next() {
+		var categoryID int
+		var month sql.NullString
+		var amount sql.NullFloat64
+		if err := rows.Scan(&categoryID, &month, &amount); err != nil {
+			rows.Close()
+			return err
+		}
+		if stats[categoryID] == nil {
+			stats[categoryID] = make(map[string]float64)
+			categoryIDs = append(categoryIDs, categoryID)
+		}
+		if !month.Valid {
+			continue
+		}
+		start, err := time.Parse("2006-01", month.String)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		start = start.AddDate(0, 0, cal.MonthStartDay-1)
+		stats[categoryID][cal.bucketLabel(start, granularityMonth)] += amount.Float64
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, categoryID := range categoryIDs {
+		statsJSON, err := json.Marshal(stats[categoryID])
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE categories SET monthly_stats = $1 WHERE id = $2", statsJSON, categoryID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Старые базы хранили даты расходов и поступлений без пояса: это местное время клиента
+// с отброшенным смещением. Переводит их в TIMESTAMPTZ по DEFAULT_TIMEZONE, назначает этот пояс
+// существующим домохозяйствам и пересчитывает их месячную статистику. Выполняется один раз.
+func migrateLegacyDates(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	legacyZone := defaultHouseholdTimezone()
+	converted := false
+	for _, table := range []string{"expenses", "incomes"} {
+		var dataType string
+		err := tx.QueryRowContext(ctx, "SELECT data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = 'date'", table).
+			Scan(&dataType)
+		if err != nil {
+			return err
+		}
+		if dataType != "timestamp without time zone" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" ALTER COLUMN date TYPE TIMESTAMPTZ USING date AT TIME ZONE "+pq.QuoteLiteral(legacyZone)); err != nil {
+			return err
+		}
+		converted = true
+	}
+	if !converted {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE households SET timezone = $1", legacyZone); err != nil {
+		return err
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM households")
+	if err != nil {
+		return err
+	}
+	var householdIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		householdIDs = append(householdIDs, id)
+	}
+	rows.Close()
+	for _, id := range householdIDs {
+		if err := recomputeMonthlyStatsWithTx(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Converted expense and income dates from %s, recomputed stats of %d households", legacyZone, len(householdIDs))
+	return tx.Commit()
+}
+
+func getHouseholdSettings(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	householdID, ok := requireHouseholdRole(c, ctx, roleViewer)
+	if !ok {
+		return
+	}
+	settings, err := loadHouseholdSettings(ctx, db, householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data:   settings,
+	})
+}
+
+// Меняет настройки; при смене часового пояса или начала месяца месячная статистика пересчитывается
+func updateHouseholdSettings(c *gin.Context) {
+	var req HouseholdSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil || req.Timezone == "Local" {
+			respondWithError(c, http.StatusBadRequest, "Unknown timezone: "+req.Timezone)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	householdID, ok := requireHouseholdRole(c, ctx, roleOwner)
+	if !ok {
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	current, err := loadHouseholdSettings(ctx, tx, householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	settings := current
+	if req.Timezone != "" {
+		settings.Timezone = req.Timezone
+	}
+	if req.MonthStartDay != 0 {
+		settings.MonthStartDay = req.MonthStartDay
+	}
+	if req.WeekStartDay != 0 {
+		settings.WeekStartDay = req.WeekStartDay
+	}
+	if req.FiscalYearStartMonth != 0 {
+		settings.FiscalYearStartMonth = req.FiscalYearStartMonth
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE households SET timezone = $1, month_start_day = $2, week_start_day = $3, fiscal_year_start_month = $4 WHERE id = $5",
+		settings.Timezone, settings.MonthStartDay, settings.WeekStartDay, settings.FiscalYearStartMonth, householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Ключи месячной статистики зависят только от часового пояса и начала месяца
+	if settings.Timezone != current.Timezone || settings.MonthStartDay != current.MonthStartDay {
+		if err := recomputeMonthlyStatsWithTx(ctx, tx, householdID); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Household settings updated",
+		Data:    settings,
+	})
+}
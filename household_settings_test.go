@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefaultHouseholdTimezone(t *testing.T) {
+	tests := map[string]string{
+		"":              "UTC",
+		"Europe/Moscow": "Europe/Moscow",
+		"Local":         "UTC",
+		"Mars/Olympus":  "UTC",
+	}
+	for env, want := range tests {
+		t.Setenv("DEFAULT_TIMEZONE", env)
+		if got := defaultHouseholdTimezone(); got != want {
+			t.Errorf("DEFAULT_TIMEZONE=%q: got %s, want %s", env, got, want)
+		}
+	}
+}
+
+func TestHouseholdSettingsCalendar(t *testing.T) {
+	cal, err := HouseholdSettings{Timezone: "Asia/Vladivostok", MonthStartDay: 25, WeekStartDay: 7, FiscalYearStartMonth: 4}.calendar()
+	if err != nil {
+		t.Fatalf("calendar: %v", err)
+	}
+	if cal.Location.String() != "Asia/Vladivostok" || cal.MonthStartDay != 25 || cal.WeekStartDay != time.Sunday || cal.FiscalYearStartMonth != time.April {
+		t.Errorf("calendar = %+v", cal)
+	}
+	if _, err := (HouseholdSettings{Timezone: "Mars/Olympus", MonthStartDay: 1, WeekStartDay: 1, FiscalYearStartMonth: 1}).calendar(); err == nil {
+		t.Error("unknown timezone accepted")
+	}
+}
+
+// Пересчет в SQL и пошаговое обновление при записи расходов дают одну и ту же статистику
+func TestRecomputeMonthlyStatsMatchesIncrementalUpdates(t *testing.T) {
+	ctx, tx := testTx(t)
+	_, householdID := createTestUser(t, ctx, tx)
+	if _, err := tx.ExecContext(ctx, "UPDATE households SET timezone = 'Asia/Vladivostok', month_start_day = 25 WHERE id = $1", householdID); err != nil {
+		t.Fatal(err)
+	}
+	food := createTestCategory(t, ctx, tx, householdID, "Food")
+	empty := createTestCategory(t, ctx, tx, householdID, "Empty")
+
+	for i, date := range []time.Time{
+		time.Date(2024, time.January, 24, 13, 59, 0, 0, time.UTC), // 24 января 23:59 по Владивостоку
+		time.Date(2024, time.January, 24, 14, 0, 0, 0, time.UTC),  // 25 января 00:00 - новый месяц
+		time.Date(2024, time.February, 29, 12, 0, 0, 0, time.UTC),
+		time.Date(2024, time.December, 31, 20, 0, 0, 0, time.UTC), // уже 2025 год
+	} {
+		createTestExpense(t, ctx, tx, householdID, food, "Expense", float64(100*(i+1)), date)
+	}
+	// Расход в корзине в статистику не входит
+	trashed := createTestExpense(t, ctx, tx, householdID, food, "Trashed", 1000, time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC))
+	if _, err := tx.ExecContext(ctx, "UPDATE expenses SET deleted_at = NOW() WHERE id = $1", trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateMonthlyStatsWithTx(ctx, tx, food, -trashed.Amount, trashed.Date); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{
+		"2023-12-25/2024-01-24": 100,
+		"2024-01-25/2024-02-24": 200,
+		"2024-02-25/2024-03-24": 300,
+		"2024-12-25/2025-01-24": 400,
+	}
+	incremental := loadTestMonthlyStats(t, ctx, tx, food)
+	for month, amount := range incremental {
+		if amount == 0 {
+			delete(incremental, month)
+		}
+	}
+	assertMonthlyStats(t, incremental, want)
+
+	// Испорченная статистика восстанавливается пересчетом
+	if _, err := tx.ExecContext(ctx, `UPDATE categories SET monthly_stats = '{"1999-01": 1}' WHERE id = ANY(ARRAY[$1, $2]::int[])`, food, empty); err != nil {
+		t.Fatal(err)
+	}
+	version := loadTestCategoryVersion(t, ctx, tx, food)
+	if err := recomputeMonthlyStatsWithTx(ctx, tx, householdID); err != nil {
+		t.Fatalf("recomputeMonthlyStatsWithTx: %v", err)
+	}
+	assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, tx, food), want)
+	assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, tx, empty), map[string]float64{})
+	if v := loadTestCategoryVersion(t, ctx, tx, food); v != version {
+		t.Errorf("category version = %d after recompute, want %d", v, version)
+	}
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ключи контекста Gin с выбранным домохозяйством и ролью в нем
+const (
+	householdIDKey = "householdID"
+	roleKey        = "role"
+)
+
+// Заголовок для выбора домохозяйства; без него используется домохозяйство по умолчанию
+const householdHeader = "X-Household-ID"
+
+// Роли участников: владелец управляет составом, редактор меняет данные, читатель только смотрит
+const (
+	roleOwner  = "owner"
+	roleEditor = "editor"
+	roleViewer = "viewer"
+)
+
+var roleRank = map[string]int{
+	roleViewer: 1,
+	roleEditor: 2,
+	roleOwner:  3,
+}
+
+const invitationTTL = 7 * 24 * time.Hour
+
+// Таблицы, строки которых принадлежат домохозяйству
+var householdTables = []string{"categories", "expenses", "incomes", "category_rules"}
+
+type Household struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	IsDefault bool      `json:"isDefault"`
+	Timezone  string    `json:"timezone"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type HouseholdMember struct {
+	UserID   int       `json:"userId"`
+	Username string    `json:"username"`
+	Email    string    `json:"email,omitempty"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+type HouseholdInvitation struct {
+	ID         int        `json:"id"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	AcceptedAt *time.Time `json:"acceptedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+type CreateHouseholdRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type InviteRequest struct {
+	Email string `json:"email" binding:"required"`
+	Role  string `json:"role" binding:"required"`
+}
+
+type MemberRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+func createHouseholdWithTx(ctx context.Context, tx *sql.Tx, name string, ownerID int) (int, error) {
+	var id int
+	if err := tx.QueryRowContext(ctx, "INSERT INTO households (name, timezone) VALUES ($1, $2) RETURNING id", name, defaultHouseholdTimezone()).Scan(&id); err != nil {
+		return 0, err
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO household_members (household_id, user_id, role) VALUES ($1, $2, $3)", id, ownerID, roleOwner)
+	return id, err
+}
+
+// Роль пользователя в домохозяйстве; пустая строка, если он не участник
+func householdRole(ctx context.Context, q queryer, householdID, userID int) (string, error) {
+	var role string
+	err := q.QueryRowContext(ctx, "SELECT role FROM household_members WHERE household_id = $1 AND user_id = $2", householdID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// Выбирает домохозяйство запроса и роль в нем. Без домохозяйства по умолчанию запрос
+// все равно проходит: пользователь может создать новое или принять приглашение.
+func resolveHousehold(c *gin.Context, ctx context.Context, userID int) bool {
+	var householdID int
+	if header := c.GetHeader(householdHeader); header != "" {
+		id, err := strconv.Atoi(header)
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, "Invalid "+householdHeader+" header")
+			return false
+		}
+		householdID = id
+	} else {
+		var defaultID sql.NullInt64
+		if err := db.QueryRowContext(ctx, "SELECT default_household_id FROM users WHERE id = $1", userID).Scan(&defaultID); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return false
+		}
+		if !defaultID.Valid {
+			return true
+		}
+		householdID = int(defaultID.Int64)
+	}
+
+	role, err := householdRole(ctx, db, householdID, userID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if role == "" {
+		respondWithError(c, http.StatusForbidden, "You are not a member of this household")
+		return false
+	}
+
+	c.Set(householdIDKey, householdID)
+	c.Set(roleKey, role)
+	return true
+}
+
+// Домохозяйство, выбранное для запроса
+func currentHouseholdID(c *gin.Context) int {
+	return c.GetInt(householdIDKey)
+}
+
+// Право токена и минимальная роль в выбранном домохозяйстве
+func requireAccess(scope, minRole string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasScope(c, scope) {
+			respondWithError(c, http.StatusForbidden, "Token lacks required scope: "+scope)
+			c.Abort()
+			return
+		}
+		if currentHouseholdID(c) == 0 {
+			respondWithError(c, http.StatusForbidden, "No household selected")
+			c.Abort()
+			return
+		}
+		if roleRank[c.GetString(roleKey)] < roleRank[minRole] {
+			respondWithError(c, http.StatusForbidden, "This action requires the "+minRole+" role")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Проверяет роль в домохозяйстве из пути запроса; при ошибке уже отвечает клиенту
+func requireHouseholdRole(c *gin.Context, ctx context.Context, minRole string) (int, bool) {
+	householdID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, "Invalid household ID")
+		return 0, false
+	}
+	role, err := householdRole(ctx, db, householdID, currentUserID(c))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return 0, false
+	}
+	if role == "" {
+		respondWithError(c, http.StatusNotFound, "Household not found")
+		return 0, false
+	}
+	if roleRank[role] < roleRank[minRole] {
+		respondWithError(c, http.StatusForbidden, "This action requires the "+minRole+" role")
+		return 0, false
+	}
+	return householdID, true
+}
+
+// Проверяет, что категория существует, принадлежит домохозяйству и не лежит в корзине
+func categoryInHousehold(ctx context.Context, q queryer, householdID, categoryID int) (bool, error) {
+	var exists bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM categories WHERE id = $1 AND household_id = $2 AND deleted_at IS NULL)", categoryID, householdID).Scan(&exists)
+	return exists, err
+}
+
+// В домохозяйстве должен остаться хотя бы один владелец. Строки участников блокируются
+// до конца транзакции, чтобы параллельные понижения и выходы не убрали последнего владельца.
+func isLastOwner(ctx context.Context, tx *sql.Tx, householdID, userID int) (bool, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT user_id, role FROM household_members WHERE household_id = $1 FOR UPDATE", householdID)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	others := 0
+	for rows.Next() {
+		var memberID int
+		var role string
+		if err := rows.Scan(&memberID, &role); err != nil {
+			return false, err
+		}
+		if role == roleOwner && memberID != userID {
+			others++
+		}
+	}
+	return others == 0, rows.Err()
+}
+
+func getHouseholds(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT h.id, h.name, m.role, COALESCE(u.default_household_id = h.id, FALSE), h.timezone, h.created_at FROM household_members m JOIN households h ON h.id = m.household_id JOIN users u ON u.id = m.user_id WHERE m.user_id = $1 ORDER BY h.id",
+		currentUserID(c))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	households := []Household{}
+	for rows.Next() {
+		var h Household
+		if err := rows.Scan(&h.ID, &h.Name, &h.Role, &h.IsDefault, &h.Timezone, &h.CreatedAt); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		households = append(households, h)
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data:   households,
+	})
+}
+
+func createHousehold(c *gin.Context) {
+	var req CreateHouseholdRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		respondWithError(c, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	userID := currentUserID(c)
+	id, err := createHouseholdWithTx(ctx, tx, name, userID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Первое домохозяйство пользователя становится основным
+	res, err := tx.ExecContext(ctx, "UPDATE users SET default_household_id = $1 WHERE id = $2 AND default_household_id IS NULL", id, userID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	isDefault, _ := res.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, Response{
+		Status:  "success",
+		Message: "Household created successfully",
+		Data:    Household{ID: id, Name: name, Role: roleOwner, IsDefault: isDefault > 0, Timezone: defaultHouseholdTimezone(), CreatedAt: time.Now()},
+	})
+}
+
+func setDefaultHousehold(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	householdID, ok := requireHouseholdRole(c, ctx, roleViewer)
+	if !ok {
+		return
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE users SET default_household_id = $1 WHERE id = $2", householdID, currentUserID(c)); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Default household updated",
+	})
+}
+
+func getHouseholdMembers(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	householdID, ok := requireHouseholdRole(c, ctx, roleViewer)
+	if !ok {
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT u.id, u.username, COALESCE(u.email, ''), m.role, m.joined_at FROM household_members m JOIN users u ON u.id = m.user_id WHERE m.household_id = $1 ORDER BY m.joined_at, u.id",
+		householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	members := []HouseholdMember{}
+	for rows.Next() {
+		var m HouseholdMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Email, &m.Role, &m.JoinedAt); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		members = append(members, m)
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data:   members,
+	})
+}
+
+func updateHouseholdMember(c *gin.Context) {
+	var req MemberRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if roleRank[req.Role] == 0 {
+		respondWithError(c, http.StatusBadRequest, "Unknown role: "+req.Role)
+		return
+	}
+	memberID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	householdID, ok := requireHouseholdRole(c, ctx, roleOwner)
+	if !ok {
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if req.Role != roleOwner {
+		last, err := isLastOwner(ctx, tx, householdID, memberID)
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if last {
+			respondWithError(c, http.StatusConflict, "Household must keep at least one owner")
+			return
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, "UPDATE household_members SET role = $1 WHERE household_id = $2 AND user_id = $3", req.Role, householdID, memberID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(c, http.StatusNotFound, "Member not found")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Member role updated successfully",
+	})
+}
+
+// Владелец может исключить любого участника, остальные - только выйти сами
+func removeHouseholdMember(c *gin.Context) {
+	memberID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	minRole := roleOwner
+	if memberID == currentUserID(c) {
+		minRole = roleViewer
+	}
+	householdID, ok := requireHouseholdRole(c, ctx, minRole)
+	if !ok {
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	last, err := isLastOwner(ctx, tx, householdID, memberID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	role, err := householdRole(ctx, tx, householdID, memberID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if role == "" {
+		respondWithError(c, http.StatusNotFound, "Member not found")
+		return
+	}
+	if role == roleOwner && last {
+		respondWithError(c, http.StatusConflict, "Household must keep at least one owner")
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM household_members WHERE household_id = $1 AND user_id = $2", householdID, memberID); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET default_household_id = NULL WHERE id = $1 AND default_household_id = $2", memberID, householdID); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Member removed successfully",
+	})
+}
+
+func scanInvitation(scan func(dest ...interface{}) error) (HouseholdInvitation, error) {
+	var inv HouseholdInvitation
+	var acceptedAt, revokedAt sql.NullTime
+	if err := scan(&inv.ID, &inv.Email, &inv.Role, &inv.CreatedAt, &inv.ExpiresAt, &acceptedAt, &revokedAt); err != nil {
+		return inv, err
+	}
+	inv.AcceptedAt = nullTimePtr(acceptedAt)
+	inv.RevokedAt = nullTimePtr(revokedAt)
+	return inv, nil
+}
+
+func getInvitations(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	householdID, ok := requireHouseholdRole(c, ctx, roleOwner)
+	if !ok {
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, email, role, created_at, expires_at, accepted_at, revoked_at FROM household_invitations WHERE household_id = $1 ORDER BY id",
+		householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	invitations := []HouseholdInvitation{}
+	for rows.Next() {
+		inv, err := scanInvitation(rows.Scan)
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		invitations = append(invitations, inv)
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data:   invitations,
+	})
+}
+
+// Отправляет приглашение письмом; принять его может тот, у кого есть ссылка
+func createInvitation(c *gin.Context) {
+	var req InviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil || addr.Name != "" {
+		respondWithError(c, http.StatusBadRequest, "Invalid email address")
+		return
+	}
+	if roleRank[req.Role] == 0 {
+		respondWithError(c, http.StatusBadRequest, "Unknown role: "+req.Role)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	householdID, ok := requireHouseholdRole(c, ctx, roleOwner)
+	if !ok {
+		return
+	}
+
+	token, hash, err := newSecretToken()
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	row := db.QueryRowContext(ctx, "INSERT INTO household_invitations (household_id, email, role, token_hash, invited_by, expires_at) VALUES ($1, $2, $3, $4, $5, NOW() + $6::interval) RETURNING id, email, role, created_at, expires_at, accepted_at, revoked_at",
+		householdID, addr.Address, req.Role, hash, currentUserID(c), fmt.Sprintf("%d seconds", int(invitationTTL.Seconds())))
+	inv, err := scanInvitation(row.Scan)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var householdName string
+	if err := db.QueryRowContext(ctx, "SELECT name FROM households WHERE id = $1", householdID).Scan(&householdName); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	body := fmt.Sprintf("Вас пригласили в домохозяйство «%s» с ролью %s.\nЧтобы присоединиться, перейдите по ссылке:\n%s/invitations/accept?token=%s\n\nСсылка действует %d дн.",
+		householdName, req.Role, appURL(), token, int(invitationTTL.Hours()/24))
+	if err := notifier.Send(addr.Address, "Приглашение в домохозяйство", body); err != nil {
+		log.Printf("Error sending invitation to %s: %v", addr.Address, err)
+	}
+
+	c.JSON(http.StatusCreated, Response{
+		Status:  "success",
+		Message: "Invitation sent",
+		Data:    inv,
+	})
+}
+
+func revokeInvitation(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	householdID, ok := requireHouseholdRole(c, ctx, roleOwner)
+	if !ok {
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "UPDATE household_invitations SET revoked_at = NOW() WHERE id = $1 AND household_id = $2 AND accepted_at IS NULL AND revoked_at IS NULL",
+		c.Param("invitationId"), householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(c, http.StatusNotFound, "Invitation not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Invitation revoked successfully",
+	})
+}
+
+func acceptInvitation(c *gin.Context) {
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	userID := currentUserID(c)
+	var invitationID, householdID int
+	var role string
+	var emailMatches bool
+	err = tx.QueryRowContext(ctx, `SELECT i.id, i.household_id, i.role, COALESCE(u.email_verified AND lower(u.email) = lower(i.email), FALSE)
+		FROM household_invitations i JOIN users u ON u.id = $1
+		WHERE i.token_hash = $2 AND i.accepted_at IS NULL AND i.revoked_at IS NULL AND i.expires_at > NOW() FOR UPDATE OF i`,
+		userID, hashSecretToken(req.Token)).Scan(&invitationID, &householdID, &role, &emailMatches)
+	if err == sql.ErrNoRows {
+		respondWithError(c, http.StatusBadRequest, "Invalid or expired invitation")
+		return
+	}
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Приглашение действует только для подтвержденного адреса, на который оно отправлено:
+	// ссылка, попавшая к другому человеку, в домохозяйство не пускает
+	if !emailMatches {
+		respondWithError(c, http.StatusForbidden, "Invitation was sent to another email address")
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE household_invitations SET accepted_at = NOW(), accepted_by = $1 WHERE id = $2", userID, invitationID); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Уже состоящему участнику приглашение роль не понижает
+	_, err = tx.ExecContext(ctx, `INSERT INTO household_members (household_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (household_id, user_id) DO UPDATE SET role = EXCLUDED.role
+		WHERE CASE household_members.role WHEN 'owner' THEN 3 WHEN 'editor' THEN 2 ELSE 1 END < CASE EXCLUDED.role WHEN 'owner' THEN 3 WHEN 'editor' THEN 2 ELSE 1 END`,
+		householdID, userID, role)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET default_household_id = $1 WHERE id = $2 AND default_household_id IS NULL", householdID, userID); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Invitation accepted",
+		Data:    map[string]interface{}{"householdId": householdID, "role": role},
+	})
+}
+
+// Передает домохозяйству строки, созданные до появления учетных записей (household_id IS NULL)
+func adoptLegacyData(ctx context.Context, householdID int) (map[string]int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	adopted := make(map[string]int64)
+	for _, table := range householdTables {
+		res, err := tx.ExecContext(ctx, "UPDATE "+table+" SET household_id = $1 WHERE household_id IS NULL", householdID)
+		if err != nil {
+			return nil, err
+		}
+		adopted[table], _ = res.RowsAffected()
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return adopted, nil
+}
+
+// expense-tracker adopt-legacy-data -user <имя>
+func runAdoptLegacyDataCommand(args []string) error {
+	fs := flag.NewFlagSet("adopt-legacy-data", flag.ExitOnError)
+	username := fs.String("user", "", "user whose default household receives the data")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	householdID, err := lookupHouseholdID(ctx, *username)
+	if err != nil {
+		return err
+	}
+	adopted, err := adoptLegacyData(ctx, householdID)
+	if err != nil {
+		return err
+	}
+	for _, table := range householdTables {
+		fmt.Printf("%s: %d rows assigned to household %d\n", table, adopted[table], householdID)
+	}
+	return nil
+}
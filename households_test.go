@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Участник домохозяйства с заданной ролью
+func addTestMember(t *testing.T, ctx context.Context, tx *sql.Tx, householdID int, role string) *User {
+	t.Helper()
+	user, _ := createTestUser(t, ctx, tx)
+	if _, err := tx.ExecContext(ctx, "INSERT INTO household_members (household_id, user_id, role) VALUES ($1, $2, $3)", householdID, user.ID, role); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// Два владельца одновременно понижают друг друга: один из запросов должен получить 409
+func TestConcurrentDemotionKeepsOwner(t *testing.T) {
+	var first, second *User
+	var householdID int
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		first, householdID = createTestUser(t, ctx, tx)
+		second = addTestMember(t, ctx, tx, householdID, roleOwner)
+	})
+
+	demote := func(actor, member *User) int {
+		router := testRouter(actor.ID, householdID)
+		router.PUT("/households/:id/members/:userId", updateHouseholdMember)
+		return doJSON(router, http.MethodPut, fmt.Sprintf("/households/%d/members/%d", householdID, member.ID), MemberRoleRequest{Role: roleEditor}).Code
+	}
+
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); codes[0] = demote(first, second) }()
+	go func() { defer wg.Done(); codes[1] = demote(second, first) }()
+	wg.Wait()
+
+	var owners int
+	if err := db.QueryRow("SELECT COUNT(*) FROM household_members WHERE household_id = $1 AND role = $2", householdID, roleOwner).Scan(&owners); err != nil {
+		t.Fatal(err)
+	}
+	if owners != 1 {
+		t.Errorf("owners = %d after concurrent demotions (statuses %v), want 1", owners, codes)
+	}
+	if !(codes[0] == http.StatusOK && codes[1] == http.StatusConflict) && !(codes[0] == http.StatusConflict && codes[1] == http.StatusOK) {
+		t.Errorf("statuses = %v, want one success and one 409", codes)
+	}
+}
+
+// Ссылка приглашения действует только для подтвержденного адреса, на который ее отправили
+func TestAcceptInvitationRequiresInvitedEmail(t *testing.T) {
+	var invited, stranger *User
+	var householdID int
+	token := uniqueName(t)
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		var owner *User
+		owner, householdID = createTestUser(t, ctx, tx)
+		var err error
+		if invited, err = createUserWithTx(ctx, tx, token+"-invited", token+"@example.com", ""); err != nil {
+			t.Fatal(err)
+		}
+		if stranger, err = createUserWithTx(ctx, tx, token+"-stranger", token+"-stranger@example.com", ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET email_verified = TRUE WHERE id = $1", stranger.ID); err != nil {
+			t.Fatal(err)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO household_invitations (household_id, email, role, token_hash, invited_by, expires_at) VALUES ($1, $2, $3, $4, $5, NOW() + interval '1 day')",
+			householdID, strings.ToUpper(token)+"@EXAMPLE.COM", roleEditor, hashSecretToken(token), owner.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	accept := func(user *User) *httptest.ResponseRecorder {
+		router := testRouter(user.ID, 0)
+		router.POST("/invitations/accept", acceptInvitation)
+		return doJSON(router, http.MethodPost, "/invitations/accept", TokenRequest{Token: token})
+	}
+
+	if w := accept(stranger); w.Code != http.StatusForbidden {
+		t.Errorf("another user: status = %d, want 403: %s", w.Code, w.Body)
+	}
+	if w := accept(invited); w.Code != http.StatusForbidden {
+		t.Errorf("unverified email: status = %d, want 403: %s", w.Code, w.Body)
+	}
+	if _, err := db.Exec("UPDATE users SET email_verified = TRUE WHERE id = $1", invited.ID); err != nil {
+		t.Fatal(err)
+	}
+	if w := accept(invited); w.Code != http.StatusOK {
+		t.Fatalf("invited user: status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	ctx := context.Background()
+	for user, want := range map[*User]string{invited: roleEditor, stranger: ""} {
+		role, err := householdRole(ctx, db, householdID, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role != want {
+			t.Errorf("role of %s = %q, want %q", user.Username, role, want)
+		}
+	}
+}
+
+// Данные без домохозяйства не достаются тому, кто зарегистрировался первым:
+// их передают явно командой adopt-legacy-data
+func TestAdoptLegacyData(t *testing.T) {
+	var legacyID, householdID int
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		if err := tx.QueryRowContext(ctx, "INSERT INTO categories (name, description, monthly_stats) VALUES ($1, '', '{}') RETURNING id", uniqueName(t)).Scan(&legacyID); err != nil {
+			t.Fatal(err)
+		}
+		_, householdID = createTestUser(t, ctx, tx)
+	})
+	ctx := context.Background()
+
+	var owner sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT household_id FROM categories WHERE id = $1", legacyID).Scan(&owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner.Valid {
+		t.Fatalf("legacy category was assigned to household %d on user creation", owner.Int64)
+	}
+
+	adopted, err := adoptLegacyData(ctx, householdID)
+	if err != nil {
+		t.Fatalf("adoptLegacyData: %v", err)
+	}
+	if adopted["categories"] < 1 {
+		t.Errorf("adopted = %v, want the legacy category", adopted)
+	}
+	if err := db.QueryRowContext(ctx, "SELECT household_id FROM categories WHERE id = $1", legacyID).Scan(&owner); err != nil {
+		t.Fatal(err)
+	}
+	if !owner.Valid || int(owner.Int64) != householdID {
+		t.Errorf("legacy category household = %v, want %d", owner, householdID)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// Заголовок повторно отданного ответа
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	// Сколько хранится ключ с ответом
+	idempotencyInterval = "24 hours"
+	// Через сколько незавершенный запрос (сервер упал или перезапустился) перестает держать ключ
+	idempotencyStaleInterval = "5 minutes"
+	// Наибольшее тело JSON-запроса с ключом; файлы и резервные копии ограничены по маршруту
+	maxIdempotentBodySize = 4 << 20
+	// Запас на поля и заголовки частей multipart сверх размера файла
+	multipartOverhead = 1 << 20
+)
+
+// Ограничения тела для маршрутов, которые принимают больше обычного JSON
+var idempotencyBodyLimits = map[string]int64{
+	"/api/restore":    maxBackupSize,
+	"/api/import/csv": maxImportFileSize + multipartOverhead,
+	"/api/import/ofx": maxImportFileSize + multipartOverhead,
+	"/api/import/1c":  maxImportFileSize + multipartOverhead,
+}
+
+// Сколько тела можно прочитать в память для отпечатка на этом маршруте
+func idempotencyBodyLimit(c *gin.Context) int64 {
+	if limit, ok := idempotencyBodyLimits[c.FullPath()]; ok {
+		return limit
+	}
+	return maxIdempotentBodySize
+}
+
+// Заголовки, которые сохраняются вместе с телом ответа
+var idempotencyStoredHeaders = []string{"Content-Type", "Content-Disposition", "ETag", "Location"}
+
+// Сохраненный ответ на запрос с ключом; Status = 0, пока запрос выполняется
+type idempotentResponse struct {
+	Fingerprint string
+	Status      int
+	Headers     map[string]string
+	Body        []byte
+}
+
+// Копирует тело ответа, чтобы его можно было сохранить после обработчика
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Отпечаток запроса: тот же ключ с другим запросом - ошибка клиента, а не повтор
+func idempotencyFingerprint(c *gin.Context, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(c.Request.Method + " " + c.Request.URL.RequestURI() + "\n"))
+	h.Write([]byte(strconv.Itoa(currentHouseholdID(c)) + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Занимает ключ за пользователем. Если ключ уже есть и не истек, возвращает сохраненную запись.
+func claimIdempotencyKey(ctx context.Context, userID int, key, fingerprint string) (bool, *idempotentResponse, error) {
+	var claimed bool
+	err := db.QueryRowContext(ctx, `INSERT INTO idempotency_keys (user_id, key, fingerprint) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint, status = NULL, headers = NULL, body = NULL, created_at = NOW()
+		WHERE idempotency_keys.created_at < NOW() - $4::interval OR (idempotency_keys.status IS NULL AND idempotency_keys.created_at < NOW() - $5::interval)
+		RETURNING true`, userID, key, fingerprint, idempotencyInterval, idempotencyStaleInterval).Scan(&claimed)
+	if err == nil {
+		return true, nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, nil, err
+	}
+
+	var stored idempotentResponse
+	var status sql.NullInt64
+	var headersJSON []byte
+	err = db.QueryRowContext(ctx, "SELECT fingerprint, status, headers, body FROM idempotency_keys WHERE user_id = $1 AND key = $2", userID, key).
+		Scan(&stored.Fingerprint, &status, &headersJSON, &stored.Body)
+	if err == sql.ErrNoRows {
+		// Запись успели освободить после ошибки сервера: клиент может повторить запрос
+		return false, &idempotentResponse{Fingerprint: fingerprint}, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	stored.Status = int(status.Int64)
+	if len(headersJSON) > 0 {
+		if err := json.Unmarshal(headersJSON, &stored.Headers); err != nil {
+			return false, nil, err
+		}
+	}
+	return false, &stored, nil
+}
+
+// Сохраняет ответ под ключом. Ответы 5xx не сохраняются: ключ освобождается для повтора.
+func finishIdempotencyKey(ctx context.Context, userID int, key string, status int, headers map[string]string, body []byte) error {
+	if status >= http.StatusInternalServerError {
+		_, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2", userID, key)
+		return err
+	}
+	headersJSON, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE idempotency_keys SET status = $1, headers = $2, body = $3 WHERE user_id = $4 AND key = $5",
+		status, headersJSON, body, userID, key)
+	return err
+}
+
+// Повтор POST с тем же Idempotency-Key в течение суток получает исходный ответ
+// вместо повторного выполнения. Подключается только после authMiddleware: ключи привязаны
+// к пользователю, а ответы входа с токенами сохранять нельзя.
+func idempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if c.Request.Method != http.MethodPost || key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			respondWithError(c, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			c.Abort()
+			return
+		}
+
+		// Тело нужно целиком для отпечатка; больше, чем принимает маршрут, не читаем
+		limit := idempotencyBodyLimit(c)
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, err.Error())
+			c.Abort()
+			return
+		}
+		if int64(len(body)) > limit {
+			respondWithError(c, http.StatusRequestEntityTooLarge, "Request body is too large")
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		userID := currentUserID(c)
+		fingerprint := idempotencyFingerprint(c, body)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		claimed, stored, err := claimIdempotencyKey(ctx, userID, key, fingerprint)
+		cancel()
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			c.Abort()
+			return
+		}
+		if !claimed {
+			switch {
+			case stored.Fingerprint != fingerprint:
+				respondWithError(c, http.StatusConflict, "Idempotency-Key was already used with a different request")
+			case stored.Status == 0:
+				respondWithError(c, http.StatusConflict, "A request with this Idempotency-Key is still being processed")
+			default:
+				for name, value := range stored.Headers {
+					c.Header(name, value)
+				}
+				c.Header(idempotencyReplayedHeader, "true")
+				c.Status(stored.Status)
+				c.Writer.Write(stored.Body)
+			}
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		headers := make(map[string]string)
+		for _, name := range idempotencyStoredHeaders {
+			if value := recorder.Header().Get(name); value != "" {
+				headers[name] = value
+			}
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := finishIdempotencyKey(ctx, userID, key, recorder.Status(), headers, recorder.body.Bytes()); err != nil {
+			log.Printf("Error saving response for idempotency key: %v", err)
+		}
+	}
+}
+
+// Удаляет ключи старше суток
+func purgeIdempotencyKeys(ctx context.Context) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < NOW() - $1::interval", idempotencyInterval)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Периодическая очистка истекших ключей в фоне, пока работает сервер
+func startIdempotencyPurger() {
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if _, err := purgeIdempotencyKeys(ctx); err != nil {
+				log.Printf("Error purging idempotency keys: %v", err)
+			}
+			cancel()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Роутер с idempotencyMiddleware и обработчиком, который считает вызовы
+func idempotencyTestRouter(userID, householdID int, status *int, calls *int) *gin.Engine {
+	router := testRouter(userID, householdID)
+	router.Use(idempotencyMiddleware())
+	handler := func(c *gin.Context) {
+		*calls++
+		c.Header("Location", "/api/expenses/42")
+		c.JSON(*status, Response{Status: "success", Data: *calls})
+	}
+	router.POST("/api/expenses", handler)
+	router.POST("/api/restore", handler)
+	router.GET("/api/expenses", handler)
+	return router
+}
+
+func postWithKey(router http.Handler, target, key string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// Проверки, которые срабатывают до обращения к базе
+func TestIdempotencyMiddlewareRejectsBeforeClaim(t *testing.T) {
+	status, calls := http.StatusCreated, 0
+	router := idempotencyTestRouter(1, 1, &status, &calls)
+
+	w := postWithKey(router, "/api/expenses", strings.Repeat("k", maxIdempotencyKeyLength+1), []byte(`{}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("long key: status = %d, want 400", w.Code)
+	}
+
+	w = postWithKey(router, "/api/expenses", "big", make([]byte, maxIdempotentBodySize+1))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status = %d, want 413", w.Code)
+	}
+
+	// Без ключа и не для POST middleware ничего не делает
+	if w := postWithKey(router, "/api/expenses", "", []byte(`{}`)); w.Code != http.StatusCreated {
+		t.Errorf("no key: status = %d, want 201", w.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/expenses", nil)
+	req.Header.Set(idempotencyKeyHeader, "get")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated || w.Header().Get(idempotencyReplayedHeader) != "" {
+		t.Errorf("GET: status = %d, replayed %q", w.Code, w.Header().Get(idempotencyReplayedHeader))
+	}
+	if calls != 2 {
+		t.Errorf("handler calls = %d, want 2", calls)
+	}
+}
+
+func TestIdempotencyBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	want := map[string]int64{
+		"/api/expenses":   maxIdempotentBodySize,
+		"/api/restore":    maxBackupSize,
+		"/api/import/csv": maxImportFileSize + multipartOverhead,
+	}
+	limits := make(map[string]int64)
+	router := gin.New()
+	for path := range want {
+		router.POST(path, func(c *gin.Context) { limits[c.FullPath()] = idempotencyBodyLimit(c) })
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, nil))
+	}
+	for path, limit := range want {
+		if limits[path] != limit {
+			t.Errorf("limit for %s = %d, want %d", path, limits[path], limit)
+		}
+	}
+}
+
+func TestIdempotencyMiddlewareReplay(t *testing.T) {
+	var alice, bob *User
+	var householdID int
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		alice, householdID = createTestUser(t, ctx, tx)
+		bob, _ = createTestUser(t, ctx, tx)
+	})
+	key := uniqueName(t)
+	body := []byte(`{"name":"Lunch","amount":500}`)
+
+	status, calls := http.StatusCreated, 0
+	router := idempotencyTestRouter(alice.ID, householdID, &status, &calls)
+
+	first := postWithKey(router, "/api/expenses", key, body)
+	if first.Code != http.StatusCreated || first.Header().Get(idempotencyReplayedHeader) != "" {
+		t.Fatalf("first request: status = %d, replayed %q", first.Code, first.Header().Get(idempotencyReplayedHeader))
+	}
+
+	replay := postWithKey(router, "/api/expenses", key, body)
+	if calls != 1 {
+		t.Fatalf("handler calls = %d, want 1: the repeat must be replayed", calls)
+	}
+	if replay.Code != first.Code || replay.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %s, want %d %s", replay.Code, replay.Body, first.Code, first.Body)
+	}
+	if replay.Header().Get(idempotencyReplayedHeader) != "true" || replay.Header().Get("Location") != "/api/expenses/42" {
+		t.Errorf("replay headers = %v", replay.Header())
+	}
+
+	if w := postWithKey(router, "/api/expenses", key, []byte(`{"name":"Dinner","amount":700}`)); w.Code != http.StatusConflict {
+		t.Errorf("same key, other body: status = %d, want 409", w.Code)
+	}
+	if w := postWithKey(router, "/api/restore", key, body); w.Code != http.StatusConflict {
+		t.Errorf("same key, other route: status = %d, want 409", w.Code)
+	}
+
+	// Ключи разных пользователей не пересекаются
+	bobRouter := idempotencyTestRouter(bob.ID, householdID, &status, &calls)
+	if w := postWithKey(bobRouter, "/api/expenses", key, body); w.Code != http.StatusCreated || w.Header().Get(idempotencyReplayedHeader) != "" {
+		t.Errorf("other user: status = %d, replayed %q", w.Code, w.Header().Get(idempotencyReplayedHeader))
+	}
+	if calls != 2 {
+		t.Errorf("handler calls = %d, want 2", calls)
+	}
+
+	// Ответ 5xx не сохраняется: повтор выполняется заново
+	failingKey := key + "-failing"
+	status = http.StatusInternalServerError
+	postWithKey(router, "/api/expenses", failingKey, body)
+	status = http.StatusCreated
+	if w := postWithKey(router, "/api/expenses", failingKey, body); w.Code != http.StatusCreated || w.Header().Get(idempotencyReplayedHeader) != "" {
+		t.Errorf("retry after 5xx: status = %d, replayed %q", w.Code, w.Header().Get(idempotencyReplayedHeader))
+	}
+	if calls != 4 {
+		t.Errorf("handler calls = %d, want 4", calls)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Максимальный размер загружаемого файла выписки
+const maxImportFileSize = 10 << 20
+
+var errImportFileTooLarge = fmt.Errorf("file is too large: the limit is %d MB", maxImportFileSize>>20)
+
+// Типы записей импорта: выписки банков содержат и списания, и поступления
+const (
+	importTypeExpense = "expense"
+	importTypeIncome  = "income"
+)
+
+// Строка импорта с результатом разбора и проверки
+type ImportRow struct {
+	Line        int      `json:"line"`
+	Type        string   `json:"type"`
+	Expense     *Expense `json:"expense,omitempty"`
+	Income      *Income  `json:"income,omitempty"`
+	ExternalID  string   `json:"externalId,omitempty"`
+	RuleID      int      `json:"ruleId,omitempty"`
+	Duplicate   bool     `json:"duplicate"`
+	DuplicateOf int      `json:"duplicateOf,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// Ключ для поиска дубликатов внутри одного файла
+func (r *ImportRow) dedupKey() string {
+	if r.ExternalID != "" {
+		return r.Type + "|" + r.ExternalID
+	}
+	if r.Income != nil {
+		return fmt.Sprintf("%s|%s|%.2f|%s", r.Type, r.Income.Date.Format("2006-01-02"), r.Income.Amount, strings.ToLower(r.Income.Name))
+	}
+	return fmt.Sprintf("%s|%s|%.2f|%s", r.Type, r.Expense.Date.Format("2006-01-02"), r.Expense.Amount, strings.ToLower(r.Expense.Name))
+}
+
+// Итог импорта (или предварительного просмотра)
+type ImportResult struct {
+	DryRun     bool        `json:"dryRun"`
+	Total      int         `json:"total"`
+	Imported   int         `json:"imported"`
+	Duplicates int         `json:"duplicates"`
+	Errors     int         `json:"errors"`
+	Rows       []ImportRow `json:"rows"`
+}
+
+// Общий интерфейс для *sql.DB и *sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Читает файл выписки целиком. Файл больше лимита не обрезается молча, а отклоняется.
+func readImportFile(r io.Reader) ([]byte, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, maxImportFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxImportFileSize {
+		return nil, errImportFileTooLarge
+	}
+	return raw, nil
+}
+
+// Оборачивает входной поток декодером указанной кодировки
+func decodeReader(r io.Reader, encoding string) (io.Reader, error) {
+	switch strings.ToLower(strings.ReplaceAll(encoding, "_", "-")) {
+	case "", "utf-8", "utf8":
+		// Пропускаем BOM, который добавляет Excel
+		br := bufio.NewReader(r)
+		if bom, err := br.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+			br.Discard(3)
+		}
+		return br, nil
+	case "windows-1251", "cp1251", "win1251":
+		return charmap.Windows1251.NewDecoder().Reader(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+// Проверяет строки на ошибки и дубликаты среди существующих расходов и внутри файла
+func validateImportRows(ctx context.Context, q queryer, householdID int, source string, rows []ImportRow) error {
+	categoryIDs := make(map[int]bool)
+	catRows, err := q.QueryContext(ctx, "SELECT id FROM categories WHERE household_id = $1 AND deleted_at IS NULL", householdID)
+	if err != nil {
+		return err
+	}
+	for catRows.Next() {
+		var id int
+		if err := catRows.Scan(&id); err != nil {
+			catRows.Close()
+			return err
+		}
+		categoryIDs[id] = true
+	}
+	catRows.Close()
+
+	// Совпадение по дню считается в часовом поясе домохозяйства
+	loc, err := householdLocation(ctx, q, householdID)
+	if err != nil {
+		return err
+	}
+
+	// Правила подбирают категорию строкам без нее и добавляют теги
+	rules, err := loadRules(ctx, q, householdID)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]int)
+	for i := range rows {
+		row := &rows[i]
+		if row.Error != "" {
+			continue
+		}
+		if row.Type == importTypeExpense {
+			if rule := applyRules(rules, row.Expense, false); rule != nil {
+				row.RuleID = rule.ID
+			}
+			if row.Expense.CategoryID == 0 {
+				row.Error = "category is required"
+				continue
+			}
+			if !categoryIDs[row.Expense.CategoryID] {
+				row.Error = fmt.Sprintf("category %d not found", row.Expense.CategoryID)
+				continue
+			}
+		}
+
+		// Дубликаты внутри самого файла
+		key := row.dedupKey()
+		if line, ok := seen[key]; ok {
+			row.Duplicate = true
+			row.Error = fmt.Sprintf("duplicate of line %d", line)
+			continue
+		}
+		seen[key] = row.Line
+
+		// Дубликаты среди уже сохраненных записей
+		var existingID int
+		switch {
+		case row.ExternalID != "" && row.Type == importTypeIncome:
+			err = q.QueryRowContext(ctx, "SELECT id FROM incomes WHERE household_id = $1 AND source = $2 AND external_id = $3",
+				householdID, source, row.ExternalID).Scan(&existingID)
+		case row.ExternalID != "":
+			err = q.QueryRowContext(ctx, "SELECT id FROM expenses WHERE household_id = $1 AND source = $2 AND external_id = $3",
+				householdID, source, row.ExternalID).Scan(&existingID)
+		case row.Type == importTypeIncome:
+			err = q.QueryRowContext(ctx, "SELECT id FROM incomes WHERE household_id = $1 AND (date AT TIME ZONE "+householdTimezoneSQL+")::date = $2::date AND amount = $3 AND lower(name) = lower($4) LIMIT 1",
+				householdID, row.Income.Date.In(loc).Format("2006-01-02"), row.Income.Amount, row.Income.Name).Scan(&existingID)
+		default:
+			err = q.QueryRowContext(ctx, "SELECT id FROM expenses WHERE household_id = $1 AND deleted_at IS NULL AND (date AT TIME ZONE "+householdTimezoneSQL+")::date = $2::date AND amount = $3 AND lower(name) = lower($4) LIMIT 1",
+				householdID, row.Expense.Date.In(loc).Format("2006-01-02"), row.Expense.Amount, row.Expense.Name).Scan(&existingID)
+		}
+		switch {
+		case err == nil:
+			row.Duplicate = true
+			row.DuplicateOf = existingID
+		case err != sql.ErrNoRows:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Сохраняет корректные строки, записывает их в журнал изменений и обновляет месячную статистику в рамках транзакции
+func importRowsWithTx(ctx context.Context, tx *sql.Tx, actor auditActor, source string, rows []ImportRow) (int, error) {
+	householdID := actor.HouseholdID
+	imported := 0
+	// Статистика пересчитывается один раз на категорию после всех вставок
+	deltas := statsDeltas{}
+	for i := range rows {
+		row := &rows[i]
+		if row.Error != "" || row.Duplicate {
+			continue
+		}
+
+		var externalID sql.NullString
+		if row.ExternalID != "" {
+			externalID = sql.NullString{String: row.ExternalID, Valid: true}
+		}
+
+		// Поступления сохраняются отдельно и в статистику расходов не попадают
+		if row.Type == importTypeIncome {
+			inc := row.Income
+			err := tx.QueryRowContext(ctx, "INSERT INTO incomes (name, amount, date, description, source, external_id, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+				inc.Name, inc.Amount, inc.Date, inc.Description, source, externalID, householdID).Scan(&inc.ID)
+			if err != nil {
+				return 0, fmt.Errorf("line %d: %v", row.Line, err)
+			}
+			imported++
+			continue
+		}
+
+		exp := row.Expense
+		err := tx.QueryRowContext(ctx, "INSERT INTO expenses (category_id, name, amount, date, description, source, external_id, tags, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+			exp.CategoryID, exp.Name, exp.Amount, exp.Date, exp.Description, source, externalID, encodeTags(exp.Tags), householdID).Scan(&exp.ID)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %v", row.Line, err)
+		}
+		if err := recordAudit(ctx, tx, actor, auditCreate, auditEntityExpense, exp.ID, nil, exp); err != nil {
+			return 0, err
+		}
+
+		deltas.add(exp.CategoryID, exp.Amount, exp.Date)
+		imported++
+	}
+
+	if err := deltas.applyWithTx(ctx, tx); err != nil {
+		return 0, err
+	}
+	return imported, nil
+}
+
+// Проверяет строки и, если это не предварительный просмотр, сохраняет их одной транзакцией
+func runImport(ctx context.Context, actor auditActor, source string, rows []ImportRow, dryRun bool) (*ImportResult, error) {
+	householdID := actor.HouseholdID
+	result := &ImportResult{DryRun: dryRun, Total: len(rows), Rows: rows}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := validateImportRows(ctx, tx, householdID, source, rows); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		switch {
+		case row.Duplicate:
+			result.Duplicates++
+		case row.Error != "":
+			result.Errors++
+		}
+	}
+
+	if dryRun {
+		return result, nil
+	}
+
+	result.Imported, err = importRowsWithTx(ctx, tx, actor, source, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if row.Expense != nil && row.Expense.ID != 0 {
+			classifier.Add(householdID, row.Expense)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Источник расходов, загруженных из файлов обмена 1С "Клиент-Банк"
+const clientBankSource = "1c"
+
+type ClientBankImportOptions struct {
+	CategoryID int    `form:"categoryId"`
+	Encoding   string `form:"encoding"`
+	DryRun     bool   `form:"dryRun"`
+}
+
+// Определение кодировки файла обмена: UTF-8, Windows-1251 или DOS (CP866)
+func decodeClientBank(raw []byte, encoding string) (string, error) {
+	if encoding != "" {
+		if strings.EqualFold(encoding, "dos") || strings.EqualFold(encoding, "cp866") {
+			decoded, err := charmap.CodePage866.NewDecoder().Bytes(raw)
+			return string(decoded), err
+		}
+		reader, err := decodeReader(bytes.NewReader(raw), encoding)
+		if err != nil {
+			return "", err
+		}
+		decoded, err := io.ReadAll(reader)
+		return string(decoded), err
+	}
+
+	if utf8.Valid(raw) {
+		return strings.TrimPrefix(string(raw), "\ufeff"), nil
+	}
+
+	decoded, err := charmap.Windows1251.NewDecoder().Bytes(raw)
+	if err != nil {
+		return "", err
+	}
+	// Файл в кодировке DOS после декодирования как Windows-1251 не содержит кириллических ключей
+	if !strings.Contains(string(decoded), "СекцияДокумент") {
+		decoded, err = charmap.CodePage866.NewDecoder().Bytes(raw)
+		if err != nil {
+			return "", err
+		}
+	}
+	return string(decoded), nil
+}
+
+// Преобразует секцию документа в строку импорта
+func clientBankDocumentRow(line int, doc map[string]string, categoryID int, loc *time.Location) ImportRow {
+	exp := &Expense{CategoryID: categoryID}
+	row := ImportRow{Line: line, Type: importTypeExpense, Expense: exp}
+
+	exp.Name = doc["Получатель1"]
+	if exp.Name == "" {
+		exp.Name = doc["Получатель"]
+	}
+	if exp.Name == "" {
+		row.Error = "counterparty is empty"
+		return row
+	}
+
+	exp.Description = doc["НазначениеПлатежа"]
+	if exp.Description == "" {
+		// В старых версиях формата назначение разбито на строки
+		var parts []string
+		for i := 1; i <= 6; i++ {
+			if part := doc[fmt.Sprintf("НазначениеПлатежа%d", i)]; part != "" {
+				parts = append(parts, part)
+			}
+		}
+		exp.Description = strings.Join(parts, " ")
+	}
+
+	amount, err := strconv.ParseFloat(strings.ReplaceAll(doc["Сумма"], ",", "."), 64)
+	if err != nil || amount <= 0 {
+		row.Error = fmt.Sprintf("invalid amount: %s", doc["Сумма"])
+		return row
+	}
+	exp.Amount = math.Round(amount*100) / 100
+
+	dateStr := doc["ДатаСписано"]
+	if dateStr == "" {
+		dateStr = doc["Дата"]
+	}
+	exp.Date, err = time.ParseInLocation("02.01.2006", dateStr, loc)
+	if err != nil {
+		row.Error = fmt.Sprintf("invalid date: %s", dateStr)
+		return row
+	}
+
+	// Номер платежного поручения уникален только в пределах счета и года
+	if number := doc["Номер"]; number != "" {
+		row.ExternalID = doc["ПлательщикСчет"] + ":" + doc["Дата"] + ":" + number
+	}
+
+	return row
+}
+
+// Разбор файла 1CClientBankExchange; в расходы попадают только исходящие платежи
+func parseClientBank(r io.Reader, encoding string, categoryID int, loc *time.Location) ([]ImportRow, error) {
+	raw, err := readImportFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := decodeClientBank(raw, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(strings.TrimSpace(data), "1CClientBankExchange") {
+		return nil, errors.New("not a 1CClientBankExchange file")
+	}
+
+	var rows []ImportRow
+	ownAccounts := make(map[string]bool)
+	var doc map[string]string
+	docLine := 0
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		key, value, hasValue := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch {
+		case key == "СекцияДокумент":
+			doc = map[string]string{"ВидДокумента": value}
+			docLine = line
+		case key == "КонецДокумента":
+			if doc == nil {
+				continue
+			}
+			// Исходящий платеж: плательщик - один из наших счетов, либо есть дата списания
+			outgoing := ownAccounts[doc["ПлательщикСчет"]]
+			if len(ownAccounts) == 0 {
+				outgoing = doc["ДатаСписано"] != ""
+			}
+			if outgoing {
+				rows = append(rows, clientBankDocumentRow(docLine, doc, categoryID, loc))
+			}
+			doc = nil
+		case doc != nil && hasValue:
+			doc[key] = value
+		case key == "РасчСчет" && value != "":
+			ownAccounts[value] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func importClientBank(c *gin.Context) {
+	var opts ClientBankImportOptions
+	if err := c.ShouldBind(&opts); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, "Exchange file is required")
+		return
+	}
+	if fileHeader.Size > maxImportFileSize {
+		respondWithError(c, http.StatusRequestEntityTooLarge, "Exchange file is too large")
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	// Даты без времени и без смещения относятся к часовому поясу домохозяйства
+	loc, err := householdLocation(ctx, db, currentHouseholdID(c))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rows, err := parseClientBank(file, opts.Encoding, opts.CategoryID, loc)
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := runImport(ctx, auditActorFrom(c), clientBankSource, rows, opts.DryRun)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithImportResult(c, result)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Выписка с разделом счетов: исходящие платежи определяются по счету плательщика
+const clientBankFixture = `1CClientBankExchange
+ВерсияФормата=1.03
+Кодировка=Windows
+Отправитель=Бухгалтерия предприятия
+ДатаНачала=01.01.2024
+ДатаКонца=31.01.2024
+РасчСчет=40702810900000000001
+СекцияРасчСчет
+ДатаНачала=01.01.2024
+РасчСчет=40702810900000000001
+КонецРасчСчет
+СекцияДокумент=Платежное поручение
+Номер=15
+Дата=10.01.2024
+Сумма=1500.50
+ПлательщикСчет=40702810900000000001
+Плательщик=ООО "Ромашка"
+ПолучательСчет=40702810100000000777
+Получатель=ИНН 7700000000 ООО "Поставщик"
+Получатель1=ООО "Поставщик"
+НазначениеПлатежа=Оплата по счету 12
+ДатаСписано=11.01.2024
+КонецДокумента
+СекцияДокумент=Платежное поручение
+Номер=3
+Дата=12.01.2024
+Сумма=90000
+ПлательщикСчет=40702810100000000777
+Плательщик=ООО "Покупатель"
+ПолучательСчет=40702810900000000001
+Получатель=ООО "Ромашка"
+ДатаПоступило=12.01.2024
+КонецДокумента
+СекцияДокумент=Платежное поручение
+Номер=16
+Дата=20.01.2024
+Сумма=250,00
+ПлательщикСчет=40702810900000000001
+Получатель=ИП Иванов
+НазначениеПлатежа1=Аренда
+НазначениеПлатежа2=за январь
+КонецДокумента
+СекцияДокумент=Платежное поручение
+Номер=17
+Дата=21.01.2024
+Сумма=0
+ПлательщикСчет=40702810900000000001
+Получатель=ИП Петров
+КонецДокумента
+КонецФайла
+`
+
+func TestDecodeClientBank(t *testing.T) {
+	const text = "1CClientBankExchange\r\nСекцияДокумент=Платежное поручение\r\nПолучатель=ООО \"Ёлка\"\r\n"
+	cp1251, err := charmap.Windows1251.NewEncoder().String(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp866, err := charmap.CodePage866.NewEncoder().String(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, raw, encoding string
+		wantErr             bool
+	}{
+		{name: "utf-8", raw: text},
+		{name: "utf-8 with BOM", raw: "\ufeff" + text},
+		{name: "windows-1251 detected", raw: cp1251},
+		{name: "cp866 detected", raw: cp866},
+		{name: "windows-1251 requested", raw: cp1251, encoding: "windows-1251"},
+		{name: "dos requested", raw: cp866, encoding: "DOS"},
+		{name: "cp866 requested", raw: cp866, encoding: "cp866"},
+		{name: "unknown encoding", raw: text, encoding: "koi8-r", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := decodeClientBank([]byte(tt.raw), tt.encoding)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil || got != text {
+			t.Errorf("%s: %q, %v, want %q", tt.name, got, err, text)
+		}
+	}
+}
+
+func TestParseClientBank(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Vladivostok")
+	if err != nil {
+		t.Skip("time zone database is not available")
+	}
+	cp1251, err := charmap.Windows1251.NewEncoder().String(clientBankFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, input := range map[string]string{"utf-8": clientBankFixture, "windows-1251": cp1251} {
+		t.Run(name, func(t *testing.T) {
+			rows, err := parseClientBank(strings.NewReader(input), "", 5, loc)
+			if err != nil {
+				t.Fatalf("parseClientBank: %v", err)
+			}
+			// Входящий платеж от покупателя пропускается
+			want := []struct {
+				line                                int
+				name, description, externalID, date string
+				amount                              float64
+				err                                 string
+			}{
+				{line: 12, name: `ООО "Поставщик"`, description: "Оплата по счету 12", externalID: "40702810900000000001:10.01.2024:15", date: "2024-01-11", amount: 1500.5},
+				{line: 34, name: "ИП Иванов", description: "Аренда за январь", externalID: "40702810900000000001:20.01.2024:16", date: "2024-01-20", amount: 250},
+				{line: 43, err: "invalid amount: 0"},
+			}
+			if len(rows) != len(want) {
+				t.Fatalf("got %d rows, want %d: %+v", len(rows), len(want), rows)
+			}
+			for i, w := range want {
+				got := rows[i]
+				if got.Line != w.line || got.Type != importTypeExpense || got.Error != w.err {
+					t.Errorf("row %d: line %d, type %q, error %q; want line %d, error %q", i, got.Line, got.Type, got.Error, w.line, w.err)
+					continue
+				}
+				if w.err != "" {
+					continue
+				}
+				exp := got.Expense
+				wantDate, _ := time.ParseInLocation("2006-01-02", w.date, loc)
+				if exp.Name != w.name || exp.Description != w.description || exp.Amount != w.amount || !exp.Date.Equal(wantDate) || exp.CategoryID != 5 {
+					t.Errorf("row %d: %+v, want %q %q %.2f %s", i, exp, w.name, w.description, w.amount, w.date)
+				}
+				if got.ExternalID != w.externalID {
+					t.Errorf("row %d: external ID %q, want %q", i, got.ExternalID, w.externalID)
+				}
+			}
+		})
+	}
+}
+
+// Без раздела счетов исходящим считается документ с датой списания
+func TestParseClientBankWithoutAccounts(t *testing.T) {
+	input := `1CClientBankExchange
+ВерсияФормата=1.02
+СекцияДокумент=Платежное поручение
+Номер=1
+Дата=10.01.2024
+Сумма=100
+Получатель=ООО "Связь"
+ДатаСписано=10.01.2024
+КонецДокумента
+СекцияДокумент=Платежное поручение
+Номер=2
+Дата=11.01.2024
+Сумма=200
+Плательщик=ООО "Клиент"
+ДатаПоступило=11.01.2024
+КонецДокумента
+КонецФайла
+`
+	rows, err := parseClientBank(strings.NewReader(input), "", 0, time.UTC)
+	if err != nil {
+		t.Fatalf("parseClientBank: %v", err)
+	}
+	if len(rows) != 1 || rows[0].Expense == nil || rows[0].Expense.Name != `ООО "Связь"` || rows[0].Expense.Amount != 100 {
+		t.Fatalf("rows = %+v, want only the outgoing payment", rows)
+	}
+	if rows[0].ExternalID != ":10.01.2024:1" {
+		t.Errorf("external ID = %q", rows[0].ExternalID)
+	}
+}
+
+func TestParseClientBankRejects(t *testing.T) {
+	if _, err := parseClientBank(strings.NewReader("<OFX>\n</OFX>\n"), "", 0, time.UTC); err == nil {
+		t.Error("OFX file was accepted as a 1C exchange file")
+	}
+
+	// Файл больше лимита не обрезается, а отклоняется
+	big := append([]byte("1CClientBankExchange\n"), bytes.Repeat([]byte("\n"), maxImportFileSize)...)
+	if _, err := parseClientBank(bytes.NewReader(big), "", 0, time.UTC); err != errImportFileTooLarge {
+		t.Errorf("file over the limit: error = %v, want %v", err, errImportFileTooLarge)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Источник расходов, загруженных из CSV
+const csvSource = "csv"
+
+// Настройки разбора CSV-файла
+type CSVImportOptions struct {
+	Delimiter          string `form:"delimiter"`
+	Encoding           string `form:"encoding"`
+	DateFormat         string `form:"dateFormat"`
+	DecimalSeparator   string `form:"decimalSeparator"`
+	ThousandsSeparator string `form:"thousandsSeparator"`
+	HasHeader          *bool  `form:"hasHeader"`
+	SkipRows           int    `form:"skipRows"`
+	InvertSign         bool   `form:"invertSign"`
+	CategoryID         int    `form:"categoryId"`
+	Mapping            string `form:"mapping"`
+	DryRun             bool   `form:"dryRun"`
+}
+
+// Соответствие полей Expense колонкам файла: имя колонки из заголовка или номер колонки (с нуля)
+type CSVColumnMapping struct {
+	Name        string `json:"name"`
+	Amount      string `json:"amount"`
+	Date        string `json:"date"`
+	Description string `json:"description"`
+	CategoryID  string `json:"categoryId"`
+}
+
+// Индексы колонок после сопоставления с заголовком
+type csvColumns struct {
+	name, amount, date, description, categoryID int
+}
+
+// Находит номер колонки по имени из заголовка или по числовому индексу
+func resolveCSVColumn(spec string, header []string, required bool, field string) (int, error) {
+	if spec == "" {
+		if required {
+			return -1, fmt.Errorf("mapping for %s is required", field)
+		}
+		return -1, nil
+	}
+
+	if idx, err := strconv.Atoi(spec); err == nil {
+		if idx < 0 {
+			return -1, fmt.Errorf("invalid column index for %s: %d", field, idx)
+		}
+		return idx, nil
+	}
+
+	for i, col := range header {
+		if strings.EqualFold(strings.TrimSpace(col), strings.TrimSpace(spec)) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("column %q for %s not found in header", spec, field)
+}
+
+// Разбор суммы с учетом разделителей целой части и разрядов
+func parseAmount(s, decimalSep, thousandsSep string) (float64, error) {
+	s = strings.TrimSpace(s)
+	// Пробелы и неразрывные пробелы часто используются как разделитель разрядов
+	s = strings.NewReplacer(" ", "", "\u00a0", "", "\u202f", "").Replace(s)
+	if thousandsSep != "" && thousandsSep != " " {
+		s = strings.ReplaceAll(s, thousandsSep, "")
+	}
+	if decimalSep != "" && decimalSep != "." {
+		s = strings.ReplaceAll(s, decimalSep, ".")
+	}
+	if s == "" {
+		return 0, errors.New("amount is empty")
+	}
+
+	amount, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount: %s", s)
+	}
+	return math.Round(amount*100) / 100, nil
+}
+
+// Значение колонки или пустая строка, если колонки нет
+func csvField(record []string, idx int) string {
+	if idx < 0 || idx >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[idx])
+}
+
+// Разбор CSV-потока в строки импорта
+func parseCSVExpenses(r io.Reader, opts CSVImportOptions, mapping CSVColumnMapping, loc *time.Location) ([]ImportRow, error) {
+	reader, err := decodeReader(r, opts.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := csv.NewReader(reader)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	if opts.Delimiter != "" {
+		delim := opts.Delimiter
+		if delim == `\t` || strings.EqualFold(delim, "tab") {
+			delim = "\t"
+		}
+		d, size := utf8.DecodeRuneInString(delim)
+		if size != len(delim) {
+			return nil, fmt.Errorf("delimiter must be a single character: %q", opts.Delimiter)
+		}
+		cr.Comma = d
+	}
+
+	dateFormat := opts.DateFormat
+	if dateFormat == "" {
+		dateFormat = "2006-01-02"
+	}
+	decimalSep := opts.DecimalSeparator
+	if decimalSep == "" {
+		decimalSep = "."
+	}
+
+	line := 0
+	for i := 0; i < opts.SkipRows; i++ {
+		if _, err := cr.Read(); err != nil {
+			return nil, fmt.Errorf("skipping rows: %v", err)
+		}
+		line++
+	}
+
+	var header []string
+	if opts.HasHeader == nil || *opts.HasHeader {
+		header, err = cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("reading header: %v", err)
+		}
+		line++
+	}
+
+	var cols csvColumns
+	if cols.name, err = resolveCSVColumn(mapping.Name, header, true, "name"); err != nil {
+		return nil, err
+	}
+	if cols.amount, err = resolveCSVColumn(mapping.Amount, header, true, "amount"); err != nil {
+		return nil, err
+	}
+	if cols.date, err = resolveCSVColumn(mapping.Date, header, true, "date"); err != nil {
+		return nil, err
+	}
+	if cols.description, err = resolveCSVColumn(mapping.Description, header, false, "description"); err != nil {
+		return nil, err
+	}
+	if cols.categoryID, err = resolveCSVColumn(mapping.CategoryID, header, false, "categoryId"); err != nil {
+		return nil, err
+	}
+
+	var rows []ImportRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			rows = append(rows, ImportRow{Line: line, Type: importTypeExpense, Error: err.Error()})
+			continue
+		}
+		// Пустые строки в конце выписки
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+
+		exp := &Expense{}
+		row := ImportRow{Line: line, Type: importTypeExpense, Expense: exp}
+		exp.Name = csvField(record, cols.name)
+		exp.Description = csvField(record, cols.description)
+		exp.CategoryID = opts.CategoryID
+
+		if exp.Name == "" {
+			row.Error = "name is empty"
+			rows = append(rows, row)
+			continue
+		}
+
+		exp.Amount, err = parseAmount(csvField(record, cols.amount), decimalSep, opts.ThousandsSeparator)
+		if err == nil && opts.InvertSign {
+			exp.Amount = -exp.Amount
+		}
+		if err == nil && exp.Amount <= 0 {
+			err = fmt.Errorf("amount must be positive: %.2f", exp.Amount)
+		}
+		if err != nil {
+			row.Error = err.Error()
+			rows = append(rows, row)
+			continue
+		}
+
+		exp.Date, err = time.ParseInLocation(dateFormat, csvField(record, cols.date), loc)
+		if err != nil {
+			row.Error = fmt.Sprintf("invalid date: %s", csvField(record, cols.date))
+			rows = append(rows, row)
+			continue
+		}
+
+		if cols.categoryID >= 0 {
+			if value := csvField(record, cols.categoryID); value != "" {
+				exp.CategoryID, err = strconv.Atoi(value)
+				if err != nil {
+					row.Error = fmt.Sprintf("invalid categoryId: %s", value)
+				}
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func importCSV(c *gin.Context) {
+	var opts CSVImportOptions
+	if err := c.ShouldBind(&opts); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var mapping CSVColumnMapping
+	if opts.Mapping == "" {
+		respondWithError(c, http.StatusBadRequest, "Column mapping is required")
+		return
+	}
+	if err := json.Unmarshal([]byte(opts.Mapping), &mapping); err != nil {
+		respondWithError(c, http.StatusBadRequest, "Invalid column mapping: "+err.Error())
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, "CSV file is required")
+		return
+	}
+	if fileHeader.Size > maxImportFileSize {
+		respondWithError(c, http.StatusRequestEntityTooLarge, "CSV file is too large")
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	// Даты без времени и без смещения относятся к часовому поясу домохозяйства
+	loc, err := householdLocation(ctx, db, currentHouseholdID(c))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rows, err := parseCSVExpenses(file, opts, mapping, loc)
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := runImport(ctx, auditActorFrom(c), csvSource, rows, opts.DryRun)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithImportResult(c, result)
+}
+
+// Ответ с результатом импорта: просмотр возвращает 200, сохранение - 201
+func respondWithImportResult(c *gin.Context, result *ImportResult) {
+	if result.DryRun {
+		c.JSON(http.StatusOK, Response{
+			Status:  "success",
+			Message: "Import preview",
+			Data:    result,
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, Response{
+		Status:  "success",
+		Message: fmt.Sprintf("Imported %d records", result.Imported),
+		Data:    result,
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in, decimal, thousands string
+		want                   float64
+		wantErr                bool
+	}{
+		{in: "1234.56", decimal: ".", want: 1234.56},
+		{in: " 42 ", decimal: ".", want: 42},
+		{in: "1234,56", decimal: ",", want: 1234.56},
+		{in: "1 234,56", decimal: ",", want: 1234.56},
+		{in: "1\u00a0234,56", decimal: ",", want: 1234.56},
+		{in: "1\u202f234,5", decimal: ",", want: 1234.5},
+		{in: "1,234.56", decimal: ".", thousands: ",", want: 1234.56},
+		{in: "1.234.567,8", decimal: ",", thousands: ".", want: 1234567.8},
+		{in: "1'234.5", decimal: ".", thousands: "'", want: 1234.5},
+		{in: "-15.5", decimal: ".", want: -15.5},
+		{in: "10.005", decimal: ".", want: 10.01},
+		{in: "", decimal: ".", wantErr: true},
+		{in: "   ", decimal: ".", wantErr: true},
+		{in: "12,5", decimal: ".", wantErr: true},
+		{in: "abc", decimal: ".", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAmount(tt.in, tt.decimal, tt.thousands)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseAmount(%q, %q, %q) = %v, want error", tt.in, tt.decimal, tt.thousands, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseAmount(%q, %q, %q) = %v, %v, want %v", tt.in, tt.decimal, tt.thousands, got, err, tt.want)
+		}
+	}
+}
+
+func TestResolveCSVColumn(t *testing.T) {
+	header := []string{"Дата", " Сумма ", "Description"}
+	tests := []struct {
+		spec     string
+		header   []string
+		required bool
+		want     int
+		wantErr  bool
+	}{
+		{spec: "Сумма", header: header, want: 1},
+		{spec: "description", header: header, want: 2},
+		{spec: " Дата ", header: header, want: 0},
+		{spec: "2", header: header, want: 2},
+		{spec: "7", header: nil, want: 7},
+		{spec: "", header: header, want: -1},
+		{spec: "", header: header, required: true, wantErr: true},
+		{spec: "-1", header: header, wantErr: true},
+		{spec: "Category", header: header, wantErr: true},
+		{spec: "Сумма", header: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := resolveCSVColumn(tt.spec, tt.header, tt.required, "field")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("resolveCSVColumn(%q) = %d, want error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveCSVColumn(%q) = %d, %v, want %d", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func encodeCP1251(t *testing.T, s string) string {
+	t.Helper()
+	encoded, err := charmap.Windows1251.NewEncoder().String(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestParseCSVExpenses(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Vladivostok")
+	if err != nil {
+		t.Skip("time zone database is not available")
+	}
+	noHeader := false
+	byName := CSVColumnMapping{Name: "Название", Amount: "Сумма", Date: "Дата"}
+
+	// Ожидаемая строка импорта; пустой err - строка без ошибки
+	type row struct {
+		line     int
+		name     string
+		amount   float64
+		date     string
+		category int
+		err      string
+	}
+	tests := []struct {
+		name    string
+		input   string
+		opts    CSVImportOptions
+		mapping CSVColumnMapping
+		want    []row
+		wantErr string
+	}{
+		{
+			name:    "semicolon with decimal comma and thousands space",
+			input:   "Дата;Название;Сумма\n2024-01-31;Продукты;1 234,50\n2024-02-01;Кафе;99\n",
+			opts:    CSVImportOptions{Delimiter: ";", DecimalSeparator: ","},
+			mapping: byName,
+			want: []row{
+				{line: 2, name: "Продукты", amount: 1234.5, date: "2024-01-31"},
+				{line: 3, name: "Кафе", amount: 99, date: "2024-02-01"},
+			},
+		},
+		{
+			name:    "cp1251",
+			input:   encodeCP1251(t, "Дата;Название;Сумма\r\n31.01.2024;Аптека;150,00\r\n"),
+			opts:    CSVImportOptions{Delimiter: ";", Encoding: "windows-1251", DecimalSeparator: ",", DateFormat: "02.01.2006"},
+			mapping: byName,
+			want:    []row{{line: 2, name: "Аптека", amount: 150, date: "2024-01-31"}},
+		},
+		{
+			name:    "utf-8 BOM before header",
+			input:   "\xef\xbb\xbfДата,Название,Сумма\n2024-03-01,Такси,300\n",
+			mapping: byName,
+			want:    []row{{line: 2, name: "Такси", amount: 300, date: "2024-03-01"}},
+		},
+		{
+			name:    "tab delimiter with thousands comma",
+			input:   "date\tname\tamount\n2024-01-05\tRent\t\"1,200.00\"\n",
+			opts:    CSVImportOptions{Delimiter: `\t`, ThousandsSeparator: ","},
+			mapping: CSVColumnMapping{Name: "name", Amount: "amount", Date: "date"},
+			want:    []row{{line: 2, name: "Rent", amount: 1200, date: "2024-01-05"}},
+		},
+		{
+			name:    "skip rows before header",
+			input:   "Выписка по счету\nПериод: январь\nДата,Название,Сумма\n2024-01-10,Хлеб,50\n",
+			opts:    CSVImportOptions{SkipRows: 2},
+			mapping: byName,
+			want:    []row{{line: 4, name: "Хлеб", amount: 50, date: "2024-01-10"}},
+		},
+		{
+			name:    "no header, columns by index, category column",
+			input:   "Хлеб,2024-01-10,50,7\nМолоко,2024-01-11,80,\n",
+			opts:    CSVImportOptions{HasHeader: &noHeader, CategoryID: 3},
+			mapping: CSVColumnMapping{Name: "0", Date: "1", Amount: "2", CategoryID: "3"},
+			want: []row{
+				{line: 1, name: "Хлеб", amount: 50, date: "2024-01-10", category: 7},
+				{line: 2, name: "Молоко", amount: 80, date: "2024-01-11", category: 3},
+			},
+		},
+		{
+			name:    "bank statement with negative debits",
+			input:   "Дата,Название,Сумма\n2024-01-10,Магазин,-250.40\n2024-01-11,Зарплата,50000\n",
+			opts:    CSVImportOptions{InvertSign: true},
+			mapping: byName,
+			want: []row{
+				{line: 2, name: "Магазин", amount: 250.4, date: "2024-01-10"},
+				{line: 3, name: "Зарплата", amount: -50000, err: "amount must be positive: -50000.00"},
+			},
+		},
+		{
+			name:    "row errors do not stop the file",
+			input:   "Дата,Название,Сумма,Категория\n2024-01-10,,10,\n2024-01-10,Хлеб,-5,\n31/01/2024,Хлеб,5,\n2024-01-10,Хлеб,5,abc\n\n2024-01-12,Сыр,7,\n",
+			mapping: CSVColumnMapping{Name: "Название", Amount: "Сумма", Date: "Дата", CategoryID: "Категория"},
+			want: []row{
+				{line: 2, err: "name is empty"},
+				{line: 3, name: "Хлеб", amount: -5, err: "amount must be positive: -5.00"},
+				{line: 4, name: "Хлеб", amount: 5, err: "invalid date: 31/01/2024"},
+				{line: 5, name: "Хлеб", amount: 5, date: "2024-01-10", err: "invalid categoryId: abc"},
+				{line: 6, name: "Сыр", amount: 7, date: "2024-01-12"},
+			},
+		},
+		{
+			name:    "multi-character delimiter",
+			input:   "a,b\n",
+			opts:    CSVImportOptions{Delimiter: ";;"},
+			mapping: byName,
+			wantErr: "delimiter must be a single character",
+		},
+		{
+			name:    "unknown encoding",
+			input:   "a,b\n",
+			opts:    CSVImportOptions{Encoding: "koi8-r"},
+			mapping: byName,
+			wantErr: "unsupported encoding",
+		},
+		{
+			name:    "required mapping missing",
+			input:   "Дата,Название,Сумма\n",
+			mapping: CSVColumnMapping{Name: "Название", Date: "Дата"},
+			wantErr: "mapping for amount is required",
+		},
+		{
+			name:    "mapped column absent from header",
+			input:   "Дата,Название,Сумма\n",
+			mapping: CSVColumnMapping{Name: "Название", Amount: "Amount", Date: "Дата"},
+			wantErr: `column "Amount" for amount not found in header`,
+		},
+		{
+			name:    "skip rows past the end",
+			input:   "Дата,Название,Сумма\n",
+			opts:    CSVImportOptions{SkipRows: 3},
+			mapping: byName,
+			wantErr: "skipping rows",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseCSVExpenses(strings.NewReader(tt.input), tt.opts, tt.mapping, loc)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCSVExpenses: %v", err)
+			}
+			if len(rows) != len(tt.want) {
+				t.Fatalf("got %d rows, want %d: %+v", len(rows), len(tt.want), rows)
+			}
+			for i, want := range tt.want {
+				got := rows[i]
+				if got.Line != want.line || got.Type != importTypeExpense || got.Error != want.err {
+					t.Errorf("row %d: line %d, type %q, error %q; want line %d, error %q", i, got.Line, got.Type, got.Error, want.line, want.err)
+				}
+				exp := got.Expense
+				if exp == nil {
+					t.Errorf("row %d: no expense", i)
+					continue
+				}
+				if exp.Name != want.name || exp.Amount != want.amount || exp.CategoryID != want.category {
+					t.Errorf("row %d: %q %.2f category %d, want %q %.2f category %d", i, exp.Name, exp.Amount, exp.CategoryID, want.name, want.amount, want.category)
+				}
+				if want.date != "" {
+					// Дата без времени - полночь в часовом поясе домохозяйства
+					wantDate, _ := time.ParseInLocation("2006-01-02", want.date, loc)
+					if !exp.Date.Equal(wantDate) {
+						t.Errorf("row %d: date %v, want %v", i, exp.Date, wantDate)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Источник записей, загруженных из OFX/QFX
+const ofxSource = "ofx"
+
+type OFXImportOptions struct {
+	CategoryID int  `form:"categoryId"`
+	DryRun     bool `form:"dryRun"`
+}
+
+// Кодировка в заголовке OFX 1.x (CHARSET:1251) или в XML-декларации OFX 2.x
+var ofxCharsetPattern = regexp.MustCompile(`(?i)(?:CHARSET:\s*|encoding=["'])(?:windows-|cp)?1251`)
+
+// Разбор даты OFX: YYYYMMDD[HHMMSS[.XXX]][[+-]HH[:TZ]]. Без смещения - время в часовом поясе loc.
+func parseOFXDate(s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+
+	// Явное смещение часового пояса, например [-5:EST] или [+3:MSK]
+	if i := strings.Index(s, "["); i >= 0 {
+		tz := strings.TrimSuffix(s[i+1:], "]")
+		s = s[:i]
+		offset := tz
+		if j := strings.Index(tz, ":"); j >= 0 {
+			offset = tz[:j]
+		}
+		hours, err := strconv.ParseFloat(offset, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timezone: %s", tz)
+		}
+		loc = time.FixedZone(tz, int(hours*3600))
+	}
+
+	if i := strings.Index(s, "."); i >= 0 {
+		s = s[:i]
+	}
+
+	var layout string
+	switch len(s) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid date: %s", s)
+	}
+
+	return time.ParseInLocation(layout, s, loc)
+}
+
+// Преобразует поля STMTTRN в строку импорта: списания становятся расходами, поступления - доходами
+func ofxTransactionRow(line int, account string, fields map[string]string, categoryID int, loc *time.Location) ImportRow {
+	row := ImportRow{Line: line, Type: importTypeExpense}
+
+	amount, err := strconv.ParseFloat(strings.ReplaceAll(fields["TRNAMT"], ",", "."), 64)
+	if err != nil {
+		row.Error = fmt.Sprintf("invalid amount: %s", fields["TRNAMT"])
+		return row
+	}
+	if amount == 0 {
+		row.Error = "amount is zero"
+		return row
+	}
+
+	date, err := parseOFXDate(fields["DTPOSTED"], loc)
+	if err != nil {
+		row.Error = err.Error()
+		return row
+	}
+
+	name := fields["NAME"]
+	description := fields["MEMO"]
+	if name == "" {
+		name, description = description, ""
+	}
+	if name == "" {
+		name = fields["TRNTYPE"]
+	}
+
+	// FITID уникален только в пределах счета
+	if fitID := fields["FITID"]; fitID != "" {
+		row.ExternalID = fitID
+		if account != "" {
+			row.ExternalID = account + ":" + fitID
+		}
+	}
+
+	amount = math.Round(math.Abs(amount)*100) / 100
+	if strings.HasPrefix(strings.TrimSpace(fields["TRNAMT"]), "-") {
+		row.Expense = &Expense{
+			CategoryID:  categoryID,
+			Name:        name,
+			Amount:      amount,
+			Date:        date,
+			Description: description,
+		}
+	} else {
+		row.Type = importTypeIncome
+		row.Income = &Income{
+			Name:        name,
+			Amount:      amount,
+			Date:        date,
+			Description: description,
+		}
+	}
+
+	return row
+}
+
+// Разбор выписки OFX 1.x (SGML) и 2.x (XML).
+// В SGML листовые элементы не закрываются, поэтому значение тега - текст до следующего '<'.
+func parseOFX(r io.Reader, categoryID int, loc *time.Location) ([]ImportRow, error) {
+	raw, err := readImportFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	header := raw
+	if len(header) > 512 {
+		header = header[:512]
+	}
+	encoding := ""
+	if ofxCharsetPattern.Match(header) {
+		encoding = "windows-1251"
+	}
+	reader, err := decodeReader(bytes.NewReader(raw), encoding)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	data := string(decoded)
+
+	if !strings.Contains(strings.ToUpper(data), "<OFX>") {
+		return nil, errors.New("not an OFX document")
+	}
+
+	var rows []ImportRow
+	var account string
+	var fields map[string]string
+	lastTag := ""
+	txnCount := 0
+
+	for pos := 0; pos < len(data); {
+		lt := strings.IndexByte(data[pos:], '<')
+		if lt < 0 {
+			break
+		}
+		lt += pos
+
+		if text := strings.TrimSpace(data[pos:lt]); text != "" && lastTag != "" {
+			value := html.UnescapeString(text)
+			switch {
+			case fields != nil:
+				// NAME может встречаться и внутри агрегата PAYEE; первое значение главнее
+				if _, ok := fields[lastTag]; !ok {
+					fields[lastTag] = value
+				}
+			case lastTag == "ACCTID":
+				account = value
+			}
+		}
+
+		gt := strings.IndexByte(data[lt:], '>')
+		if gt < 0 {
+			break
+		}
+		gt += lt
+		tag := strings.ToUpper(strings.TrimSpace(data[lt+1 : gt]))
+		pos = gt + 1
+
+		switch {
+		case strings.HasPrefix(tag, "?"), strings.HasPrefix(tag, "!"):
+			lastTag = ""
+		case tag == "/STMTTRN":
+			if fields != nil {
+				txnCount++
+				rows = append(rows, ofxTransactionRow(txnCount, account, fields, categoryID, loc))
+				fields = nil
+			}
+			lastTag = ""
+		case strings.HasPrefix(tag, "/"):
+			lastTag = ""
+		case tag == "STMTTRN":
+			fields = make(map[string]string)
+			lastTag = ""
+		default:
+			lastTag = tag
+		}
+	}
+
+	return rows, nil
+}
+
+func importOFX(c *gin.Context) {
+	var opts OFXImportOptions
+	if err := c.ShouldBind(&opts); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, "OFX file is required")
+		return
+	}
+	if fileHeader.Size > maxImportFileSize {
+		respondWithError(c, http.StatusRequestEntityTooLarge, "OFX file is too large")
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	// Даты без времени и без смещения относятся к часовому поясу домохозяйства
+	loc, err := householdLocation(ctx, db, currentHouseholdID(c))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rows, err := parseOFX(file, opts.CategoryID, loc)
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := runImport(ctx, auditActorFrom(c), ofxSource, rows, opts.DryRun)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithImportResult(c, result)
+}
+
+// Подкоманда: expense-tracker import-ofx -user NAME [-category ID] [-dry-run] file.ofx...
+func runImportOFXCommand(args []string) error {
+	fs := flag.NewFlagSet("import-ofx", flag.ExitOnError)
+	username := fs.String("user", "", "user whose default household receives the records")
+	categoryID := fs.Int("category", 0, "target category ID for expenses")
+	dryRun := fs.Bool("dry-run", false, "parse and validate without saving")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: import-ofx -user NAME [-category ID] [-dry-run] file.ofx...")
+	}
+
+	lookupCtx, lookupCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	actor, err := lookupAuditActor(lookupCtx, *username)
+	var loc *time.Location
+	if err == nil {
+		loc, err = householdLocation(lookupCtx, db, actor.HouseholdID)
+	}
+	lookupCancel()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range fs.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		rows, err := parseOFX(file, *categoryID, loc)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		result, err := runImport(ctx, actor, ofxSource, rows, *dryRun)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		printImportResult(path, result)
+	}
+
+	return nil
+}
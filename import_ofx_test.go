@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOFXDate(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Vladivostok")
+	if err != nil {
+		t.Skip("time zone database is not available")
+	}
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "20240131", want: time.Date(2024, time.January, 31, 0, 0, 0, 0, loc)},
+		{in: " 202401311530 ", want: time.Date(2024, time.January, 31, 15, 30, 0, 0, loc)},
+		{in: "20240131153045", want: time.Date(2024, time.January, 31, 15, 30, 45, 0, loc)},
+		{in: "20240131153045.123", want: time.Date(2024, time.January, 31, 15, 30, 45, 0, loc)},
+		// Явное смещение главнее часового пояса домохозяйства
+		{in: "20240131120000.000[-5:EST]", want: time.Date(2024, time.January, 31, 17, 0, 0, 0, time.UTC)},
+		{in: "20240131120000[+3:MSK]", want: time.Date(2024, time.January, 31, 9, 0, 0, 0, time.UTC)},
+		{in: "20240131[0:GMT]", want: time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC)},
+		{in: "20240131120000[+5.5]", want: time.Date(2024, time.January, 31, 6, 30, 0, 0, time.UTC)},
+		{in: "20240131120000[-3.5:NST]", want: time.Date(2024, time.January, 31, 15, 30, 0, 0, time.UTC)},
+		{in: "", wantErr: true},
+		{in: "202401", wantErr: true},
+		{in: "2024013112", wantErr: true},
+		{in: "20241331", wantErr: true},
+		{in: "20240131[EST]", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseOFXDate(tt.in, loc)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseOFXDate(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseOFXDate(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// Выписка OFX 1.x: SGML-заголовок, незакрытые листовые теги, кодировка 1251
+const ofxSGMLFixture = `OFXHEADER:100
+DATA:OFXSGML
+VERSION:102
+SECURITY:NONE
+ENCODING:USASCII
+CHARSET:1251
+COMPRESSION:NONE
+OLDFILEUID:NONE
+NEWFILEUID:NONE
+
+<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0<SEVERITY>INFO</STATUS><DTSERVER>20240201120000<LANGUAGE>RUS</SONRS></SIGNONMSGSRSV1>
+<BANKMSGSRSV1>
+<STMTTRNRS>
+<STMTRS>
+<CURDEF>RUB
+<BANKACCTFROM><BANKID>044525225<ACCTID>40817810000000000001<ACCTTYPE>CHECKING</BANKACCTFROM>
+<BANKTRANLIST>
+<DTSTART>20240101<DTEND>20240131
+<STMTTRN>
+<TRNTYPE>DEBIT
+<DTPOSTED>20240115
+<TRNAMT>-1234,50
+<FITID>1001
+<NAME>Пятёрочка
+<MEMO>Покупка по карте
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>CREDIT
+<DTPOSTED>20240120120000[+3:MSK]
+<TRNAMT>50000.00
+<FITID>1002
+<MEMO>Зарплата за январь
+</STMTTRN>
+</BANKTRANLIST>
+</STMTRS>
+</STMTTRNRS>
+<STMTTRNRS>
+<STMTRS>
+<BANKACCTFROM><BANKID>044525225<ACCTID>40817810000000000002<ACCTTYPE>SAVINGS</BANKACCTFROM>
+<BANKTRANLIST>
+<STMTTRN>
+<TRNTYPE>FEE
+<DTPOSTED>20240131
+<TRNAMT>-99
+<FITID>1001
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>DEBIT
+<DTPOSTED>2024-01-31
+<TRNAMT>-10
+<FITID>1003
+</STMTTRN>
+</BANKTRANLIST>
+</STMTRS>
+</STMTTRNRS>
+</BANKMSGSRSV1>
+</OFX>
+`
+
+// Выписка OFX 2.x: XML с закрытыми тегами, сущностями и агрегатом PAYEE
+const ofxXMLFixture = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<?OFX OFXHEADER="200" VERSION="211" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+  <CREDITCARDMSGSRSV1>
+    <CCSTMTTRNRS>
+      <CCSTMTRS>
+        <CURDEF>USD</CURDEF>
+        <CCACCTFROM><ACCTID>4111-XXXX</ACCTID></CCACCTFROM>
+        <BANKTRANLIST>
+          <STMTTRN>
+            <TRNTYPE>DEBIT</TRNTYPE>
+            <DTPOSTED>20240305220000.000[-5:EST]</DTPOSTED>
+            <TRNAMT>-42.10</TRNAMT>
+            <FITID>A-1</FITID>
+            <NAME>Tom &amp; Jerry&apos;s</NAME>
+            <PAYEE><NAME>Ignored payee name</NAME></PAYEE>
+            <MEMO>Dinner</MEMO>
+          </STMTTRN>
+          <STMTTRN>
+            <TRNTYPE>DEBIT</TRNTYPE>
+            <DTPOSTED>20240306</DTPOSTED>
+            <TRNAMT>0.00</TRNAMT>
+            <FITID>A-2</FITID>
+            <NAME>Authorization hold</NAME>
+          </STMTTRN>
+        </BANKTRANLIST>
+      </CCSTMTRS>
+    </CCSTMTTRNRS>
+  </CREDITCARDMSGSRSV1>
+</OFX>
+`
+
+func TestParseOFX(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Vladivostok")
+	if err != nil {
+		t.Skip("time zone database is not available")
+	}
+
+	type row struct {
+		typ, externalID, name, description string
+		amount                             float64
+		date                               time.Time
+		err                                string
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  []row
+	}{
+		{
+			name:  "SGML 1.x in windows-1251",
+			input: encodeCP1251(t, ofxSGMLFixture),
+			want: []row{
+				{typ: importTypeExpense, externalID: "40817810000000000001:1001", name: "Пятёрочка", description: "Покупка по карте", amount: 1234.5,
+					date: time.Date(2024, time.January, 15, 0, 0, 0, 0, loc)},
+				{typ: importTypeIncome, externalID: "40817810000000000001:1002", name: "Зарплата за январь", amount: 50000,
+					date: time.Date(2024, time.January, 20, 9, 0, 0, 0, time.UTC)},
+				// Тот же FITID на другом счете - другая операция
+				{typ: importTypeExpense, externalID: "40817810000000000002:1001", name: "FEE", amount: 99,
+					date: time.Date(2024, time.January, 31, 0, 0, 0, 0, loc)},
+				{typ: importTypeExpense, err: "invalid date: 2024-01-31"},
+			},
+		},
+		{
+			name:  "XML 2.x",
+			input: ofxXMLFixture,
+			want: []row{
+				{typ: importTypeExpense, externalID: "4111-XXXX:A-1", name: "Tom & Jerry's", description: "Dinner", amount: 42.1,
+					date: time.Date(2024, time.March, 6, 3, 0, 0, 0, time.UTC)},
+				{typ: importTypeExpense, err: "amount is zero"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseOFX(strings.NewReader(tt.input), 7, loc)
+			if err != nil {
+				t.Fatalf("parseOFX: %v", err)
+			}
+			if len(rows) != len(tt.want) {
+				t.Fatalf("got %d rows, want %d: %+v", len(rows), len(tt.want), rows)
+			}
+			for i, want := range tt.want {
+				got := rows[i]
+				if got.Line != i+1 || got.Type != want.typ || got.Error != want.err {
+					t.Errorf("row %d: line %d, type %q, error %q; want line %d, type %q, error %q", i, got.Line, got.Type, got.Error, i+1, want.typ, want.err)
+					continue
+				}
+				if want.err != "" {
+					continue
+				}
+				if got.ExternalID != want.externalID {
+					t.Errorf("row %d: external ID %q, want %q", i, got.ExternalID, want.externalID)
+				}
+
+				var name, description string
+				var amount float64
+				var date time.Time
+				switch {
+				case got.Expense != nil && got.Income == nil:
+					if got.Expense.CategoryID != 7 {
+						t.Errorf("row %d: category %d, want 7", i, got.Expense.CategoryID)
+					}
+					name, description, amount, date = got.Expense.Name, got.Expense.Description, got.Expense.Amount, got.Expense.Date
+				case got.Income != nil && got.Expense == nil:
+					name, description, amount, date = got.Income.Name, got.Income.Description, got.Income.Amount, got.Income.Date
+				default:
+					t.Fatalf("row %d: expense %v, income %v", i, got.Expense, got.Income)
+				}
+				if name != want.name || description != want.description || amount != want.amount || !date.Equal(want.date) {
+					t.Errorf("row %d: %q %q %.2f %v, want %q %q %.2f %v", i, name, description, amount, date, want.name, want.description, want.amount, want.date)
+				}
+			}
+		})
+	}
+}
+
+func TestParseOFXRejects(t *testing.T) {
+	if _, err := parseOFX(strings.NewReader("Date,Name,Amount\n2024-01-01,Bread,10\n"), 0, time.UTC); err == nil {
+		t.Error("CSV file was accepted as OFX")
+	}
+
+	// Файл больше лимита не обрезается, а отклоняется
+	big := append([]byte("<OFX>"), bytes.Repeat([]byte(" "), maxImportFileSize)...)
+	if _, err := parseOFX(bytes.NewReader(big), 0, time.UTC); err != errImportFileTooLarge {
+		t.Errorf("file over the limit: error = %v, want %v", err, errImportFileTooLarge)
+	}
+	rows, err := parseOFX(bytes.NewReader(big[:maxImportFileSize]), 0, time.UTC)
+	if err != nil || len(rows) != 0 {
+		t.Errorf("file at the limit: %d rows, error %v", len(rows), err)
+	}
+}
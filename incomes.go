@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getIncomes(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT id, name, amount, date, description FROM incomes WHERE household_id = $1 ORDER BY date", currentHouseholdID(c))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	incomes := []Income{}
+	for rows.Next() {
+		var inc Income
+		err := rows.Scan(&inc.ID, &inc.Name, &inc.Amount, &inc.Date, &inc.Description)
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		incomes = append(incomes, inc)
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data:   incomes,
+	})
+}
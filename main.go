@@ -8,6 +8,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -23,6 +26,9 @@ type Category struct {
 	TotalAmount  float64            `json:"totalAmount"`
 	Expenses     []Expense          `json:"expenses,omitempty"`
 	MonthlyStats map[string]float64 `json:"monthlyStats"`
+	// Версия строки для If-Match; растет при каждом изменении категории,
+	// пересчет monthlyStats ее не меняет
+	Version int `json:"version,omitempty"`
 }
 
 type Expense struct {
@@ -32,6 +38,16 @@ type Expense struct {
 	Amount      float64   `json:"amount"`
 	Date        time.Time `json:"date"`
 	Description string    `json:"description"`
+	Tags        []string  `json:"tags,omitempty"`
+	Version     int       `json:"version,omitempty"`
+}
+
+type Income struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Amount      float64   `json:"amount"`
+	Date        time.Time `json:"date"`
+	Description string    `json:"description"`
 }
 
 type Response struct {
@@ -58,41 +74,160 @@ func main() {
 	// Инициализация базы данных
 	initDB()
 
+	// Отправка писем пользователям
+	notifier = newNotifierFromEnv()
+
+	// Подкоманды командной строки выполняются вместо запуска сервера
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	// Без секрета подписи токенов API недоступен
+	if _, err := jwtSecret(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	// Вход через OpenID Connect включается переменными OIDC_*
+	oidcCfg, err := oidcConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if oidcCfg != nil {
+		oidc = newOIDCProvider(*oidcCfg, nil)
+		log.Printf("Single sign-on enabled for issuer %s", oidcCfg.Issuer)
+	}
+
 	// Инициализация подготовленных запросов
 	initPreparedStatements()
 	defer closePreparedStatements()
 
+	// Обучение классификатора категорий на истории расходов
+	trainCtx, trainCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := trainClassifier(trainCtx); err != nil {
+		log.Printf("Error training category classifier: %v", err)
+	}
+	trainCancel()
+
+	// Старые записи из корзины удаляются окончательно
+	startTrashPurger()
+	// Истекшие ключи идемпотентности тоже
+	startIdempotencyPurger()
+
 	// Инициализация HTTP сервера
 	router := gin.Default()
+	router.Use(requestIDMiddleware())
 
 	// Настройка CORS
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
-		AllowHeaders:     []string{"Origin", "Content-Type"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-Household-ID", "X-Request-ID", "If-Match", "Idempotency-Key"},
+		ExposeHeaders:    []string{"Content-Length", "X-Request-ID", "ETag", "Idempotent-Replayed"},
 		AllowCredentials: true,
 	}))
 
+	// Регистрация и вход не требуют токена
+	auth := router.Group("/api/auth")
+	{
+		auth.POST("/register", register)
+		auth.POST("/login", login)
+		auth.POST("/verify-email", verifyEmail)
+		auth.POST("/verify-email/resend", resendVerification)
+		auth.POST("/password-reset", requestPasswordReset)
+		auth.POST("/password-reset/confirm", resetPassword)
+		auth.GET("/oidc/login", oidcLogin)
+		auth.GET("/oidc/callback", oidcCallback)
+	}
+
 	// API маршруты
 	api := router.Group("/api")
+	// Ключ идемпотентности проверяется после входа: ключи привязаны к пользователю
+	api.Use(authMiddleware(), idempotencyMiddleware())
 	{
+		// Каждый маршрут требует право токена и роль в выбранном домохозяйстве
+		read := requireAccess(scopeExpensesRead, roleViewer)
+		write := requireAccess(scopeExpensesWrite, roleEditor)
+		stats := requireAccess(scopeStatsRead, roleViewer)
+		// Восстановление добавляет записи архива к данным домохозяйства; доступно только владельцу
+		restore := requireAccess(scopeExpensesWrite, roleOwner)
+
 		// Категории
-		api.GET("/categories", getCategories)
-		api.GET("/categories/:id", getCategory)
-		api.POST("/categories", createCategory)
-		api.PUT("/categories/:id", updateCategory)
-		api.DELETE("/categories/:id", deleteCategory)
+		api.GET("/categories", read, getCategories)
+		api.GET("/categories/:id", read, getCategory)
+		api.POST("/categories", write, createCategory)
+		api.PUT("/categories/:id", write, updateCategory)
+		api.DELETE("/categories/:id", write, deleteCategory)
+		api.POST("/categories/merge", write, mergeCategories)
 
 		// Расходы
-		api.GET("/expenses", getExpenses)
-		api.GET("/expenses/:id", getExpense)
-		api.POST("/expenses", createExpense)
-		api.PUT("/expenses/:id", updateExpense)
-		api.DELETE("/expenses/:id", deleteExpense)
+		api.GET("/expenses", read, getExpenses)
+		api.GET("/expenses/:id", read, getExpense)
+		api.POST("/expenses", write, createExpense)
+		api.PUT("/expenses/:id", write, updateExpense)
+		api.DELETE("/expenses/:id", write, deleteExpense)
+		api.POST("/expenses/receipt", write, createExpenseFromReceipt)
+		api.POST("/expenses/suggest-category", read, suggestCategory)
+		api.GET("/expenses/duplicates", read, getDuplicateExpenses)
+		api.POST("/expenses/merge", write, mergeExpenses)
+		api.POST("/expenses/batch", write, batchExpenses)
+
+		// Правила автокатегоризации
+		api.GET("/rules", read, getRules)
+		api.POST("/rules", write, createRule)
+		api.PUT("/rules/:id", write, updateRule)
+		api.DELETE("/rules/:id", write, deleteRule)
+		api.POST("/rules/apply", write, applyRulesRetroactively)
+
+		// Поступления
+		api.GET("/incomes", read, getIncomes)
 
 		// Статистика
-		api.GET("/statistics", getStatistics)
+		api.GET("/statistics", stats, getStatistics)
+		api.GET("/statistics/compare", stats, compareStatistics)
+
+		// Импорт
+		api.POST("/import/csv", write, importCSV)
+		api.POST("/import/ofx", write, importOFX)
+		api.POST("/import/1c", write, importClientBank)
+
+		// Экспорт
+		api.GET("/export/expenses.csv", read, exportExpensesCSV)
+		api.GET("/export/expenses.xlsx", read, exportExpensesXLSX)
+		api.GET("/export/statistics.xlsx", stats, exportStatisticsXLSX)
+
+		// Резервное копирование
+		api.GET("/backup", read, getBackup)
+		api.POST("/restore", restore, restoreFromBackup)
+
+		// Корзина
+		api.GET("/trash", read, getTrash)
+		api.POST("/trash/expenses/:id/restore", write, restoreExpense)
+		api.POST("/trash/categories/:id/restore", write, restoreCategory)
+
+		// Журнал изменений
+		api.GET("/audit", requireAccess(scopeExpensesRead, roleOwner), getAuditLog)
+
+		// Персональные токены доступа
+		api.GET("/tokens", requireSession(), getAPITokens)
+		api.POST("/tokens", requireSession(), createAPIToken)
+		api.DELETE("/tokens/:id", requireSession(), revokeAPIToken)
+
+		// Домохозяйства и приглашения
+		api.GET("/households", requireSession(), getHouseholds)
+		api.POST("/households", requireSession(), createHousehold)
+		api.PUT("/households/:id/default", requireSession(), setDefaultHousehold)
+		api.GET("/households/:id/settings", requireSession(), getHouseholdSettings)
+		api.PUT("/households/:id/settings", requireSession(), updateHouseholdSettings)
+		api.GET("/households/:id/members", requireSession(), getHouseholdMembers)
+		api.PUT("/households/:id/members/:userId", requireSession(), updateHouseholdMember)
+		api.DELETE("/households/:id/members/:userId", requireSession(), removeHouseholdMember)
+		api.GET("/households/:id/invitations", requireSession(), getInvitations)
+		api.POST("/households/:id/invitations", requireSession(), createInvitation)
+		api.DELETE("/households/:id/invitations/:invitationId", requireSession(), revokeInvitation)
+		api.POST("/invitations/accept", requireSession(), acceptInvitation)
 	}
 
 	// Статический файловый сервер для React-приложения
@@ -164,9 +299,239 @@ func initDB() {
         category_id INTEGER REFERENCES categories(id) ON DELETE CASCADE,
         name TEXT NOT NULL,
         amount DECIMAL(10,2) NOT NULL,
-        date TIMESTAMP,
+        date TIMESTAMPTZ,
         description TEXT
     );
+
+    -- Источник расхода (например, фискальный чек) и его внешний идентификатор
+    ALTER TABLE expenses ADD COLUMN IF NOT EXISTS source TEXT;
+    ALTER TABLE expenses ADD COLUMN IF NOT EXISTS external_id TEXT;
+    CREATE UNIQUE INDEX IF NOT EXISTS expenses_source_external_id_idx
+        ON expenses (source, external_id) WHERE external_id IS NOT NULL;
+
+    -- Поступления из банковских выписок
+    CREATE TABLE IF NOT EXISTS incomes (
+        id SERIAL PRIMARY KEY,
+        name TEXT NOT NULL,
+        amount DECIMAL(10,2) NOT NULL,
+        date TIMESTAMPTZ,
+        description TEXT,
+        source TEXT,
+        external_id TEXT
+    );
+    CREATE UNIQUE INDEX IF NOT EXISTS incomes_source_external_id_idx
+        ON incomes (source, external_id) WHERE external_id IS NOT NULL;
+
+    ALTER TABLE expenses ADD COLUMN IF NOT EXISTS tags JSONB;
+
+    -- Правила автокатегоризации: все заданные условия должны выполняться одновременно
+    CREATE TABLE IF NOT EXISTS category_rules (
+        id SERIAL PRIMARY KEY,
+        name TEXT NOT NULL,
+        priority INTEGER NOT NULL DEFAULT 0,
+        name_contains TEXT,
+        description_contains TEXT,
+        pattern TEXT,
+        min_amount DECIMAL(10,2),
+        max_amount DECIMAL(10,2),
+        payee TEXT,
+        category_id INTEGER REFERENCES categories(id) ON DELETE CASCADE,
+        tags JSONB,
+        enabled BOOLEAN NOT NULL DEFAULT TRUE
+    );
+
+    -- Пользователи
+    CREATE TABLE IF NOT EXISTS users (
+        id SERIAL PRIMARY KEY,
+        username TEXT NOT NULL UNIQUE,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+    );
+
+    -- Домохозяйства: данные принадлежат домохозяйству, пользователи входят в него с ролью
+    CREATE TABLE IF NOT EXISTS households (
+        id SERIAL PRIMARY KEY,
+        name TEXT NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+    );
+
+    CREATE TABLE IF NOT EXISTS household_members (
+        household_id INTEGER NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+        joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+        PRIMARY KEY (household_id, user_id)
+    );
+    CREATE INDEX IF NOT EXISTS household_members_user_id_idx ON household_members (user_id);
+
+    -- Приглашения по email; хранится только хэш токена из ссылки
+    CREATE TABLE IF NOT EXISTS household_invitations (
+        id SERIAL PRIMARY KEY,
+        household_id INTEGER NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+        email TEXT NOT NULL,
+        role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+        token_hash TEXT NOT NULL UNIQUE,
+        invited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+        expires_at TIMESTAMPTZ NOT NULL,
+        accepted_at TIMESTAMPTZ,
+        accepted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        revoked_at TIMESTAMPTZ
+    );
+
+    -- Домохозяйство, с которым пользователь работает, если не указано другое
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS default_household_id INTEGER REFERENCES households(id) ON DELETE SET NULL;
+
+    ALTER TABLE categories ADD COLUMN IF NOT EXISTS household_id INTEGER REFERENCES households(id) ON DELETE CASCADE;
+    ALTER TABLE expenses ADD COLUMN IF NOT EXISTS household_id INTEGER REFERENCES households(id) ON DELETE CASCADE;
+    ALTER TABLE incomes ADD COLUMN IF NOT EXISTS household_id INTEGER REFERENCES households(id) ON DELETE CASCADE;
+    ALTER TABLE category_rules ADD COLUMN IF NOT EXISTS household_id INTEGER REFERENCES households(id) ON DELETE CASCADE;
+    CREATE INDEX IF NOT EXISTS categories_household_id_idx ON categories (household_id);
+    CREATE INDEX IF NOT EXISTS expenses_household_id_idx ON expenses (household_id);
+    CREATE INDEX IF NOT EXISTS incomes_household_id_idx ON incomes (household_id);
+    CREATE INDEX IF NOT EXISTS category_rules_household_id_idx ON category_rules (household_id);
+    -- Столбцы user_id промежуточной схемы не выпускались: удаляются без переноса данных
+    ALTER TABLE categories DROP COLUMN IF EXISTS user_id;
+    ALTER TABLE expenses DROP COLUMN IF EXISTS user_id;
+    ALTER TABLE incomes DROP COLUMN IF EXISTS user_id;
+    ALTER TABLE category_rules DROP COLUMN IF EXISTS user_id;
+
+    -- Внешние идентификаторы уникальны в пределах домохозяйства
+    DROP INDEX IF EXISTS expenses_source_external_id_idx;
+    DROP INDEX IF EXISTS incomes_source_external_id_idx;
+    CREATE UNIQUE INDEX IF NOT EXISTS expenses_household_source_external_id_idx
+        ON expenses (household_id, source, external_id) WHERE external_id IS NOT NULL;
+    CREATE UNIQUE INDEX IF NOT EXISTS incomes_household_source_external_id_idx
+        ON incomes (household_id, source, external_id) WHERE external_id IS NOT NULL;
+
+    -- Локальные учетные записи: пароль, подтверждение адреса, блокировка после неудачных входов
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash TEXT;
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_logins INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ;
+    -- Токены, выпущенные до смены пароля, перестают действовать
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMPTZ;
+    CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (lower(email));
+
+    -- Одноразовые токены из писем; хранится только хэш
+    CREATE TABLE IF NOT EXISTS auth_tokens (
+        id SERIAL PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        purpose TEXT NOT NULL,
+        token_hash TEXT NOT NULL UNIQUE,
+        expires_at TIMESTAMPTZ NOT NULL,
+        used_at TIMESTAMPTZ
+    );
+
+    -- Персональные токены для скриптов и интеграций
+    CREATE TABLE IF NOT EXISTS api_tokens (
+        id SERIAL PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        prefix TEXT NOT NULL,
+        token_hash TEXT NOT NULL UNIQUE,
+        scopes JSONB NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+        expires_at TIMESTAMPTZ,
+        last_used_at TIMESTAMPTZ,
+        revoked_at TIMESTAMPTZ
+    );
+
+    -- Вход через OpenID Connect: привязка учетных записей провайдера и незавершенные входы
+    CREATE TABLE IF NOT EXISTS user_identities (
+        issuer TEXT NOT NULL,
+        subject TEXT NOT NULL,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+        PRIMARY KEY (issuer, subject)
+    );
+
+    CREATE TABLE IF NOT EXISTS oidc_login_states (
+        state_hash TEXT PRIMARY KEY,
+        code_verifier TEXT NOT NULL,
+        nonce TEXT NOT NULL,
+        expires_at TIMESTAMPTZ NOT NULL
+    );
+
+    -- Домохозяйства, созданные по группам провайдера
+    ALTER TABLE households ADD COLUMN IF NOT EXISTS external_id TEXT;
+    CREATE UNIQUE INDEX IF NOT EXISTS households_external_id_idx ON households (external_id);
+
+    -- Журнал изменений категорий и расходов: кто, когда, в каком запросе и что было до и после
+    CREATE TABLE IF NOT EXISTS audit_log (
+        id BIGSERIAL PRIMARY KEY,
+        household_id INTEGER NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+        actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        action TEXT NOT NULL,
+        entity TEXT NOT NULL,
+        entity_id INTEGER NOT NULL,
+        request_id TEXT,
+        before JSONB,
+        after JSONB,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+    );
+    CREATE INDEX IF NOT EXISTS audit_log_household_created_idx ON audit_log (household_id, created_at);
+    CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (household_id, entity, entity_id);
+
+    -- Корзина: удаленные категории и расходы помечаются и окончательно удаляются после срока хранения
+    ALTER TABLE categories ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+    ALTER TABLE expenses ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+    CREATE INDEX IF NOT EXISTS categories_deleted_at_idx ON categories (deleted_at) WHERE deleted_at IS NOT NULL;
+    CREATE INDEX IF NOT EXISTS expenses_deleted_at_idx ON expenses (deleted_at) WHERE deleted_at IS NOT NULL;
+
+    -- Версии строк для оптимистичной блокировки (ETag / If-Match)
+    ALTER TABLE categories ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE expenses ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+
+    -- Ключи идемпотентности POST-запросов и сохраненные ответы; user_id = 0 для запросов без входа
+    CREATE TABLE IF NOT EXISTS idempotency_keys (
+        user_id INTEGER NOT NULL,
+        key VARCHAR(255) NOT NULL,
+        fingerprint VARCHAR(64) NOT NULL,
+        status INTEGER,
+        headers JSONB,
+        body BYTEA,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+        PRIMARY KEY (user_id, key)
+    );
+    CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
+    -- Ответы входа без пользователя хранить нельзя: в них токены
+    DELETE FROM idempotency_keys WHERE user_id = 0;
+
+    -- Часовой пояс домохозяйства (IANA), в нем считается статистика
+    ALTER TABLE households ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT 'UTC';
+
+    -- Границы финансовых периодов: день начала месяца, день начала недели (1 - понедельник) и месяц начала года
+    ALTER TABLE households ADD COLUMN IF NOT EXISTS month_start_day INTEGER NOT NULL DEFAULT 1 CHECK (month_start_day BETWEEN 1 AND 28);
+    ALTER TABLE households ADD COLUMN IF NOT EXISTS week_start_day INTEGER NOT NULL DEFAULT 1 CHECK (week_start_day BETWEEN 1 AND 7);
+    ALTER TABLE households ADD COLUMN IF NOT EXISTS fiscal_year_start_month INTEGER NOT NULL DEFAULT 1 CHECK (fiscal_year_start_month BETWEEN 1 AND 12);
+
+    -- Служебные отметки времени - моменты с часовым поясом. Старые значения без пояса записывались
+    -- NOW() в часовом поясе сессии, поэтому переводятся обычным приведением. Даты расходов
+    -- и поступлений переводит migrateLegacyDates.
+    -- Переводятся только перечисленные столбцы приложения, чужие таблицы схемы не затрагиваются.
+    DO $$
+    DECLARE
+        col RECORD;
+    BEGIN
+        FOR col IN SELECT c.table_name, c.column_name FROM information_schema.columns c
+            JOIN (VALUES
+                ('users', 'created_at'), ('users', 'locked_until'), ('users', 'password_changed_at'),
+                ('households', 'created_at'), ('household_members', 'joined_at'),
+                ('household_invitations', 'created_at'), ('household_invitations', 'expires_at'),
+                ('household_invitations', 'accepted_at'), ('household_invitations', 'revoked_at'),
+                ('auth_tokens', 'expires_at'), ('auth_tokens', 'used_at'),
+                ('api_tokens', 'created_at'), ('api_tokens', 'expires_at'),
+                ('api_tokens', 'last_used_at'), ('api_tokens', 'revoked_at'),
+                ('user_identities', 'created_at'), ('oidc_login_states', 'expires_at'),
+                ('audit_log', 'created_at'), ('categories', 'deleted_at'), ('expenses', 'deleted_at'),
+                ('idempotency_keys', 'created_at')
+            ) AS app(table_name, column_name) ON app.table_name = c.table_name AND app.column_name = c.column_name
+            WHERE c.table_schema = current_schema() AND c.data_type = 'timestamp without time zone'
+        LOOP
+            EXECUTE format('ALTER TABLE %I ALTER COLUMN %I TYPE TIMESTAMPTZ', col.table_name, col.column_name);
+        END LOOP;
+    END $$;
     `
 
 	_, err = db.Exec(createTables)
@@ -174,6 +539,12 @@ func initDB() {
 		log.Fatalf("Error creating tables: %v", err)
 	}
 
+	migrateCtx, migrateCancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer migrateCancel()
+	if err := migrateLegacyDates(migrateCtx); err != nil {
+		log.Fatalf("Error converting expense dates: %v", err)
+	}
+
 	log.Println("Database initialized successfully")
 }
 
@@ -182,43 +553,43 @@ func initPreparedStatements() {
 	var err error
 
 	// Подготовка запросов для категорий
-	stmtGetCategories, err = db.Prepare("SELECT id, name, description, monthly_stats FROM categories")
+	stmtGetCategories, err = db.Prepare("SELECT id, name, description, monthly_stats, version FROM categories WHERE household_id = $1 AND deleted_at IS NULL")
 	if err != nil {
 		log.Fatalf("Error preparing stmtGetCategories: %v", err)
 	}
 
-	stmtGetCategory, err = db.Prepare("SELECT id, name, description, monthly_stats FROM categories WHERE id = $1")
+	stmtGetCategory, err = db.Prepare("SELECT id, name, description, monthly_stats, version FROM categories WHERE id = $1 AND household_id = $2 AND deleted_at IS NULL")
 	if err != nil {
 		log.Fatalf("Error preparing stmtGetCategory: %v", err)
 	}
 
 	// Подготовка запросов для расходов
-	stmtGetExpenses, err = db.Prepare("SELECT id, category_id, name, amount, date, description FROM expenses")
+	stmtGetExpenses, err = db.Prepare("SELECT id, category_id, name, amount, date, description, tags, version FROM expenses WHERE household_id = $1 AND deleted_at IS NULL")
 	if err != nil {
 		log.Fatalf("Error preparing stmtGetExpenses: %v", err)
 	}
 
-	stmtGetExpensesByCat, err = db.Prepare("SELECT id, category_id, name, amount, date, description FROM expenses WHERE category_id = $1")
+	stmtGetExpensesByCat, err = db.Prepare("SELECT id, category_id, name, amount, date, description, tags, version FROM expenses WHERE category_id = $1 AND household_id = $2 AND deleted_at IS NULL")
 	if err != nil {
 		log.Fatalf("Error preparing stmtGetExpensesByCat: %v", err)
 	}
 
-	stmtGetExpense, err = db.Prepare("SELECT id, category_id, name, amount, date, description FROM expenses WHERE id = $1")
+	stmtGetExpense, err = db.Prepare("SELECT id, category_id, name, amount, date, description, tags, version FROM expenses WHERE id = $1 AND household_id = $2 AND deleted_at IS NULL")
 	if err != nil {
 		log.Fatalf("Error preparing stmtGetExpense: %v", err)
 	}
 
-	stmtCreateExpense, err = db.Prepare("INSERT INTO expenses (category_id, name, amount, date, description) VALUES ($1, $2, $3, $4, $5) RETURNING id")
+	stmtCreateExpense, err = db.Prepare("INSERT INTO expenses (category_id, name, amount, date, description, household_id) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id")
 	if err != nil {
 		log.Fatalf("Error preparing stmtCreateExpense: %v", err)
 	}
 
-	stmtUpdateExpense, err = db.Prepare("UPDATE expenses SET category_id = $1, name = $2, amount = $3, date = $4, description = $5 WHERE id = $6")
+	stmtUpdateExpense, err = db.Prepare("UPDATE expenses SET category_id = $1, name = $2, amount = $3, date = $4, description = $5, version = version + 1 WHERE id = $6 AND household_id = $7 AND deleted_at IS NULL")
 	if err != nil {
 		log.Fatalf("Error preparing stmtUpdateExpense: %v", err)
 	}
 
-	stmtDeleteExpense, err = db.Prepare("DELETE FROM expenses WHERE id = $1")
+	stmtDeleteExpense, err = db.Prepare("UPDATE expenses SET deleted_at = NOW(), version = version + 1 WHERE id = $1 AND household_id = $2 AND deleted_at IS NULL")
 	if err != nil {
 		log.Fatalf("Error preparing stmtDeleteExpense: %v", err)
 	}
@@ -251,7 +622,8 @@ func getCategories(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	rows, err := stmtGetCategories.QueryContext(ctx)
+	householdID := currentHouseholdID(c)
+	rows, err := stmtGetCategories.QueryContext(ctx, householdID)
 	if err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
@@ -262,7 +634,7 @@ func getCategories(c *gin.Context) {
 	for rows.Next() {
 		var cat Category
 		var monthlyStatsJSON []byte
-		err := rows.Scan(&cat.ID, &cat.Name, &cat.Description, &monthlyStatsJSON)
+		err := rows.Scan(&cat.ID, &cat.Name, &cat.Description, &monthlyStatsJSON, &cat.Version)
 		if err != nil {
 			respondWithError(c, http.StatusInternalServerError, err.Error())
 			return
@@ -277,7 +649,7 @@ func getCategories(c *gin.Context) {
 		}
 
 		// Получаем все расходы для данной категории
-		expRows, err := stmtGetExpensesByCat.QueryContext(ctx, cat.ID)
+		expRows, err := stmtGetExpensesByCat.QueryContext(ctx, cat.ID, householdID)
 		if err != nil {
 			respondWithError(c, http.StatusInternalServerError, err.Error())
 			return
@@ -288,15 +660,15 @@ func getCategories(c *gin.Context) {
 		var totalAmount float64
 		for expRows.Next() {
 			var exp Expense
-			var dateStr string
-			err := expRows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &dateStr, &exp.Description)
+			var tagsJSON []byte
+			err := expRows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &exp.Version)
 			if err != nil {
 				respondWithError(c, http.StatusInternalServerError, err.Error())
 				return
 			}
 
 			exp.CategoryID = cat.ID
-			exp.Date, _ = time.Parse(time.RFC3339, dateStr)
+			exp.Tags = decodeTags(tagsJSON)
 			cat.Expenses = append(cat.Expenses, exp)
 			totalAmount += exp.Amount
 		}
@@ -316,11 +688,12 @@ func getCategory(c *gin.Context) {
 	defer cancel()
 
 	id := c.Param("id")
+	householdID := currentHouseholdID(c)
 
 	var cat Category
 	var monthlyStatsJSON []byte
-	err := stmtGetCategory.QueryRowContext(ctx, id).
-		Scan(&cat.ID, &cat.Name, &cat.Description, &monthlyStatsJSON)
+	err := stmtGetCategory.QueryRowContext(ctx, id, householdID).
+		Scan(&cat.ID, &cat.Name, &cat.Description, &monthlyStatsJSON, &cat.Version)
 	if err != nil {
 		respondWithError(c, http.StatusNotFound, "Category not found")
 		return
@@ -335,7 +708,7 @@ func getCategory(c *gin.Context) {
 	}
 
 	// Получаем все расходы для данной категории
-	rows, err := stmtGetExpensesByCat.QueryContext(ctx, id)
+	rows, err := stmtGetExpensesByCat.QueryContext(ctx, id, householdID)
 	if err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
@@ -346,20 +719,21 @@ func getCategory(c *gin.Context) {
 	var totalAmount float64
 	for rows.Next() {
 		var exp Expense
-		var dateStr string
-		err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &dateStr, &exp.Description)
+		var tagsJSON []byte
+		err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &exp.Version)
 		if err != nil {
 			respondWithError(c, http.StatusInternalServerError, err.Error())
 			return
 		}
 
 		exp.CategoryID = cat.ID
-		exp.Date, _ = time.Parse(time.RFC3339, dateStr)
+		exp.Tags = decodeTags(tagsJSON)
 		cat.Expenses = append(cat.Expenses, exp)
 		totalAmount += exp.Amount
 	}
 	cat.TotalAmount = totalAmount
 
+	setVersionETag(c, cat.Version)
 	c.JSON(http.StatusOK, Response{
 		Status: "success",
 		Data:   cat,
@@ -383,15 +757,30 @@ func createCategory(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var id int
-	err = db.QueryRowContext(ctx, "INSERT INTO categories (name, description, monthly_stats) VALUES ($1, $2, $3) RETURNING id",
-		cat.Name, cat.Description, monthlyStatsJSON).Scan(&id)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
+	defer tx.Rollback()
 
-	cat.ID = id
+	err = tx.QueryRowContext(ctx, "INSERT INTO categories (name, description, monthly_stats, household_id) VALUES ($1, $2, $3, $4) RETURNING id, version",
+		cat.Name, cat.Description, monthlyStatsJSON, currentHouseholdID(c)).Scan(&cat.ID, &cat.Version)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := recordAudit(ctx, tx, auditActorFrom(c), auditCreate, auditEntityCategory, cat.ID, nil, cat); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	setVersionETag(c, cat.Version)
 	c.JSON(http.StatusCreated, Response{
 		Status:  "success",
 		Message: "Category created successfully",
@@ -407,23 +796,51 @@ func updateCategory(c *gin.Context) {
 		return
 	}
 
-	// Преобразуем monthlyStats в JSON строку
-	monthlyStatsJSON, err := json.Marshal(cat.MonthlyStats)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		respondWithError(c, http.StatusInternalServerError, "Error serializing monthly stats")
+		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
+	defer tx.Rollback()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	householdID := currentHouseholdID(c)
+	before, err := loadCategoryForAudit(ctx, tx, id, householdID)
+	if err == sql.ErrNoRows {
+		respondWithError(c, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !checkVersion(c, cat.Version, before.Version) {
+		return
+	}
 
-	_, err = db.ExecContext(ctx, "UPDATE categories SET name = $1, description = $2, monthly_stats = $3 WHERE id = $4",
-		cat.Name, cat.Description, monthlyStatsJSON, id)
+	// Статистика считается сервером из расходов, присланное клиентом значение игнорируем
+	err = tx.QueryRowContext(ctx, "UPDATE categories SET name = $1, description = $2, version = version + 1 WHERE id = $3 AND household_id = $4 RETURNING version",
+		cat.Name, cat.Description, before.ID, householdID).Scan(&cat.Version)
 	if err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
+	cat.ID = before.ID
+	cat.MonthlyStats = before.MonthlyStats
 
+	if err := recordAudit(ctx, tx, auditActorFrom(c), auditUpdate, auditEntityCategory, cat.ID, before, cat); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	setVersionETag(c, cat.Version)
 	c.JSON(http.StatusOK, Response{
 		Status:  "success",
 		Message: "Category updated successfully",
@@ -431,38 +848,233 @@ func updateCategory(c *gin.Context) {
 	})
 }
 
+// Действующие расходы категории с блокировкой строк до конца транзакции
+func loadCategoryExpenses(ctx context.Context, tx *sql.Tx, categoryID int) ([]Expense, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, category_id, name, amount, date, description, tags, version FROM expenses WHERE category_id = $1 AND deleted_at IS NULL ORDER BY id FOR UPDATE", categoryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expenses []Expense
+	for rows.Next() {
+		var exp Expense
+		var tagsJSON []byte
+		if err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &exp.Version); err != nil {
+			return nil, err
+		}
+		exp.Tags = decodeTags(tagsJSON)
+		expenses = append(expenses, exp)
+	}
+	return expenses, rows.Err()
+}
+
+// Удаляет категорию в корзину. С reassignTo расходы и правила переходят в другую категорию
+// вместе с суммами месячной статистики; без него непустую категорию удаляет только force=true.
 func deleteCategory(c *gin.Context) {
 	id := c.Param("id")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	var reassignTo int
+	if v := c.Query("reassignTo"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			respondWithError(c, http.StatusBadRequest, "Invalid reassignTo: "+v)
+			return
+		}
+		reassignTo = n
+	}
+	force := c.Query("force") == "true"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	_, err := db.ExecContext(ctx, "DELETE FROM categories WHERE id = $1", id)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	householdID := currentHouseholdID(c)
+	before, err := loadCategoryForAudit(ctx, tx, id, householdID)
+	if err == sql.ErrNoRows {
+		respondWithError(c, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !checkVersion(c, 0, before.Version) {
+		return
+	}
+
+	if reassignTo != 0 {
+		if reassignTo == before.ID {
+			respondWithError(c, http.StatusBadRequest, "Cannot reassign expenses to the category being deleted")
+			return
+		}
+		ok, err := categoryInHousehold(ctx, tx, householdID, reassignTo)
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !ok {
+			respondWithError(c, http.StatusBadRequest, "Target category not found")
+			return
+		}
+	}
+
+	expenses, err := loadCategoryExpenses(ctx, tx, before.ID)
 	if err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if len(expenses) > 0 && reassignTo == 0 && !force {
+		respondWithError(c, http.StatusConflict, fmt.Sprintf("Category has %d expenses; pass reassignTo to move them or force=true to delete them too", len(expenses)))
+		return
+	}
 
+	actor := auditActorFrom(c)
+	var moved []Expense
+	if reassignTo != 0 {
+		for _, exp := range expenses {
+			updated := exp
+			updated.CategoryID = reassignTo
+			if _, err := tx.ExecContext(ctx, "UPDATE expenses SET category_id = $1, version = version + 1 WHERE id = $2", reassignTo, exp.ID); err != nil {
+				respondWithError(c, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if err := updateMonthlyStatsWithTx(ctx, tx, exp.CategoryID, -exp.Amount, exp.Date); err != nil {
+				respondWithError(c, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if err := updateMonthlyStatsWithTx(ctx, tx, reassignTo, exp.Amount, exp.Date); err != nil {
+				respondWithError(c, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if err := recordAudit(ctx, tx, actor, auditUpdate, auditEntityExpense, exp.ID, exp, updated); err != nil {
+				respondWithError(c, http.StatusInternalServerError, err.Error())
+				return
+			}
+			moved = append(moved, updated)
+		}
+		// Правила продолжают раскладывать расходы, но уже в новую категорию
+		if _, err := tx.ExecContext(ctx, "UPDATE category_rules SET category_id = $1 WHERE category_id = $2", reassignTo, before.ID); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		// NOW() одинаково для всей транзакции: по этой метке категорию восстановят вместе с ее расходами
+		if _, err := tx.ExecContext(ctx, "UPDATE expenses SET deleted_at = NOW(), version = version + 1 WHERE category_id = $1 AND deleted_at IS NULL", before.ID); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, exp := range expenses {
+			if err := updateMonthlyStatsWithTx(ctx, tx, exp.CategoryID, -exp.Amount, exp.Date); err != nil {
+				respondWithError(c, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if err := recordAudit(ctx, tx, actor, auditDelete, auditEntityExpense, exp.ID, exp, nil); err != nil {
+				respondWithError(c, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE categories SET deleted_at = NOW(), version = version + 1 WHERE id = $1", before.ID); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := recordAudit(ctx, tx, actor, auditDelete, auditEntityCategory, before.ID, before, nil); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Категория из корзины не предлагается, поэтому модель ее забывает
+	classifier.RemoveCategory(householdID, before.ID)
+	for i := range moved {
+		classifier.Add(householdID, &moved[i])
+	}
+
+	message := "Category deleted successfully"
+	if reassignTo != 0 {
+		message = fmt.Sprintf("Category deleted, %d expenses moved to category %d", len(moved), reassignTo)
+	} else if len(expenses) > 0 {
+		message = fmt.Sprintf("Category deleted with %d expenses", len(expenses))
+	}
 	c.JSON(http.StatusOK, Response{
 		Status:  "success",
-		Message: "Category deleted successfully",
+		Message: message,
 	})
 }
 
+// Фильтры списка расходов; те же параметры принимает экспорт, а в теле - пакетная перекатегоризация.
+// HouseholdID не приходит из запроса: его заполняет обработчик.
+type ExpenseFilter struct {
+	HouseholdID int    `form:"-" json:"-"`
+	CategoryID  int    `form:"categoryId" json:"categoryId"`
+	From        string `form:"from" json:"from"`
+	To          string `form:"to" json:"to"`
+}
+
+// Условие WHERE для фильтра; alias - псевдоним таблицы expenses в запросе
+func (f *ExpenseFilter) whereClause(alias string) (string, []interface{}, error) {
+	if alias != "" {
+		alias += "."
+	}
+
+	// Условие по домохозяйству есть всегда: фильтр без него не вернет ничего.
+	// Расходы из корзины в выборки не попадают. Границы дат - полночь в часовом поясе домохозяйства.
+	args := []interface{}{f.HouseholdID}
+	conditions := []string{fmt.Sprintf("%shousehold_id = $1", alias), alias + "deleted_at IS NULL"}
+	if f.CategoryID != 0 {
+		args = append(args, f.CategoryID)
+		conditions = append(conditions, fmt.Sprintf("%scategory_id = $%d", alias, len(args)))
+	}
+	if f.From != "" {
+		from, err := time.Parse("2006-01-02", f.From)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid from date: %s", f.From)
+		}
+		args = append(args, from.Format("2006-01-02"))
+		conditions = append(conditions, fmt.Sprintf("%sdate >= ($%d::timestamp AT TIME ZONE %s)", alias, len(args), householdTimezoneSQL))
+	}
+	if f.To != "" {
+		// Граница включительная: берем все до начала следующего дня
+		to, err := time.Parse("2006-01-02", f.To)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid to date: %s", f.To)
+		}
+		args = append(args, to.AddDate(0, 0, 1).Format("2006-01-02"))
+		conditions = append(conditions, fmt.Sprintf("%sdate < ($%d::timestamp AT TIME ZONE %s)", alias, len(args), householdTimezoneSQL))
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
 func getExpenses(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	categoryID := c.Query("categoryId")
-	var rows *sql.Rows
-	var err error
+	var filter ExpenseFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.HouseholdID = currentHouseholdID(c)
 
-	if categoryID != "" {
-		rows, err = stmtGetExpensesByCat.QueryContext(ctx, categoryID)
-	} else {
-		rows, err = stmtGetExpenses.QueryContext(ctx)
+	where, args, err := filter.whereClause("")
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
 	}
 
+	rows, err := db.QueryContext(ctx, "SELECT id, category_id, name, amount, date, description, tags, version FROM expenses"+where, args...)
 	if err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
@@ -472,14 +1084,14 @@ func getExpenses(c *gin.Context) {
 	var expenses []Expense
 	for rows.Next() {
 		var exp Expense
-		var dateStr string
-		err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &dateStr, &exp.Description)
+		var tagsJSON []byte
+		err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &exp.Version)
 		if err != nil {
 			respondWithError(c, http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		exp.Date, _ = time.Parse(time.RFC3339, dateStr)
+		exp.Tags = decodeTags(tagsJSON)
 		expenses = append(expenses, exp)
 	}
 
@@ -496,16 +1108,17 @@ func getExpense(c *gin.Context) {
 	id := c.Param("id")
 
 	var exp Expense
-	var dateStr string
-	err := stmtGetExpense.QueryRowContext(ctx, id).
-		Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &dateStr, &exp.Description)
+	var tagsJSON []byte
+	err := stmtGetExpense.QueryRowContext(ctx, id, currentHouseholdID(c)).
+		Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &exp.Version)
 	if err != nil {
 		respondWithError(c, http.StatusNotFound, "Expense not found")
 		return
 	}
 
-	exp.Date, _ = time.Parse(time.RFC3339, dateStr)
+	exp.Tags = decodeTags(tagsJSON)
 
+	setVersionETag(c, exp.Version)
 	c.JSON(http.StatusOK, Response{
 		Status: "success",
 		Data:   exp,
@@ -514,37 +1127,75 @@ func getExpense(c *gin.Context) {
 
 // Обновленная функция обновления статистики с поддержкой транзакций
 func updateMonthlyStatsWithTx(ctx context.Context, tx *sql.Tx, categoryID int, amount float64, date time.Time) error {
-	// Получаем текущую статистику
-	var monthlyStatsJSON []byte
-	err := tx.QueryRowContext(ctx, "SELECT monthly_stats FROM categories WHERE id = $1", categoryID).Scan(&monthlyStatsJSON)
-	if err != nil {
-		log.Printf("Error getting monthly stats for category %d: %v", categoryID, err)
-		return err
+	deltas := statsDeltas{}
+	deltas.add(categoryID, amount, date)
+	return deltas.applyWithTx(ctx, tx)
+}
+
+// Изменения месячной статистики, накопленные за транзакцию: категория -> момент (Unix) -> сумма.
+// Месяц определяется при записи, по часовому поясу и началу месяца домохозяйства категории.
+type statsDeltas map[int]map[int64]float64
+
+func (d statsDeltas) add(categoryID int, amount float64, date time.Time) {
+	if d[categoryID] == nil {
+		d[categoryID] = make(map[int64]float64)
 	}
+	d[categoryID][date.Unix()] += amount
+}
 
-	monthlyStats := make(map[string]float64)
-	if len(monthlyStatsJSON) > 0 {
-		if err := json.Unmarshal(monthlyStatsJSON, &monthlyStats); err != nil {
-			log.Printf("Error parsing monthly stats for category %d: %v", categoryID, err)
+// Применяет изменения одним чтением и одной записью на категорию.
+// Категории обходятся по возрастанию id, чтобы параллельные транзакции не блокировали друг друга.
+func (d statsDeltas) applyWithTx(ctx context.Context, tx *sql.Tx) error {
+	categoryIDs := make([]int, 0, len(d))
+	for categoryID := range d {
+		categoryIDs = append(categoryIDs, categoryID)
+	}
+	sort.Ints(categoryIDs)
+
+	calendars := make(map[int]periodCalendar)
+	for _, categoryID := range categoryIDs {
+		// Получаем текущую статистику и календарь домохозяйства
+		var monthlyStatsJSON []byte
+		var householdID int
+		err := tx.QueryRowContext(ctx, "SELECT monthly_stats, household_id FROM categories WHERE id = $1 FOR UPDATE", categoryID).Scan(&monthlyStatsJSON, &householdID)
+		if err != nil {
+			log.Printf("Error getting monthly stats for category %d: %v", categoryID, err)
 			return err
 		}
-	}
+		cal, ok := calendars[householdID]
+		if !ok {
+			if cal, err = householdCalendar(ctx, tx, householdID); err != nil {
+				return err
+			}
+			calendars[householdID] = cal
+		}
 
-	// Добавляем сумму к соответствующему месяцу
-	month := date.Format("2006-01")
-	monthlyStats[month] += amount
+		monthlyStats := make(map[string]float64)
+		if len(monthlyStatsJSON) > 0 {
+			if err := json.Unmarshal(monthlyStatsJSON, &monthlyStats); err != nil {
+				log.Printf("Error parsing monthly stats for category %d: %v", categoryID, err)
+				return err
+			}
+		}
 
-	// Обновляем статистику в базе данных
-	updatedStatsJSON, err := json.Marshal(monthlyStats)
-	if err != nil {
-		log.Printf("Error serializing monthly stats for category %d: %v", categoryID, err)
-		return err
-	}
+		// Добавляем суммы к соответствующим месяцам
+		for unix, amount := range d[categoryID] {
+			monthlyStats[cal.monthLabel(time.Unix(unix, 0))] += amount
+		}
 
-	_, err = tx.ExecContext(ctx, "UPDATE categories SET monthly_stats = $1 WHERE id = $2", updatedStatsJSON, categoryID)
-	if err != nil {
-		log.Printf("Error updating monthly stats for category %d: %v", categoryID, err)
-		return err
+		// Обновляем статистику в базе данных
+		updatedStatsJSON, err := json.Marshal(monthlyStats)
+		if err != nil {
+			log.Printf("Error serializing monthly stats for category %d: %v", categoryID, err)
+			return err
+		}
+
+		// Статистика не входит в редактируемые поля категории, поэтому версию не меняем
+		_, err = tx.ExecContext(ctx, "UPDATE categories SET monthly_stats = $1 WHERE id = $2", updatedStatsJSON, categoryID)
+		if err != nil {
+			log.Printf("Error updating monthly stats for category %d: %v", categoryID, err)
+			return err
+		}
 	}
 
 	return nil
@@ -576,16 +1227,39 @@ func createExpense(c *gin.Context) {
 	// Если транзакция успешно завершится commit, rollback не будет иметь эффекта
 	defer tx.Rollback()
 
-	// Создаем расход
-	var id int
-	err = tx.QueryRowContext(ctx, "INSERT INTO expenses (category_id, name, amount, date, description) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		exp.CategoryID, exp.Name, exp.Amount, exp.Date.Format(time.RFC3339), exp.Description).Scan(&id)
+	householdID := currentHouseholdID(c)
+
+	// Если категория не указана, ее подбирают правила автокатегоризации
+	if exp.CategoryID == 0 {
+		rules, err := loadRules(ctx, tx, householdID)
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		applyRules(rules, &exp, false)
+		if exp.CategoryID == 0 {
+			respondWithError(c, http.StatusBadRequest, "categoryId is required: no categorization rule matched")
+			return
+		}
+	}
+
+	ok, err := categoryInHousehold(ctx, tx, householdID, exp.CategoryID)
 	if err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if !ok {
+		respondWithError(c, http.StatusBadRequest, "Category not found")
+		return
+	}
 
-	exp.ID = id
+	// Создаем расход
+	err = tx.QueryRowContext(ctx, "INSERT INTO expenses (category_id, name, amount, date, description, tags, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, version",
+		exp.CategoryID, exp.Name, exp.Amount, exp.Date, exp.Description, encodeTags(exp.Tags), householdID).Scan(&exp.ID, &exp.Version)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	// Обновляем месячную статистику для категории
 	err = updateMonthlyStatsWithTx(ctx, tx, exp.CategoryID, exp.Amount, exp.Date)
@@ -594,12 +1268,19 @@ func createExpense(c *gin.Context) {
 		return
 	}
 
+	if err := recordAudit(ctx, tx, auditActorFrom(c), auditCreate, auditEntityExpense, exp.ID, nil, exp); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	// Фиксируем транзакцию
 	if err = tx.Commit(); err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
+	classifier.Add(householdID, &exp)
 
+	setVersionETag(c, exp.Version)
 	c.JSON(http.StatusCreated, Response{
 		Status:  "success",
 		Message: "Expense created successfully",
@@ -627,20 +1308,35 @@ func updateExpense(c *gin.Context) {
 
 	defer tx.Rollback()
 
+	householdID := currentHouseholdID(c)
+
 	// Получаем текущие данные о расходе для обновления статистики
 	var oldExp Expense
-	var dateStr string
-	err = tx.QueryRowContext(ctx, "SELECT id, category_id, amount, date FROM expenses WHERE id = $1", id).
-		Scan(&oldExp.ID, &oldExp.CategoryID, &oldExp.Amount, &dateStr)
+	var tagsJSON []byte
+	err = tx.QueryRowContext(ctx, "SELECT id, category_id, name, amount, date, description, tags, version FROM expenses WHERE id = $1 AND household_id = $2 AND deleted_at IS NULL FOR UPDATE", id, householdID).
+		Scan(&oldExp.ID, &oldExp.CategoryID, &oldExp.Name, &oldExp.Amount, &oldExp.Date, &oldExp.Description, &tagsJSON, &oldExp.Version)
 	if err != nil {
 		respondWithError(c, http.StatusNotFound, "Expense not found")
 		return
 	}
-	oldExp.Date, _ = time.Parse(time.RFC3339, dateStr)
+	oldExp.Tags = decodeTags(tagsJSON)
+	if !checkVersion(c, exp.Version, oldExp.Version) {
+		return
+	}
+
+	ok, err := categoryInHousehold(ctx, tx, householdID, exp.CategoryID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		respondWithError(c, http.StatusBadRequest, "Category not found")
+		return
+	}
 
 	// Обновляем расход
-	_, err = tx.ExecContext(ctx, "UPDATE expenses SET category_id = $1, name = $2, amount = $3, date = $4, description = $5 WHERE id = $6",
-		exp.CategoryID, exp.Name, exp.Amount, exp.Date.Format(time.RFC3339), exp.Description, id)
+	err = tx.QueryRowContext(ctx, "UPDATE expenses SET category_id = $1, name = $2, amount = $3, date = $4, description = $5, tags = $6, version = version + 1 WHERE id = $7 AND household_id = $8 RETURNING version",
+		exp.CategoryID, exp.Name, exp.Amount, exp.Date, exp.Description, encodeTags(exp.Tags), id, householdID).Scan(&exp.Version)
 	if err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
@@ -661,12 +1357,20 @@ func updateExpense(c *gin.Context) {
 		return
 	}
 
+	exp.ID = oldExp.ID
+	if err := recordAudit(ctx, tx, auditActorFrom(c), auditUpdate, auditEntityExpense, exp.ID, oldExp, exp); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	// Фиксируем транзакцию
 	if err = tx.Commit(); err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
+	classifier.Replace(householdID, &oldExp, &exp)
 
+	setVersionETag(c, exp.Version)
 	c.JSON(http.StatusOK, Response{
 		Status:  "success",
 		Message: "Expense updated successfully",
@@ -676,6 +1380,7 @@ func updateExpense(c *gin.Context) {
 
 func deleteExpense(c *gin.Context) {
 	id := c.Param("id")
+	householdID := currentHouseholdID(c)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -691,17 +1396,20 @@ func deleteExpense(c *gin.Context) {
 
 	// Получаем данные о расходе перед удалением для обновления статистики
 	var exp Expense
-	var dateStr string
-	err = tx.QueryRowContext(ctx, "SELECT id, category_id, amount, date FROM expenses WHERE id = $1", id).
-		Scan(&exp.ID, &exp.CategoryID, &exp.Amount, &dateStr)
+	var tagsJSON []byte
+	err = tx.QueryRowContext(ctx, "SELECT id, category_id, name, amount, date, description, tags, version FROM expenses WHERE id = $1 AND household_id = $2 AND deleted_at IS NULL FOR UPDATE", id, householdID).
+		Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &exp.Version)
 	if err != nil {
 		respondWithError(c, http.StatusNotFound, "Expense not found")
 		return
 	}
-	exp.Date, _ = time.Parse(time.RFC3339, dateStr)
+	exp.Tags = decodeTags(tagsJSON)
+	if !checkVersion(c, 0, exp.Version) {
+		return
+	}
 
-	// Удаляем расход
-	_, err = tx.ExecContext(ctx, "DELETE FROM expenses WHERE id = $1", id)
+	// Расход уходит в корзину, откуда его можно восстановить
+	_, err = tx.ExecContext(ctx, "UPDATE expenses SET deleted_at = NOW(), version = version + 1 WHERE id = $1", exp.ID)
 	if err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
@@ -714,11 +1422,17 @@ func deleteExpense(c *gin.Context) {
 		return
 	}
 
+	if err := recordAudit(ctx, tx, auditActorFrom(c), auditDelete, auditEntityExpense, exp.ID, exp, nil); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	// Фиксируем транзакцию
 	if err = tx.Commit(); err != nil {
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
+	classifier.Remove(householdID, &exp)
 
 	c.JSON(http.StatusOK, Response{
 		Status:  "success",
@@ -726,118 +1440,151 @@ func deleteExpense(c *gin.Context) {
 	})
 }
 
+// Статистика за период from - to (включительно; по умолчанию от первого расхода до сегодня)
+// с разбивкой по granularity, нулями в пустых периодах и фильтром по категориям.
+// monthlyTotals и monthlyStats категорий сохранены для прежних клиентов.
 func getStatistics(c *gin.Context) {
+	var filter StatisticsFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.Granularity == "" {
+		filter.Granularity = granularityMonth
+	}
+	if !validGranularity(filter.Granularity) {
+		respondWithError(c, http.StatusBadRequest, "granularity must be one of day, week, month, quarter, year")
+		return
+	}
+	var from, to time.Time
+	var err error
+	if filter.From != "" {
+		if from, err = time.Parse("2006-01-02", filter.From); err != nil {
+			respondWithError(c, http.StatusBadRequest, "invalid from date: "+filter.From)
+			return
+		}
+	}
+	if filter.To != "" {
+		if to, err = time.Parse("2006-01-02", filter.To); err != nil {
+			respondWithError(c, http.StatusBadRequest, "invalid to date: "+filter.To)
+			return
+		}
+		if !from.IsZero() && to.Before(from) {
+			respondWithError(c, http.StatusBadRequest, "to must not be before from")
+			return
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Получение общей суммы расходов
-	var totalAmount sql.NullFloat64
-	err := db.QueryRowContext(ctx, "SELECT SUM(amount) FROM expenses").Scan(&totalAmount)
+	householdID := currentHouseholdID(c)
+
+	// Дни, периоды и текущий месяц считаются по календарю домохозяйства
+	cal, err := householdCalendar(ctx, db, householdID)
 	if err != nil {
-		log.Printf("Error getting total amount: %v", err)
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// Безопасно извлекаем значение (0 если NULL)
-	totalAmountValue := 0.0
-	if totalAmount.Valid {
-		totalAmountValue = totalAmount.Float64
+	categoryStats, categoryIndex, err := loadStatisticsCategories(ctx, householdID, filter.CategoryIDs)
+	if err != nil {
+		log.Printf("Error getting category stats: %v", err)
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
 	}
-
-	// Получение суммы расходов за текущий месяц
-	currentMonth := time.Now().Format("2006-01")
-	startOfMonth := currentMonth + "-01T00:00:00Z"
-	endOfMonth := ""
-	if time.Now().Month() == 12 {
-		endOfMonth = fmt.Sprintf("%d-01-01T00:00:00Z", time.Now().Year()+1)
-	} else {
-		endOfMonth = fmt.Sprintf("%d-%02d-01T00:00:00Z", time.Now().Year(), time.Now().Month()+1)
+	for _, id := range filter.CategoryIDs {
+		if _, ok := categoryIndex[id]; !ok {
+			respondWithError(c, http.StatusBadRequest, fmt.Sprintf("Category %d not found", id))
+			return
+		}
 	}
 
-	var currentMonthAmount sql.NullFloat64
-	err = db.QueryRowContext(ctx, "SELECT SUM(amount) FROM expenses WHERE date >= $1 AND date < $2", startOfMonth, endOfMonth).Scan(&currentMonthAmount)
+	// Суммы по дням и категориям за период; периоды собираются из них в Go
+	days, err := queryDailyTotals(ctx, householdID, filter.CategoryIDs, from, to)
 	if err != nil {
-		log.Printf("Error getting current month amount: %v", err)
+		log.Printf("Error getting daily totals: %v", err)
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// Безопасно извлекаем значение (0 если NULL)
-	currentMonthAmountValue := 0.0
-	if currentMonthAmount.Valid {
-		currentMonthAmountValue = currentMonthAmount.Float64
+	// Границы по умолчанию: от первого расхода до сегодня (или до последнего расхода, если он позже)
+	now := time.Now().In(cal.Location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if from.IsZero() {
+		from = today
+		if len(days) > 0 {
+			from = days[0].day
+		}
+	}
+	if to.IsZero() {
+		to = today
+		if len(days) > 0 && days[len(days)-1].day.After(to) {
+			to = days[len(days)-1].day
+		}
+		if to.Before(from) {
+			to = from
+		}
 	}
 
-	// Получение статистики по категориям
-	rows, err := db.QueryContext(ctx, "SELECT c.id, c.name, c.monthly_stats, SUM(e.amount) FROM categories c LEFT JOIN expenses e ON c.id = e.category_id GROUP BY c.id")
+	buckets, err := cal.buildBuckets(from, to, filter.Granularity)
 	if err != nil {
-		log.Printf("Error getting category stats: %v", err)
-		respondWithError(c, http.StatusInternalServerError, err.Error())
+		respondWithError(c, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer rows.Close()
-
-	type CategoryStat struct {
-		ID           int                `json:"id"`
-		Name         string             `json:"name"`
-		TotalAmount  float64            `json:"totalAmount"`
-		MonthlyStats map[string]float64 `json:"monthlyStats"`
+	for i := range categoryStats {
+		categoryStats[i].Buckets = make([]float64, len(buckets))
 	}
 
-	var categoryStats []CategoryStat
-	for rows.Next() {
-		var cat CategoryStat
-		var totalAmount sql.NullFloat64
-		var monthlyStatsJSON []byte
-		err := rows.Scan(&cat.ID, &cat.Name, &monthlyStatsJSON, &totalAmount)
-		if err != nil {
-			log.Printf("Error scanning category stats: %v", err)
-			respondWithError(c, http.StatusInternalServerError, err.Error())
-			return
-		}
-
-		if totalAmount.Valid {
-			cat.TotalAmount = totalAmount.Float64
+	totalAmountValue := 0.0
+	monthlyTotals := make(map[string]float64)
+	for _, d := range days {
+		totalAmountValue += d.amount
+		monthlyTotals[cal.bucketLabel(cal.bucketStart(d.day, granularityMonth), granularityMonth)] += d.amount
+		i := cal.bucketIndex(buckets, d.day, filter.Granularity)
+		if i >= 0 {
+			buckets[i].Total += d.amount
 		}
-
-		// Разбор JSON строки для monthlyStats
-		cat.MonthlyStats = make(map[string]float64)
-		if len(monthlyStatsJSON) > 0 {
-			if err := json.Unmarshal(monthlyStatsJSON, &cat.MonthlyStats); err != nil {
-				log.Printf("Error parsing monthly stats for category %d: %v", cat.ID, err)
+		if j, ok := categoryIndex[d.categoryID]; ok {
+			categoryStats[j].TotalAmount += d.amount
+			if i >= 0 {
+				categoryStats[j].Buckets[i] += d.amount
 			}
 		}
-
-		categoryStats = append(categoryStats, cat)
 	}
 
-	// Получение статистики по месяцам (для всех категорий)
-	rows, err = db.QueryContext(ctx, "SELECT to_char(date, 'YYYY-MM') as month, SUM(amount) FROM expenses GROUP BY month ORDER BY month")
+	// Получение суммы расходов за текущий месяц (финансовый, с дня начала месяца домохозяйства)
+	monthStart := cal.bucketStart(today, granularityMonth)
+	startOfMonth := time.Date(monthStart.Year(), monthStart.Month(), monthStart.Day(), 0, 0, 0, 0, cal.Location)
+	endOfMonth := startOfMonth.AddDate(0, 1, 0)
+
+	conditions, args := statisticsConditions(householdID, filter.CategoryIDs)
+	monthArgs := append(args, startOfMonth, endOfMonth)
+	var currentMonthAmount sql.NullFloat64
+	err = db.QueryRowContext(ctx, "SELECT SUM(amount) FROM expenses WHERE "+strings.Join(conditions, " AND ")+
+		fmt.Sprintf(" AND date >= $%d AND date < $%d", len(monthArgs)-1, len(monthArgs)), monthArgs...).Scan(&currentMonthAmount)
 	if err != nil {
-		log.Printf("Error getting monthly totals: %v", err)
+		log.Printf("Error getting current month amount: %v", err)
 		respondWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	monthlyTotals := make(map[string]float64)
-	for rows.Next() {
-		var month string
-		var amount float64
-		err := rows.Scan(&month, &amount)
-		if err != nil {
-			log.Printf("Error scanning monthly totals: %v", err)
-			respondWithError(c, http.StatusInternalServerError, err.Error())
-			return
-		}
-		monthlyTotals[month] = amount
+	// Безопасно извлекаем значение (0 если NULL)
+	currentMonthAmountValue := 0.0
+	if currentMonthAmount.Valid {
+		currentMonthAmountValue = currentMonthAmount.Float64
 	}
 
 	statistics := map[string]interface{}{
 		"totalAmount":        totalAmountValue,
 		"currentMonthAmount": currentMonthAmountValue,
+		"currentMonth":       cal.bucketLabel(monthStart, granularityMonth),
 		"categoryStats":      categoryStats,
 		"monthlyTotals":      monthlyTotals,
+		"from":               cal.bucketStart(from, granularityDay).Format("2006-01-02"),
+		"to":                 cal.bucketStart(to, granularityDay).Format("2006-01-02"),
+		"granularity":        filter.Granularity,
+		"buckets":            buckets,
 	}
 
 	c.JSON(http.StatusOK, Response{
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeleteCategory(t *testing.T) {
+	t.Setenv("REQUIRE_IF_MATCH", "false")
+	var user *User
+	var householdID, food, cafe, forced, empty, foreign int
+	var bread, latte, cake Expense
+	var rule int
+	january := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+	february := time.Date(2024, time.February, 10, 12, 0, 0, 0, time.UTC)
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, householdID = createTestUser(t, ctx, tx)
+		if _, err := tx.ExecContext(ctx, "UPDATE households SET timezone = 'UTC', month_start_day = 1 WHERE id = $1", householdID); err != nil {
+			t.Fatal(err)
+		}
+		food = createTestCategory(t, ctx, tx, householdID, "Food")
+		cafe = createTestCategory(t, ctx, tx, householdID, "Cafe")
+		forced = createTestCategory(t, ctx, tx, householdID, "Sweets")
+		empty = createTestCategory(t, ctx, tx, householdID, "Empty")
+		_, otherHousehold := createTestUser(t, ctx, tx)
+		foreign = createTestCategory(t, ctx, tx, otherHousehold, "Foreign")
+
+		bread = createTestExpense(t, ctx, tx, householdID, food, "Bread", 50, january)
+		latte = createTestExpense(t, ctx, tx, householdID, cafe, "Latte", 200, january)
+		createTestExpense(t, ctx, tx, householdID, cafe, "Espresso", 150, february)
+		cake = createTestExpense(t, ctx, tx, householdID, forced, "Cake", 300, february)
+
+		if err := tx.QueryRowContext(ctx, "INSERT INTO category_rules (name, name_contains, category_id, household_id) VALUES ('Coffee', 'coffee', $1, $2) RETURNING id",
+			cafe, householdID).Scan(&rule); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	router := testRouter(user.ID, householdID)
+	router.DELETE("/api/categories/:id", deleteCategory)
+	ctx := context.Background()
+	deleteURL := func(id int, query string) string {
+		return fmt.Sprintf("/api/categories/%d%s", id, query)
+	}
+	inTrash := func(table string, id int) bool {
+		t.Helper()
+		var deleted bool
+		if err := db.QueryRowContext(ctx, "SELECT deleted_at IS NOT NULL FROM "+table+" WHERE id = $1", id).Scan(&deleted); err != nil {
+			t.Fatal(err)
+		}
+		return deleted
+	}
+
+	t.Run("rejected requests change nothing", func(t *testing.T) {
+		tests := []struct {
+			url  string
+			want int
+		}{
+			// Без reassignTo и force непустую категорию не удалить
+			{url: deleteURL(cafe, ""), want: http.StatusConflict},
+			{url: deleteURL(cafe, "?force=false"), want: http.StatusConflict},
+			{url: deleteURL(cafe, "?reassignTo=abc"), want: http.StatusBadRequest},
+			{url: deleteURL(cafe, "?reassignTo=0"), want: http.StatusBadRequest},
+			{url: deleteURL(cafe, fmt.Sprintf("?reassignTo=%d", cafe)), want: http.StatusBadRequest},
+			{url: deleteURL(cafe, fmt.Sprintf("?reassignTo=%d", foreign)), want: http.StatusBadRequest},
+			{url: deleteURL(foreign, ""), want: http.StatusNotFound},
+		}
+		for _, tt := range tests {
+			if w := doJSON(router, http.MethodDelete, tt.url, nil); w.Code != tt.want {
+				t.Errorf("DELETE %s: status = %d, want %d: %s", tt.url, w.Code, tt.want, w.Body)
+			}
+		}
+		if inTrash("categories", cafe) || inTrash("expenses", latte.ID) {
+			t.Fatal("rejected delete moved the category or its expenses to the trash")
+		}
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, cafe), map[string]float64{"2024-01": 200, "2024-02": 150})
+	})
+
+	t.Run("reassign", func(t *testing.T) {
+		w := doJSON(router, http.MethodDelete, deleteURL(cafe, fmt.Sprintf("?reassignTo=%d", food)), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+		if !inTrash("categories", cafe) {
+			t.Error("category is not in the trash")
+		}
+
+		// Расходы переезжают вместе со своими суммами в статистике
+		var moved int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM expenses WHERE category_id = $1 AND deleted_at IS NULL", food).Scan(&moved); err != nil {
+			t.Fatal(err)
+		}
+		if moved != 3 {
+			t.Errorf("food has %d expenses, want 3", moved)
+		}
+		var version int
+		if err := db.QueryRowContext(ctx, "SELECT version FROM expenses WHERE id = $1", latte.ID).Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		if version != latte.Version+1 {
+			t.Errorf("moved expense version = %d, want %d", version, latte.Version+1)
+		}
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), map[string]float64{"2024-01": 250, "2024-02": 150})
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, cafe), map[string]float64{"2024-01": 0, "2024-02": 0})
+
+		// Правило продолжает работать, но раскладывает в новую категорию
+		var ruleCategory int
+		if err := db.QueryRowContext(ctx, "SELECT category_id FROM category_rules WHERE id = $1", rule).Scan(&ruleCategory); err != nil {
+			t.Fatal(err)
+		}
+		if ruleCategory != food {
+			t.Errorf("rule category = %d, want %d", ruleCategory, food)
+		}
+	})
+
+	t.Run("force", func(t *testing.T) {
+		w := doJSON(router, http.MethodDelete, deleteURL(forced, "?force=true"), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+
+		// Расходы уходят в корзину с той же меткой, что и категория, и вычитаются из статистики
+		var sameTime bool
+		if err := db.QueryRowContext(ctx, "SELECT e.deleted_at = c.deleted_at FROM expenses e JOIN categories c ON c.id = e.category_id WHERE e.id = $1", cake.ID).Scan(&sameTime); err != nil {
+			t.Fatal(err)
+		}
+		if !sameTime {
+			t.Error("expense and category were trashed at different times")
+		}
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, forced), map[string]float64{"2024-02": 0})
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), map[string]float64{"2024-01": 250, "2024-02": 150})
+		if inTrash("expenses", bread.ID) {
+			t.Error("expense of another category was trashed")
+		}
+	})
+
+	t.Run("empty category", func(t *testing.T) {
+		if w := doJSON(router, http.MethodDelete, deleteURL(empty, ""), nil); w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+		if !inTrash("categories", empty) {
+			t.Error("category is not in the trash")
+		}
+		if w := doJSON(router, http.MethodDelete, deleteURL(empty, ""), nil); w.Code != http.StatusNotFound {
+			t.Errorf("second delete: status = %d, want 404", w.Code)
+		}
+	})
+}
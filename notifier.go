@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Отправка писем пользователям: подтверждение адреса, сброс пароля
+type Notifier interface {
+	Send(to, subject, body string) error
+}
+
+var notifier Notifier = logNotifier{}
+
+// Настройки SMTP из переменных окружения. Без SMTP_HOST письма только пишутся в лог,
+// для проверки подойдет локальный перехватчик вроде MailHog (SMTP_HOST=localhost SMTP_PORT=1025).
+func newNotifierFromEnv() Notifier {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return logNotifier{}
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "25"
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "expense-tracker@localhost"
+	}
+
+	n := &smtpNotifier{
+		addr: net.JoinHostPort(host, port),
+		from: from,
+	}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		n.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return n
+}
+
+type smtpNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (n *smtpNotifier) Send(to, subject, body string) error {
+	msg, err := buildEmail(n.from, to, subject, body)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(n.addr, n.auth, n.from, []string{to}, msg)
+}
+
+// Письмо в text/plain UTF-8; заголовок темы кодируется по RFC 2047
+func buildEmail(from, to, subject, body string) ([]byte, error) {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(from, "\r\n") {
+		return nil, fmt.Errorf("invalid email address")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Заглушка на случай, когда SMTP не настроен: ссылки можно взять из лога
+type logNotifier struct{}
+
+func (logNotifier) Send(to, subject, body string) error {
+	log.Printf("Email to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// Подкоманда: expense-tracker send-test-email -to address
+func runSendTestEmailCommand(args []string) error {
+	fs := flag.NewFlagSet("send-test-email", flag.ExitOnError)
+	to := fs.String("to", "", "recipient address")
+	fs.Parse(args)
+
+	if *to == "" {
+		return fmt.Errorf("-to is required")
+	}
+	if err := notifier.Send(*to, "Проверка почты", "Настройки SMTP работают."); err != nil {
+		return err
+	}
+	fmt.Printf("Test email sent to %s\n", *to)
+	return nil
+}
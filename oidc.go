@@ -0,0 +1,758 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Сколько живет незавершенный вход через провайдера
+const oidcStateTTL = 10 * time.Minute
+
+// Как долго кэшируются документ discovery и ключи, если провайдер не указал max-age
+const oidcCacheTTL = time.Hour
+
+// Неизвестный kid вызывает перезагрузку ключей не чаще этого интервала
+const oidcJWKSMinRefresh = time.Minute
+
+// Допустимое расхождение часов с провайдером
+const oidcClockSkew = time.Minute
+
+const oidcMaxResponseSize = 1 << 20
+
+var errOIDCNotConfigured = errors.New("single sign-on is not configured")
+
+// Настройки входа через OpenID Connect из переменных окружения
+type oidcConfig struct {
+	Issuer         string
+	ClientID       string
+	ClientSecret   string
+	RedirectURL    string
+	Scopes         []string
+	UsernameClaim  string
+	HouseholdClaim string
+	HouseholdRole  string
+}
+
+// OIDC_ISSUER и OIDC_CLIENT_ID включают вход через провайдера. Без OIDC_CLIENT_SECRET
+// клиент считается публичным и защищен только PKCE. OIDC_HOUSEHOLD_CLAIM задает claim
+// (например, groups), значения которого становятся общими домохозяйствами.
+func oidcConfigFromEnv() (*oidcConfig, error) {
+	issuer := strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/")
+	clientID := os.Getenv("OIDC_CLIENT_ID")
+	if issuer == "" && clientID == "" {
+		return nil, nil
+	}
+	if issuer == "" || clientID == "" {
+		return nil, errors.New("OIDC_ISSUER and OIDC_CLIENT_ID must be set together")
+	}
+
+	cfg := &oidcConfig{
+		Issuer:         issuer,
+		ClientID:       clientID,
+		ClientSecret:   os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:    os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:         strings.Fields(os.Getenv("OIDC_SCOPES")),
+		UsernameClaim:  os.Getenv("OIDC_USERNAME_CLAIM"),
+		HouseholdClaim: os.Getenv("OIDC_HOUSEHOLD_CLAIM"),
+		HouseholdRole:  os.Getenv("OIDC_HOUSEHOLD_ROLE"),
+	}
+	if cfg.RedirectURL == "" {
+		cfg.RedirectURL = appURL() + "/api/auth/oidc/callback"
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.HouseholdRole == "" {
+		cfg.HouseholdRole = roleEditor
+	}
+	if roleRank[cfg.HouseholdRole] == 0 {
+		return nil, fmt.Errorf("unknown OIDC_HOUSEHOLD_ROLE: %s", cfg.HouseholdRole)
+	}
+	return cfg, nil
+}
+
+// Провайдер с кэшем discovery и ключей подписи; nil, если вход не настроен
+var oidc *oidcProvider
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcProvider struct {
+	cfg    oidcConfig
+	client *http.Client
+
+	mu              sync.Mutex
+	discovery       *oidcDiscovery
+	discoveryExpiry time.Time
+	keys            map[string]crypto.PublicKey
+	keysExpiry      time.Time
+	keysFetched     time.Time
+}
+
+func newOIDCProvider(cfg oidcConfig, client *http.Client) *oidcProvider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &oidcProvider{cfg: cfg, client: client}
+}
+
+// Загружает JSON и возвращает срок кэширования из Cache-Control
+func (p *oidcProvider) getJSON(ctx context.Context, endpoint string, v interface{}) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: unexpected status %s", endpoint, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseSize)).Decode(v); err != nil {
+		return 0, fmt.Errorf("GET %s: %w", endpoint, err)
+	}
+	return cacheMaxAge(resp.Header.Get("Cache-Control")), nil
+}
+
+var maxAgeRe = regexp.MustCompile(`(?:^|[,\s])max-age=(\d+)`)
+
+func cacheMaxAge(header string) time.Duration {
+	if m := maxAgeRe.FindStringSubmatch(header); m != nil {
+		if seconds, err := strconv.Atoi(m[1]); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return oidcCacheTTL
+}
+
+// Документ discovery провайдера; issuer в нем обязан совпадать с настроенным
+func (p *oidcProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil && time.Now().Before(p.discoveryExpiry) {
+		return p.discovery, nil
+	}
+
+	var doc oidcDiscovery
+	ttl, err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(doc.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", doc.Issuer, p.cfg.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing required endpoints")
+	}
+
+	p.discovery = &doc
+	p.discoveryExpiry = time.Now().Add(ttl)
+	return p.discovery, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// Ключ подписи по kid. Ключи кэшируются; при неизвестном kid (ротация у провайдера)
+// загружаются заново, но не чаще oidcJWKSMinRefresh.
+func (p *oidcProvider) signingKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookupKey(kid); ok && time.Now().Before(p.keysExpiry) {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcJWKSMinRefresh && time.Now().Before(p.keysExpiry) {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	ttl, err := p.getJSON(ctx, discovery.JWKSURI, &set)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping OIDC key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.keysExpiry = p.keysFetched.Add(ttl)
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// Без kid подходит только единственный ключ в наборе
+func (p *oidcProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// Claims из ID-токена
+type oidcClaims map[string]interface{}
+
+func (c oidcClaims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Значение claim как список строк: провайдеры отдают и строку, и массив
+func (c oidcClaims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func (c oidcClaims) Time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// Некоторые провайдеры передают email_verified строкой
+func (c oidcClaims) EmailVerified() bool {
+	switch v := c["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// Проверяет подпись ID-токена (RS256 или ES256), издателя, получателя, срок и nonce
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token, nonce string) (oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	key, err := p.signingKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errInvalidToken
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return nil, errInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return nil, errInvalidToken
+		}
+	default:
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims oidcClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+
+	if strings.TrimRight(claims.String("iss"), "/") != p.cfg.Issuer {
+		return nil, errors.New("ID token issuer mismatch")
+	}
+	audience := claims.Strings("aud")
+	if !containsString(audience, p.cfg.ClientID) {
+		return nil, errors.New("ID token audience mismatch")
+	}
+	if len(audience) > 1 && claims.String("azp") != p.cfg.ClientID {
+		return nil, errors.New("ID token authorized party mismatch")
+	}
+	now := time.Now()
+	exp, ok := claims.Time("exp")
+	if !ok || now.After(exp.Add(oidcClockSkew)) {
+		return nil, errTokenExpired
+	}
+	if iat, ok := claims.Time("iat"); !ok || iat.After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("ID token issued in the future")
+	}
+	if claims.String("nonce") != nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	if claims.String("sub") == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Адрес страницы входа провайдера с параметрами PKCE
+func (p *oidcProvider) authorizationURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Обменивает код авторизации на ID-токен и проверяет его
+func (p *oidcProvider) exchangeCode(ctx context.Context, code, verifier, nonce string) (oidcClaims, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", verifier)
+	// Конфиденциальный клиент передает секрет через Basic, публичный - только client_id
+	if p.cfg.ClientSecret == "" {
+		form.Set("client_id", p.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseSize)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if tokens.Error != "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint returned no ID token (%s)", resp.Status)
+	}
+
+	return p.verifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// Находит или создает локального пользователя по claims. Пользователь привязывается
+// к паре issuer+sub; существующая учетная запись подхватывается, только если email подтвержден
+// и провайдером, и локально.
+func oidcUserFromClaims(ctx context.Context, tx *sql.Tx, cfg oidcConfig, claims oidcClaims) (*User, error) {
+	subject := claims.String("sub")
+	email := strings.TrimSpace(claims.String("email"))
+	emailVerified := email != "" && claims.EmailVerified()
+
+	var userID int
+	emailTaken := false
+	err := tx.QueryRowContext(ctx, "SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2", cfg.Issuer, subject).Scan(&userID)
+	if err == sql.ErrNoRows && emailVerified {
+		// Привязываемся только к учетной записи, владелец которой сам подтвердил адрес:
+		// иначе SSO-вход попал бы в запись, зарегистрированную на чужой email с чужим паролем
+		var localVerified bool
+		err = tx.QueryRowContext(ctx, "SELECT id, email_verified FROM users WHERE lower(email) = lower($1)", email).Scan(&userID, &localVerified)
+		if err == nil && !localVerified {
+			emailTaken = true
+			err = sql.ErrNoRows
+		}
+	}
+	if err == sql.ErrNoRows {
+		username, err := availableUsername(ctx, tx, oidcUsername(cfg, claims))
+		if err != nil {
+			return nil, err
+		}
+		// Неподтвержденный адрес не сохраняем, чтобы не занять чужой email;
+		// адрес, занятый неподтвержденной записью, новой записи тоже не достается
+		storedEmail := ""
+		if emailVerified && !emailTaken {
+			storedEmail = email
+		}
+		user, err := createUserWithTx(ctx, tx, username, storedEmail, "")
+		if err != nil {
+			return nil, err
+		}
+		if storedEmail != "" {
+			if _, err := tx.ExecContext(ctx, "UPDATE users SET email_verified = TRUE WHERE id = $1", user.ID); err != nil {
+				return nil, err
+			}
+		}
+		userID = user.ID
+		log.Printf("Created user %s from OIDC subject %s", username, subject)
+	} else if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO user_identities (issuer, subject, user_id) VALUES ($1, $2, $3) ON CONFLICT (issuer, subject) DO NOTHING",
+		cfg.Issuer, subject, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.HouseholdClaim != "" {
+		if err := syncOIDCHouseholds(ctx, tx, cfg, userID, claims.Strings(cfg.HouseholdClaim)); err != nil {
+			return nil, err
+		}
+	}
+
+	var user User
+	var storedEmail sql.NullString
+	err = tx.QueryRowContext(ctx, "SELECT id, username, email, email_verified, created_at FROM users WHERE id = $1", userID).
+		Scan(&user.ID, &user.Username, &storedEmail, &user.EmailVerified, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	user.Email = storedEmail.String
+	return &user, nil
+}
+
+func oidcUsername(cfg oidcConfig, claims oidcClaims) string {
+	if name := strings.TrimSpace(claims.String(cfg.UsernameClaim)); name != "" {
+		return name
+	}
+	if local, _, ok := strings.Cut(claims.String("email"), "@"); ok && local != "" {
+		return local
+	}
+	return "user-" + claims.String("sub")
+}
+
+// Имя, еще не занятое другим пользователем: name, name-2, name-3...
+func availableUsername(ctx context.Context, tx *sql.Tx, name string) (string, error) {
+	for i := 1; i <= 100; i++ {
+		candidate := name
+		if i > 1 {
+			candidate = fmt.Sprintf("%s-%d", name, i)
+		}
+		var taken bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)", candidate).Scan(&taken); err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+	return "", errUserExists
+}
+
+// Группы из claim становятся общими домохозяйствами. Состав таких домохозяйств
+// определяет провайдер: участник, исключенный из группы, теряет к нему доступ.
+func syncOIDCHouseholds(ctx context.Context, tx *sql.Tx, cfg oidcConfig, userID int, groups []string) error {
+	var householdIDs []int64
+	for _, group := range groups {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+		var householdID int64
+		err := tx.QueryRowContext(ctx, "INSERT INTO households (name, external_id) VALUES ($1, $1) ON CONFLICT (external_id) DO UPDATE SET external_id = EXCLUDED.external_id RETURNING id",
+			group).Scan(&householdID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO household_members (household_id, user_id, role) VALUES ($1, $2, $3) ON CONFLICT (household_id, user_id) DO NOTHING",
+			householdID, userID, cfg.HouseholdRole)
+		if err != nil {
+			return err
+		}
+		householdIDs = append(householdIDs, householdID)
+	}
+
+	_, err := tx.ExecContext(ctx, "DELETE FROM household_members m USING households h WHERE m.household_id = h.id AND m.user_id = $1 AND h.external_id IS NOT NULL AND NOT (h.id = ANY($2))",
+		userID, pq.Array(householdIDs))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE users SET default_household_id = NULL WHERE id = $1 AND default_household_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM household_members WHERE household_id = default_household_id AND user_id = $1)",
+		userID)
+	if err != nil {
+		return err
+	}
+	if len(householdIDs) > 0 {
+		_, err = tx.ExecContext(ctx, "UPDATE users SET default_household_id = $1 WHERE id = $2 AND default_household_id IS NULL", householdIDs[0], userID)
+	}
+	return err
+}
+
+// Начинает вход: сохраняет state, nonce и PKCE verifier и перенаправляет к провайдеру
+func oidcLogin(c *gin.Context) {
+	if oidc == nil {
+		respondWithError(c, http.StatusNotFound, errOIDCNotConfigured.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	state, stateHash, err := newSecretToken()
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	nonce, _, err := newSecretToken()
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	verifier, _, err := newSecretToken()
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	authURL, err := oidc.authorizationURL(ctx, state, nonce, verifier)
+	if err != nil {
+		respondWithError(c, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM oidc_login_states WHERE expires_at < NOW()"); err != nil {
+		log.Printf("Error deleting expired OIDC states: %v", err)
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO oidc_login_states (state_hash, code_verifier, nonce, expires_at) VALUES ($1, $2, $3, NOW() + $4::interval)",
+		stateHash, verifier, nonce, fmt.Sprintf("%d seconds", int(oidcStateTTL.Seconds())))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// Завершает вход: проверяет state, обменивает код и выдает собственный токен сессии
+func oidcCallback(c *gin.Context) {
+	if oidc == nil {
+		respondWithError(c, http.StatusNotFound, errOIDCNotConfigured.Error())
+		return
+	}
+	if errCode := c.Query("error"); errCode != "" {
+		respondWithError(c, http.StatusUnauthorized, strings.TrimSpace(errCode+" "+c.Query("error_description")))
+		return
+	}
+	code, state := c.Query("code"), c.Query("state")
+	if code == "" || state == "" {
+		respondWithError(c, http.StatusBadRequest, "code and state are required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// state одноразовый: удаляется при первом же использовании
+	var verifier, nonce string
+	err := db.QueryRowContext(ctx, "DELETE FROM oidc_login_states WHERE state_hash = $1 AND expires_at > NOW() RETURNING code_verifier, nonce",
+		hashSecretToken(state)).Scan(&verifier, &nonce)
+	if err == sql.ErrNoRows {
+		respondWithError(c, http.StatusBadRequest, "Invalid or expired login state")
+		return
+	}
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	claims, err := oidc.exchangeCode(ctx, code, verifier, nonce)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		respondWithError(c, http.StatusUnauthorized, "Single sign-on failed")
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := oidcUserFromClaims(ctx, tx, oidc.cfg, claims)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	token, err := issueToken(user.ID, defaultTokenTTL)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data: LoginResponse{
+			Token:     token,
+			ExpiresAt: time.Now().Add(defaultTokenTTL),
+			User:      *user,
+		},
+	})
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testOIDCClientID = "expense-tracker"
+
+// Поддельный провайдер OpenID Connect: discovery, JWKS и token endpoint.
+// Код авторизации выдает authorize, имитируя согласие пользователя у провайдера.
+type mockOIDCProvider struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	rsaKey   *rsa.PrivateKey
+	rsaKid   string
+	ecKey    *ecdsa.PrivateKey
+	codes    map[string]mockAuthCode
+	jwksHits int
+}
+
+type mockAuthCode struct {
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	m := &mockOIDCProvider{
+		rsaKey: generateRSAKey(t),
+		rsaKid: "rsa-1",
+		codes:  make(map[string]mockAuthCode),
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ecKey = ecKey
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", m.serveJWKS)
+	mux.HandleFunc("/token", m.serveToken)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func generateRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func (m *mockOIDCProvider) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jwksHits++
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	keys := []jsonWebKey{
+		{
+			Kty: "RSA", Kid: m.rsaKid, Use: "sig",
+			N: b64(m.rsaKey.N.Bytes()),
+			E: b64(big.NewInt(int64(m.rsaKey.E)).Bytes()),
+		},
+		{
+			Kty: "EC", Kid: "ec-1", Use: "sig", Crv: "P-256",
+			X: b64(m.ecKey.X.FillBytes(make([]byte, 32))),
+			Y: b64(m.ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+		// Ключ шифрования не должен использоваться для проверки подписи
+		{Kty: "RSA", Kid: "enc-1", Use: "enc", N: b64(m.rsaKey.N.Bytes()), E: "AQAB"},
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (m *mockOIDCProvider) serveToken(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError("invalid_request")
+		return
+	}
+	if r.PostForm.Get("client_id") != testOIDCClientID {
+		tokenError("invalid_client")
+		return
+	}
+
+	// Код одноразовый, как требует RFC 6749
+	m.mu.Lock()
+	code, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+	if !ok {
+		tokenError("invalid_grant")
+		return
+	}
+	if pkceChallenge(r.PostForm.Get("code_verifier")) != code.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	claims := code.claims
+	claims["nonce"] = code.nonce
+	json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(claims)})
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Провайдер приложения, настроенный на поддельный
+func (m *mockOIDCProvider) provider() *oidcProvider {
+	return newOIDCProvider(oidcConfig{
+		Issuer:         m.URL,
+		ClientID:       testOIDCClientID,
+		RedirectURL:    "http://app.test/api/auth/oidc/callback",
+		Scopes:         []string{"openid", "email", "profile"},
+		UsernameClaim:  "preferred_username",
+		HouseholdClaim: "groups",
+		HouseholdRole:  roleEditor,
+	}, m.Client())
+}
+
+func (m *mockOIDCProvider) claims(nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":   m.URL,
+		"aud":   testOIDCClientID,
+		"sub":   "subject-1",
+		"nonce": nonce,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+	}
+}
+
+func (m *mockOIDCProvider) sign(claims map[string]interface{}) string {
+	return signRS256(m.rsaKey, m.rsaKid, claims)
+}
+
+// Разбирает адрес входа и выдает код, привязанный к его code_challenge и nonce
+func (m *mockOIDCProvider) authorize(t *testing.T, authURL string, claims map[string]interface{}) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("code_challenge_method = %q, want S256", q.Get("code_challenge_method"))
+	}
+	code, _, err := newSecretToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.codes[code] = mockAuthCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+	m.mu.Unlock()
+	return code
+}
+
+func encodeJWTPart(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signRS256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeJWTPart(map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeJWTPart(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func signES256(key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeJWTPart(map[string]string{"alg": "ES256", "kid": kid}) + "." + encodeJWTPart(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	p := m.provider()
+	otherKey := generateRSAKey(t)
+	const nonce = "nonce-1"
+
+	withClaims := func(change func(map[string]interface{})) string {
+		claims := m.claims(nonce)
+		change(claims)
+		return m.sign(claims)
+	}
+	tampered := func() string {
+		parts := strings.Split(m.sign(m.claims(nonce)), ".")
+		claims := m.claims(nonce)
+		claims["sub"] = "someone-else"
+		return parts[0] + "." + encodeJWTPart(claims) + "." + parts[2]
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid RS256", m.sign(m.claims(nonce)), false},
+		{"valid ES256", signES256(m.ecKey, "ec-1", m.claims(nonce)), false},
+		{"audience list with azp", withClaims(func(c map[string]interface{}) {
+			c["aud"] = []string{"other-client", testOIDCClientID}
+			c["azp"] = testOIDCClientID
+		}), false},
+		{"issuer with trailing slash", withClaims(func(c map[string]interface{}) { c["iss"] = m.URL + "/" }), false},
+		{"expired within clock skew", withClaims(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-oidcClockSkew / 2).Unix()
+		}), false},
+
+		{"signed by another key", signRS256(otherKey, m.rsaKid, m.claims(nonce)), true},
+		{"tampered payload", tampered(), true},
+		{"RSA key used for ES256", func() string {
+			parts := strings.Split(m.sign(m.claims(nonce)), ".")
+			return encodeJWTPart(map[string]string{"alg": "ES256", "kid": m.rsaKid}) + "." + parts[1] + "." + parts[2]
+		}(), true},
+		{"alg none", encodeJWTPart(map[string]string{"alg": "none", "kid": m.rsaKid}) + "." + encodeJWTPart(m.claims(nonce)) + ".", true},
+		{"encryption key", signRS256(m.rsaKey, "enc-1", m.claims(nonce)), true},
+		{"unknown kid", signRS256(m.rsaKey, "missing", m.claims(nonce)), true},
+		{"not a JWT", "abc.def", true},
+		{"wrong issuer", withClaims(func(c map[string]interface{}) { c["iss"] = "https://evil.test" }), true},
+		{"wrong audience", withClaims(func(c map[string]interface{}) { c["aud"] = "other-client" }), true},
+		{"audience list without azp", withClaims(func(c map[string]interface{}) {
+			c["aud"] = []string{"other-client", testOIDCClientID}
+		}), true},
+		{"expired", withClaims(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-2 * oidcClockSkew).Unix()
+		}), true},
+		{"no exp", withClaims(func(c map[string]interface{}) { delete(c, "exp") }), true},
+		{"issued in the future", withClaims(func(c map[string]interface{}) {
+			c["iat"] = time.Now().Add(2 * oidcClockSkew).Unix()
+		}), true},
+		{"wrong nonce", withClaims(func(c map[string]interface{}) { c["nonce"] = "replayed" }), true},
+		{"no nonce", withClaims(func(c map[string]interface{}) { delete(c, "nonce") }), true},
+		{"no subject", withClaims(func(c map[string]interface{}) { delete(c, "sub") }), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := p.verifyIDToken(context.Background(), tt.token, nonce)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("verifyIDToken accepted the token: %v", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyIDToken: %v", err)
+			}
+			if claims.String("sub") != "subject-1" {
+				t.Errorf("sub = %q, want subject-1", claims.String("sub"))
+			}
+		})
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	p := m.provider()
+	ctx := context.Background()
+
+	if _, err := p.verifyIDToken(ctx, m.sign(m.claims("n")), "n"); err != nil {
+		t.Fatalf("verifyIDToken: %v", err)
+	}
+
+	// Провайдер сменил ключ; неизвестный kid сразу после загрузки не вызывает повторный запрос
+	m.mu.Lock()
+	m.rsaKey = generateRSAKey(t)
+	m.rsaKid = "rsa-2"
+	m.mu.Unlock()
+	if _, err := p.verifyIDToken(ctx, m.sign(m.claims("n")), "n"); err == nil {
+		t.Fatal("unknown kid accepted before JWKS refresh")
+	}
+	if m.jwksHits != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", m.jwksHits)
+	}
+
+	p.mu.Lock()
+	p.keysFetched = time.Now().Add(-2 * oidcJWKSMinRefresh)
+	p.mu.Unlock()
+	if _, err := p.verifyIDToken(ctx, m.sign(m.claims("n")), "n"); err != nil {
+		t.Fatalf("verifyIDToken after rotation: %v", err)
+	}
+	if m.jwksHits != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2", m.jwksHits)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	p := m.provider()
+	p.cfg.Issuer = "https://other-issuer.test"
+	if _, err := p.authorizationURL(context.Background(), "state", "nonce", "verifier"); err == nil {
+		t.Fatal("discovery with a different issuer was accepted")
+	}
+}
+
+func TestAuthorizationURLUsesPKCE(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	p := m.provider()
+
+	authURL, err := p.authorizationURL(context.Background(), "state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatalf("authorizationURL: %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != m.URL+"/authorize" {
+		t.Errorf("endpoint = %s, want %s/authorize", got, m.URL)
+	}
+	q := u.Query()
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testOIDCClientID,
+		"redirect_uri":          "http://app.test/api/auth/oidc/callback",
+		"scope":                 "openid email profile",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        pkceChallenge("verifier-1"),
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if q.Get(name) != value {
+			t.Errorf("%s = %q, want %q", name, q.Get(name), value)
+		}
+	}
+	if q.Get("code_verifier") != "" {
+		t.Error("code_verifier leaked into the authorization URL")
+	}
+}
+
+func TestExchangeCode(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	p := m.provider()
+	ctx := context.Background()
+
+	login := func(verifier, nonce string) string {
+		authURL, err := p.authorizationURL(ctx, "state", nonce, verifier)
+		if err != nil {
+			t.Fatalf("authorizationURL: %v", err)
+		}
+		return m.authorize(t, authURL, m.claims(""))
+	}
+
+	t.Run("valid verifier", func(t *testing.T) {
+		code := login("verifier-1", "nonce-1")
+		claims, err := p.exchangeCode(ctx, code, "verifier-1", "nonce-1")
+		if err != nil {
+			t.Fatalf("exchangeCode: %v", err)
+		}
+		if claims.String("nonce") != "nonce-1" {
+			t.Errorf("nonce = %q, want nonce-1", claims.String("nonce"))
+		}
+
+		// Повторный обмен того же кода провайдер отклоняет
+		if _, err := p.exchangeCode(ctx, code, "verifier-1", "nonce-1"); err == nil {
+			t.Fatal("authorization code was accepted twice")
+		}
+	})
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		code := login("verifier-2", "nonce-2")
+		if _, err := p.exchangeCode(ctx, code, "intercepted", "nonce-2"); err == nil {
+			t.Fatal("code was exchanged without the matching PKCE verifier")
+		}
+	})
+
+	t.Run("nonce from another login", func(t *testing.T) {
+		code := login("verifier-3", "nonce-3")
+		if _, err := p.exchangeCode(ctx, code, "verifier-3", "nonce-other"); err == nil {
+			t.Fatal("ID token with a foreign nonce was accepted")
+		}
+	})
+}
+
+// Полный вход через обработчики: state действует только один раз
+func TestOIDCCallbackStateIsSingleUse(t *testing.T) {
+	requireTestDB(t)
+	t.Setenv("JWT_SECRET", strings.Repeat("s", 32))
+	gin.SetMode(gin.TestMode)
+
+	m := newMockOIDCProvider(t)
+	previous := oidc
+	oidc = m.provider()
+	oidc.cfg.HouseholdClaim = ""
+	t.Cleanup(func() { oidc = previous })
+
+	router := gin.New()
+	router.GET("/login", oidcLogin)
+	router.GET("/callback", oidcCallback)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := get("/login")
+	if w.Code != http.StatusFound {
+		t.Fatalf("login status = %d, want 302: %s", w.Code, w.Body)
+	}
+	authURL := w.Header().Get("Location")
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := u.Query().Get("state")
+
+	claims := m.claims("")
+	claims["sub"] = uniqueName(t)
+	claims["preferred_username"] = uniqueName(t)
+	callback := func(code string) *httptest.ResponseRecorder {
+		return get("/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	}
+
+	w = callback(m.authorize(t, authURL, claims))
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Data LoginResponse `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.Token == "" || resp.Data.User.ID == 0 {
+		t.Fatalf("callback returned no session: %s", w.Body)
+	}
+	if userID, _, err := parseToken(resp.Data.Token); err != nil || userID != resp.Data.User.ID {
+		t.Fatalf("session token is for user %d (%v), want %d", userID, err, resp.Data.User.ID)
+	}
+
+	// Даже с новым кодом тот же state второй раз не принимается
+	w = callback(m.authorize(t, authURL, claims))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("reused state: status = %d, want 400: %s", w.Code, w.Body)
+	}
+
+	w = get("/callback?code=x&state=unknown")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown state: status = %d, want 400", w.Code)
+	}
+}
+
+func TestSyncOIDCHouseholds(t *testing.T) {
+	ctx, tx := testTx(t)
+	user, personalID := createTestUser(t, ctx, tx)
+	cfg := oidcConfig{HouseholdRole: roleViewer}
+	groupA, groupB := uniqueName(t)+"-a", uniqueName(t)+"-b"
+
+	memberships := func(userID int) map[string]string {
+		t.Helper()
+		rows, err := tx.QueryContext(ctx, "SELECT COALESCE(h.external_id, 'personal'), m.role FROM household_members m JOIN households h ON h.id = m.household_id WHERE m.user_id = $1", userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		result := make(map[string]string)
+		for rows.Next() {
+			var name, role string
+			if err := rows.Scan(&name, &role); err != nil {
+				t.Fatal(err)
+			}
+			result[name] = role
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	defaultHousehold := func(userID int) sql.NullInt64 {
+		t.Helper()
+		var id sql.NullInt64
+		if err := tx.QueryRowContext(ctx, "SELECT default_household_id FROM users WHERE id = $1", userID).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	householdID := func(externalID string) int64 {
+		t.Helper()
+		var id int64
+		if err := tx.QueryRowContext(ctx, "SELECT id FROM households WHERE external_id = $1", externalID).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	syncGroups := func(userID int, groups ...string) {
+		t.Helper()
+		if err := syncOIDCHouseholds(ctx, tx, cfg, userID, groups); err != nil {
+			t.Fatalf("syncOIDCHouseholds(%v): %v", groups, err)
+		}
+	}
+
+	syncGroups(user.ID, groupA, " ", groupB)
+	got := memberships(user.ID)
+	want := map[string]string{"personal": roleOwner, groupA: roleViewer, groupB: roleViewer}
+	if len(got) != len(want) {
+		t.Fatalf("memberships = %v, want %v", got, want)
+	}
+	for name, role := range want {
+		if got[name] != role {
+			t.Errorf("role in %s = %q, want %q", name, got[name], role)
+		}
+	}
+	if id := defaultHousehold(user.ID); id.Int64 != int64(personalID) {
+		t.Errorf("default household changed to %v, want personal %d", id, personalID)
+	}
+
+	// Второй участник группы попадает в то же домохозяйство, а не в новое
+	other, _ := createTestUser(t, ctx, tx)
+	syncGroups(other.ID, groupB)
+	var count int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM household_members WHERE household_id = $1", householdID(groupB)).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("members of %s = %d, want 2", groupB, count)
+	}
+
+	// Исключение из группы у провайдера снимает доступ; личное домохозяйство остается
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET default_household_id = $1 WHERE id = $2", householdID(groupA), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	syncGroups(user.ID, groupB)
+	got = memberships(user.ID)
+	if _, ok := got[groupA]; ok {
+		t.Errorf("still a member of %s after leaving the group", groupA)
+	}
+	if got["personal"] != roleOwner || got[groupB] != roleViewer {
+		t.Errorf("memberships = %v", got)
+	}
+	if id := defaultHousehold(user.ID); id.Int64 != householdID(groupB) {
+		t.Errorf("default household = %v, want %s", id, groupB)
+	}
+
+	syncGroups(user.ID)
+	got = memberships(user.ID)
+	if len(got) != 1 || got["personal"] != roleOwner {
+		t.Errorf("memberships after leaving all groups = %v", got)
+	}
+}
+
+// Вход через провайдера подхватывает локальную учетную запись только с подтвержденным адресом
+func TestOIDCUserLinksOnlyVerifiedLocalEmail(t *testing.T) {
+	ctx, tx := testTx(t)
+	cfg := oidcConfig{Issuer: "https://idp.example.com", UsernameClaim: "preferred_username"}
+	name := uniqueName(t)
+
+	verified, err := createUserWithTx(ctx, tx, name+"-verified", name+"-verified@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET email_verified = TRUE WHERE id = $1", verified.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Запись, зарегистрированная на чужой адрес без подтверждения
+	squatter, err := createUserWithTx(ctx, tx, name+"-squatter", name+"-victim@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := oidcUserFromClaims(ctx, tx, cfg, oidcClaims{"sub": name + "-1", "email": strings.ToUpper(verified.Email), "email_verified": true})
+	if err != nil {
+		t.Fatalf("oidcUserFromClaims: %v", err)
+	}
+	if user.ID != verified.ID {
+		t.Errorf("verified email: signed in as %d, want linked user %d", user.ID, verified.ID)
+	}
+
+	user, err = oidcUserFromClaims(ctx, tx, cfg, oidcClaims{"sub": name + "-2", "email": squatter.Email, "email_verified": true, "preferred_username": name + "-victim"})
+	if err != nil {
+		t.Fatalf("oidcUserFromClaims: %v", err)
+	}
+	if user.ID == squatter.ID {
+		t.Fatal("SSO identity was linked to an account with an unverified email")
+	}
+	if user.Email != "" {
+		t.Errorf("new user email = %q, want none while the address is held by another account", user.Email)
+	}
+
+	var linked int
+	if err := tx.QueryRowContext(ctx, "SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2", cfg.Issuer, name+"-2").Scan(&linked); err != nil {
+		t.Fatal(err)
+	}
+	if linked != user.ID {
+		t.Errorf("identity linked to %d, want %d", linked, user.ID)
+	}
+}
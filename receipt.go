@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Источник расходов, созданных по QR-коду кассового чека
+const receiptSource = "receipt"
+
+// Признак расчета "приход" - обычная покупка
+const receiptTypeIncome = 1
+
+// Данные фискального чека из QR-кода
+type FiscalReceipt struct {
+	Date  time.Time `json:"date"`
+	Total float64   `json:"total"`
+	FN    string    `json:"fn"`
+	FD    string    `json:"fd"`
+	FP    string    `json:"fp"`
+	Type  int       `json:"type"`
+}
+
+// Ключ для проверки дубликатов: номер ФН, номер ФД и фискальный признак
+func (r *FiscalReceipt) externalID() string {
+	return r.FN + ":" + r.FD + ":" + r.FP
+}
+
+// QR - текст, закодированный в QR-коде чека. Изображения сервер не распознает:
+// код считывает сканер на клиенте и присылает полученную строку.
+type ReceiptRequest struct {
+	QR          string `json:"qr" binding:"required"`
+	CategoryID  int    `json:"categoryId"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Разбор строки QR-кода вида t=20260101T1200&s=1234.00&fn=...&i=...&fp=...&n=1.
+// Время в чеке местное, без смещения: оно относится к часовому поясу loc.
+func parseFiscalQR(qr string, loc *time.Location) (*FiscalReceipt, error) {
+	qr = strings.TrimSpace(qr)
+	if strings.HasPrefix(qr, "data:") {
+		return nil, errors.New("QR images are not supported: send the text decoded from the QR code")
+	}
+	values, err := url.ParseQuery(qr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid QR string: %v", err)
+	}
+
+	var receipt FiscalReceipt
+
+	t := values.Get("t")
+	if t == "" {
+		return nil, errors.New("receipt date (t) is missing")
+	}
+	// Секунды в QR-коде указываются не всегда
+	for _, layout := range []string{"20060102T150405", "20060102T1504"} {
+		receipt.Date, err = time.ParseInLocation(layout, t, loc)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid receipt date: %s", t)
+	}
+
+	s := values.Get("s")
+	if s == "" {
+		return nil, errors.New("receipt total (s) is missing")
+	}
+	receipt.Total, err = strconv.ParseFloat(s, 64)
+	if err != nil || receipt.Total <= 0 {
+		return nil, fmt.Errorf("invalid receipt total: %s", s)
+	}
+
+	receipt.FN = values.Get("fn")
+	receipt.FD = values.Get("i")
+	receipt.FP = values.Get("fp")
+	if receipt.FN == "" || receipt.FD == "" || receipt.FP == "" {
+		return nil, errors.New("fiscal identifiers (fn, i, fp) are required")
+	}
+
+	receipt.Type = receiptTypeIncome
+	if n := values.Get("n"); n != "" {
+		receipt.Type, err = strconv.Atoi(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid receipt type: %s", n)
+		}
+	}
+
+	return &receipt, nil
+}
+
+// Проверка нарушения уникального индекса PostgreSQL
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func createExpenseFromReceipt(c *gin.Context) {
+	var req ReceiptRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	householdID := currentHouseholdID(c)
+	loc, err := householdLocation(ctx, db, householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	receipt, err := parseFiscalQR(req.QR, loc)
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Возвраты и расходные чеки расходами не являются
+	if receipt.Type != receiptTypeIncome {
+		respondWithError(c, http.StatusBadRequest, fmt.Sprintf("Unsupported receipt type: %d", receipt.Type))
+		return
+	}
+
+	exp := Expense{
+		CategoryID:  req.CategoryID,
+		Name:        req.Name,
+		Amount:      receipt.Total,
+		Date:        receipt.Date,
+		Description: req.Description,
+	}
+	if exp.Name == "" {
+		exp.Name = "Кассовый чек"
+	}
+	if exp.Description == "" {
+		exp.Description = fmt.Sprintf("ФН %s, ФД %s, ФП %s", receipt.FN, receipt.FD, receipt.FP)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	// Без явной категории ее подбирают правила автокатегоризации
+	rules, err := loadRules(ctx, tx, householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	applyRules(rules, &exp, false)
+	if exp.CategoryID == 0 {
+		respondWithError(c, http.StatusBadRequest, "categoryId is required: no categorization rule matched")
+		return
+	}
+	ok, err := categoryInHousehold(ctx, tx, householdID, exp.CategoryID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		respondWithError(c, http.StatusBadRequest, "Category not found")
+		return
+	}
+
+	// Повторно загруженный чек не должен создавать второй расход
+	var existingID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM expenses WHERE household_id = $1 AND source = $2 AND external_id = $3",
+		householdID, receiptSource, receipt.externalID()).Scan(&existingID)
+	if err == nil {
+		respondWithError(c, http.StatusConflict, fmt.Sprintf("Receipt already imported as expense %d", existingID))
+		return
+	}
+	if err != sql.ErrNoRows {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, "INSERT INTO expenses (category_id, name, amount, date, description, source, external_id, tags, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+		exp.CategoryID, exp.Name, exp.Amount, exp.Date, exp.Description, receiptSource, receipt.externalID(), encodeTags(exp.Tags), householdID).Scan(&id)
+	if err != nil {
+		// Одновременная загрузка того же чека
+		if isUniqueViolation(err) {
+			respondWithError(c, http.StatusConflict, "Receipt already imported")
+			return
+		}
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	exp.ID = id
+
+	err = updateMonthlyStatsWithTx(ctx, tx, exp.CategoryID, exp.Amount, exp.Date)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := recordAudit(ctx, tx, auditActorFrom(c), auditCreate, auditEntityExpense, exp.ID, nil, exp); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	classifier.Add(householdID, &exp)
+
+	c.JSON(http.StatusCreated, Response{
+		Status:  "success",
+		Message: "Expense created from receipt",
+		Data: map[string]interface{}{
+			"expense": exp,
+			"receipt": receipt,
+		},
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFiscalQR(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Vladivostok")
+	if err != nil {
+		t.Skip("time zone database is not available")
+	}
+	tests := []struct {
+		qr      string
+		want    FiscalReceipt
+		wantErr string
+	}{
+		{
+			qr:   "t=20260101T1200&s=1234.00&fn=9999078900004792&i=12345&fp=3522207165&n=1",
+			want: FiscalReceipt{Date: time.Date(2026, time.January, 1, 12, 0, 0, 0, loc), Total: 1234, FN: "9999078900004792", FD: "12345", FP: "3522207165", Type: 1},
+		},
+		{
+			qr:   "  t=20260131T235959&s=99.90&fn=1&i=2&fp=3\n",
+			want: FiscalReceipt{Date: time.Date(2026, time.January, 31, 23, 59, 59, 0, loc), Total: 99.9, FN: "1", FD: "2", FP: "3", Type: 1},
+		},
+		{
+			qr:   "fp=3&i=2&fn=1&s=10&t=20260101T0800&n=2",
+			want: FiscalReceipt{Date: time.Date(2026, time.January, 1, 8, 0, 0, 0, loc), Total: 10, FN: "1", FD: "2", FP: "3", Type: 2},
+		},
+		{qr: "s=10&fn=1&i=2&fp=3", wantErr: "receipt date (t) is missing"},
+		{qr: "t=2026-01-01&s=10&fn=1&i=2&fp=3", wantErr: "invalid receipt date"},
+		{qr: "t=20260101T1200&fn=1&i=2&fp=3", wantErr: "receipt total (s) is missing"},
+		{qr: "t=20260101T1200&s=0&fn=1&i=2&fp=3", wantErr: "invalid receipt total"},
+		{qr: "t=20260101T1200&s=12,50&fn=1&i=2&fp=3", wantErr: "invalid receipt total"},
+		{qr: "t=20260101T1200&s=10&fn=1&fp=3", wantErr: "fiscal identifiers"},
+		{qr: "t=20260101T1200&s=10&fn=1&i=2&fp=3&n=x", wantErr: "invalid receipt type"},
+		{qr: "t=%zz", wantErr: "invalid QR string"},
+		{qr: "data:image/png;base64,iVBORw0KGgo=", wantErr: "QR images are not supported"},
+	}
+	for _, tt := range tests {
+		got, err := parseFiscalQR(tt.qr, loc)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseFiscalQR(%q): error = %v, want %q", tt.qr, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseFiscalQR(%q): %v", tt.qr, err)
+			continue
+		}
+		if !got.Date.Equal(tt.want.Date) || got.Total != tt.want.Total || got.FN != tt.want.FN || got.FD != tt.want.FD || got.FP != tt.want.FP || got.Type != tt.want.Type {
+			t.Errorf("parseFiscalQR(%q) = %+v, want %+v", tt.qr, *got, tt.want)
+		}
+		if id := got.externalID(); id != tt.want.FN+":"+tt.want.FD+":"+tt.want.FP {
+			t.Errorf("externalID = %q", id)
+		}
+	}
+}
+
+func TestCreateExpenseFromReceiptRejectsDuplicates(t *testing.T) {
+	var user *User
+	var householdID, categoryID int
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, householdID = createTestUser(t, ctx, tx)
+		categoryID = createTestCategory(t, ctx, tx, householdID, "Groceries")
+	})
+	router := testRouter(user.ID, householdID)
+	router.POST("/expenses/receipt", createExpenseFromReceipt)
+
+	req := ReceiptRequest{QR: "t=20260101T1200&s=1234.00&fn=9999078900004792&i=12345&fp=3522207165&n=1", CategoryID: categoryID}
+	if w := doJSON(router, http.MethodPost, "/expenses/receipt", req); w.Code != http.StatusCreated {
+		t.Fatalf("first upload: status = %d, want 201: %s", w.Code, w.Body)
+	}
+	if w := doJSON(router, http.MethodPost, "/expenses/receipt", req); w.Code != http.StatusConflict {
+		t.Errorf("second upload: status = %d, want 409: %s", w.Code, w.Body)
+	}
+	refund := ReceiptRequest{QR: "t=20260101T1200&s=100&fn=1&i=2&fp=3&n=2", CategoryID: categoryID}
+	if w := doJSON(router, http.MethodPost, "/expenses/receipt", refund); w.Code != http.StatusBadRequest {
+		t.Errorf("refund receipt: status = %d, want 400: %s", w.Code, w.Body)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM expenses WHERE household_id = $1", householdID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expenses = %d, want 1", count)
+	}
+	assertMonthlyStats(t, loadTestMonthlyStats(t, context.Background(), db, categoryID), map[string]float64{"2026-01": 1234})
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Правило автокатегоризации. Все заданные условия должны выполняться одновременно;
+// правила проверяются по возрастанию приоритета, затем по ID.
+type CategoryRule struct {
+	ID                  int      `json:"id"`
+	Name                string   `json:"name" binding:"required"`
+	Priority            int      `json:"priority"`
+	NameContains        string   `json:"nameContains,omitempty"`
+	DescriptionContains string   `json:"descriptionContains,omitempty"`
+	Pattern             string   `json:"pattern,omitempty"`
+	MinAmount           *float64 `json:"minAmount,omitempty"`
+	MaxAmount           *float64 `json:"maxAmount,omitempty"`
+	Payee               string   `json:"payee,omitempty"`
+	CategoryID          int      `json:"categoryId,omitempty"`
+	Tags                []string `json:"tags,omitempty"`
+	Enabled             bool     `json:"enabled"`
+
+	re *regexp.Regexp
+}
+
+// Изменение, которое правила вносят в существующий расход
+type RuleChange struct {
+	ExpenseID     int      `json:"expenseId"`
+	Name          string   `json:"name"`
+	RuleID        int      `json:"ruleId,omitempty"`
+	OldCategoryID int      `json:"oldCategoryId"`
+	NewCategoryID int      `json:"newCategoryId"`
+	OldTags       []string `json:"oldTags"`
+	NewTags       []string `json:"newTags"`
+}
+
+const ruleColumns = "id, name, priority, name_contains, description_contains, pattern, min_amount, max_amount, payee, category_id, tags, enabled"
+
+func encodeTags(tags []string) []byte {
+	if tags == nil {
+		tags = []string{}
+	}
+	data, _ := json.Marshal(tags)
+	return data
+}
+
+func decodeTags(data []byte) []string {
+	var tags []string
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &tags); err != nil {
+			log.Printf("Error parsing tags: %v", err)
+		}
+	}
+	return tags
+}
+
+// Объединение тегов без повторов (без учета регистра), порядок сохраняется
+func mergeTags(tags []string, extra []string) []string {
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		seen[strings.ToLower(tag)] = true
+	}
+	for _, tag := range extra {
+		if !seen[strings.ToLower(tag)] {
+			seen[strings.ToLower(tag)] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func equalTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *CategoryRule) validate() error {
+	if r.NameContains == "" && r.DescriptionContains == "" && r.Pattern == "" &&
+		r.MinAmount == nil && r.MaxAmount == nil && r.Payee == "" {
+		return errors.New("rule must have at least one condition")
+	}
+	if r.CategoryID == 0 && len(r.Tags) == 0 {
+		return errors.New("rule must assign a category or tags")
+	}
+	if r.MinAmount != nil && r.MaxAmount != nil && *r.MinAmount > *r.MaxAmount {
+		return errors.New("minAmount must not exceed maxAmount")
+	}
+	return r.compile()
+}
+
+func (r *CategoryRule) compile() error {
+	r.re = nil
+	if r.Pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	r.re = re
+	return nil
+}
+
+// Проверка условий правила; payee сравнивается с названием расхода целиком
+func (r *CategoryRule) matches(exp *Expense) bool {
+	name := strings.ToLower(exp.Name)
+	description := strings.ToLower(exp.Description)
+
+	if r.NameContains != "" && !strings.Contains(name, strings.ToLower(r.NameContains)) {
+		return false
+	}
+	if r.DescriptionContains != "" && !strings.Contains(description, strings.ToLower(r.DescriptionContains)) {
+		return false
+	}
+	if r.re != nil && !r.re.MatchString(exp.Name) && !r.re.MatchString(exp.Description) {
+		return false
+	}
+	if r.MinAmount != nil && exp.Amount < *r.MinAmount {
+		return false
+	}
+	if r.MaxAmount != nil && exp.Amount > *r.MaxAmount {
+		return false
+	}
+	if r.Payee != "" && !strings.EqualFold(strings.TrimSpace(exp.Name), strings.TrimSpace(r.Payee)) {
+		return false
+	}
+	return true
+}
+
+// Применяет правила к расходу: категорию задает первое подходящее правило с категорией
+// (существующую - только при override), теги добавляют все подходящие правила.
+// Возвращает правило, назначившее категорию.
+func applyRules(rules []CategoryRule, exp *Expense, override bool) *CategoryRule {
+	var assigned *CategoryRule
+	categorySet := exp.CategoryID != 0 && !override
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.matches(exp) {
+			continue
+		}
+		if !categorySet && rule.CategoryID != 0 {
+			exp.CategoryID = rule.CategoryID
+			categorySet = true
+			assigned = rule
+		}
+		exp.Tags = mergeTags(exp.Tags, rule.Tags)
+	}
+	return assigned
+}
+
+func scanRule(scan func(dest ...interface{}) error) (CategoryRule, error) {
+	var rule CategoryRule
+	var nameContains, descriptionContains, pattern, payee sql.NullString
+	var minAmount, maxAmount sql.NullFloat64
+	var categoryID sql.NullInt64
+	var tagsJSON []byte
+	err := scan(&rule.ID, &rule.Name, &rule.Priority, &nameContains, &descriptionContains, &pattern,
+		&minAmount, &maxAmount, &payee, &categoryID, &tagsJSON, &rule.Enabled)
+	if err != nil {
+		return rule, err
+	}
+
+	rule.NameContains = nameContains.String
+	rule.DescriptionContains = descriptionContains.String
+	rule.Pattern = pattern.String
+	rule.Payee = payee.String
+	rule.CategoryID = int(categoryID.Int64)
+	if minAmount.Valid {
+		rule.MinAmount = &minAmount.Float64
+	}
+	if maxAmount.Valid {
+		rule.MaxAmount = &maxAmount.Float64
+	}
+	rule.Tags = decodeTags(tagsJSON)
+	return rule, nil
+}
+
+func queryRules(ctx context.Context, q queryer, householdID int, onlyEnabled bool) ([]CategoryRule, error) {
+	query := "SELECT " + ruleColumns + " FROM category_rules WHERE household_id = $1"
+	// Правило с категорией из корзины не применяется, пока ее не восстановят
+	if onlyEnabled {
+		query += " AND enabled AND NOT EXISTS (SELECT 1 FROM categories c WHERE c.id = category_rules.category_id AND c.deleted_at IS NOT NULL)"
+	}
+	rows, err := q.QueryContext(ctx, query+" ORDER BY priority, id", householdID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []CategoryRule{}
+	for rows.Next() {
+		rule, err := scanRule(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// Включенные правила в порядке проверки, с откомпилированными шаблонами
+func loadRules(ctx context.Context, q queryer, householdID int) ([]CategoryRule, error) {
+	rules, err := queryRules(ctx, q, householdID, true)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", rules[i].ID, err)
+		}
+	}
+	return rules, nil
+}
+
+func nullFloat(f *float64) sql.NullFloat64 {
+	if f == nil {
+		return sql.NullFloat64{}
+	}
+	return sql.NullFloat64{Float64: *f, Valid: true}
+}
+
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
+
+// Правило может ссылаться только на категорию того же домохозяйства; при ошибке уже отвечает клиенту
+func checkRuleCategory(c *gin.Context, ctx context.Context, householdID, categoryID int) bool {
+	if categoryID == 0 {
+		return true
+	}
+	ok, err := categoryInHousehold(ctx, db, householdID, categoryID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if !ok {
+		respondWithError(c, http.StatusBadRequest, "Category not found")
+		return false
+	}
+	return true
+}
+
+// Нарушение внешнего ключа: ссылка на несуществующую категорию
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+func getRules(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rules, err := queryRules(ctx, db, currentHouseholdID(c), false)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data:   rules,
+	})
+}
+
+func createRule(c *gin.Context) {
+	rule := CategoryRule{Enabled: true}
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := rule.validate(); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	householdID := currentHouseholdID(c)
+	if !checkRuleCategory(c, ctx, householdID, rule.CategoryID) {
+		return
+	}
+
+	err := db.QueryRowContext(ctx, "INSERT INTO category_rules (name, priority, name_contains, description_contains, pattern, min_amount, max_amount, payee, category_id, tags, enabled, household_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id",
+		rule.Name, rule.Priority, nullString(rule.NameContains), nullString(rule.DescriptionContains), nullString(rule.Pattern),
+		nullFloat(rule.MinAmount), nullFloat(rule.MaxAmount), nullString(rule.Payee), nullInt(rule.CategoryID), encodeTags(rule.Tags), rule.Enabled, householdID).Scan(&rule.ID)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			respondWithError(c, http.StatusBadRequest, "Category not found")
+			return
+		}
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, Response{
+		Status:  "success",
+		Message: "Rule created successfully",
+		Data:    rule,
+	})
+}
+
+func updateRule(c *gin.Context) {
+	id := c.Param("id")
+	rule := CategoryRule{Enabled: true}
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := rule.validate(); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	householdID := currentHouseholdID(c)
+	if !checkRuleCategory(c, ctx, householdID, rule.CategoryID) {
+		return
+	}
+
+	err := db.QueryRowContext(ctx, "UPDATE category_rules SET name = $1, priority = $2, name_contains = $3, description_contains = $4, pattern = $5, min_amount = $6, max_amount = $7, payee = $8, category_id = $9, tags = $10, enabled = $11 WHERE id = $12 AND household_id = $13 RETURNING id",
+		rule.Name, rule.Priority, nullString(rule.NameContains), nullString(rule.DescriptionContains), nullString(rule.Pattern),
+		nullFloat(rule.MinAmount), nullFloat(rule.MaxAmount), nullString(rule.Payee), nullInt(rule.CategoryID), encodeTags(rule.Tags), rule.Enabled, id, householdID).Scan(&rule.ID)
+	if err == sql.ErrNoRows {
+		respondWithError(c, http.StatusNotFound, "Rule not found")
+		return
+	}
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			respondWithError(c, http.StatusBadRequest, "Category not found")
+			return
+		}
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Rule updated successfully",
+		Data:    rule,
+	})
+}
+
+func deleteRule(c *gin.Context) {
+	id := c.Param("id")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "DELETE FROM category_rules WHERE id = $1 AND household_id = $2", id, currentHouseholdID(c))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Rule deleted successfully",
+	})
+}
+
+// Повторное применение правил к существующим расходам.
+// Принимает фильтры списка расходов; с dryRun=true только показывает, что изменится.
+func applyRulesRetroactively(c *gin.Context) {
+	var filter ExpenseFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	householdID := currentHouseholdID(c)
+	filter.HouseholdID = householdID
+	where, args, err := filter.whereClause("")
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	dryRun := c.Query("dryRun") == "true"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	rules, err := loadRules(ctx, tx, filter.HouseholdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, category_id, name, amount, date, description, tags FROM expenses"+where+" ORDER BY id FOR UPDATE", args...)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var expenses []Expense
+	for rows.Next() {
+		var exp Expense
+		var tagsJSON []byte
+		if err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON); err != nil {
+			rows.Close()
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		exp.Tags = decodeTags(tagsJSON)
+		expenses = append(expenses, exp)
+	}
+	rows.Close()
+
+	changes := []RuleChange{}
+	var recategorized [][2]Expense
+	for _, exp := range expenses {
+		updated := exp
+		updated.Tags = append([]string(nil), exp.Tags...)
+		rule := applyRules(rules, &updated, true)
+		if updated.CategoryID == exp.CategoryID && equalTags(updated.Tags, exp.Tags) {
+			continue
+		}
+
+		change := RuleChange{
+			ExpenseID:     exp.ID,
+			Name:          exp.Name,
+			OldCategoryID: exp.CategoryID,
+			NewCategoryID: updated.CategoryID,
+			OldTags:       exp.Tags,
+			NewTags:       updated.Tags,
+		}
+		if rule != nil {
+			change.RuleID = rule.ID
+		}
+		changes = append(changes, change)
+
+		if dryRun {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE expenses SET category_id = $1, tags = $2, version = version + 1 WHERE id = $3",
+			updated.CategoryID, encodeTags(updated.Tags), exp.ID)
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := recordAudit(ctx, tx, auditActorFrom(c), auditUpdate, auditEntityExpense, exp.ID, exp, updated); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Сумма переносится в статистику новой категории
+		if updated.CategoryID != exp.CategoryID {
+			recategorized = append(recategorized, [2]Expense{exp, updated})
+			if err := updateMonthlyStatsWithTx(ctx, tx, exp.CategoryID, -exp.Amount, exp.Date); err != nil {
+				respondWithError(c, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if err := updateMonthlyStatsWithTx(ctx, tx, updated.CategoryID, exp.Amount, exp.Date); err != nil {
+				respondWithError(c, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+	}
+
+	message := fmt.Sprintf("%d expenses would change", len(changes))
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		message = fmt.Sprintf("%d expenses updated", len(changes))
+		for i := range recategorized {
+			classifier.Replace(householdID, &recategorized[i][0], &recategorized[i][1])
+		}
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: message,
+		Data:    changes,
+	})
+}
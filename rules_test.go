@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func amountPtr(v float64) *float64 { return &v }
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		name string
+		rule CategoryRule
+		exp  Expense
+		want bool
+	}{
+		{name: "name substring ignores case", rule: CategoryRule{NameContains: "ПЯТЁР"}, exp: Expense{Name: "Пятёрочка 123"}, want: true},
+		{name: "name substring missing", rule: CategoryRule{NameContains: "магнит"}, exp: Expense{Name: "Пятёрочка"}},
+		{name: "description substring", rule: CategoryRule{DescriptionContains: "uber"}, exp: Expense{Name: "Taxi", Description: "UBER *TRIP"}, want: true},
+		// Подстрока в названии не ищется в описании
+		{name: "name substring only in description", rule: CategoryRule{NameContains: "uber"}, exp: Expense{Name: "Taxi", Description: "Uber"}},
+		{name: "regex on name", rule: CategoryRule{Pattern: `^AZS-\d+$`}, exp: Expense{Name: "AZS-42"}, want: true},
+		{name: "regex on description", rule: CategoryRule{Pattern: `(?i)netflix`}, exp: Expense{Name: "Card payment", Description: "NETFLIX.COM"}, want: true},
+		{name: "regex is case sensitive", rule: CategoryRule{Pattern: `netflix`}, exp: Expense{Name: "NETFLIX"}},
+		{name: "regex anchored mismatch", rule: CategoryRule{Pattern: `^AZS-\d+$`}, exp: Expense{Name: "AZS-42 Moscow"}},
+		{name: "min amount is inclusive", rule: CategoryRule{MinAmount: amountPtr(100)}, exp: Expense{Amount: 100}, want: true},
+		{name: "below min amount", rule: CategoryRule{MinAmount: amountPtr(100)}, exp: Expense{Amount: 99.99}},
+		{name: "max amount is inclusive", rule: CategoryRule{MaxAmount: amountPtr(500)}, exp: Expense{Amount: 500}, want: true},
+		{name: "above max amount", rule: CategoryRule{MaxAmount: amountPtr(500)}, exp: Expense{Amount: 500.01}},
+		{name: "within range", rule: CategoryRule{MinAmount: amountPtr(100), MaxAmount: amountPtr(500)}, exp: Expense{Amount: 250}, want: true},
+		{name: "payee matches whole name", rule: CategoryRule{Payee: " Yandex Go "}, exp: Expense{Name: "yandex go"}, want: true},
+		{name: "payee is not a substring match", rule: CategoryRule{Payee: "Yandex"}, exp: Expense{Name: "Yandex Go"}},
+		{name: "all conditions must hold", rule: CategoryRule{NameContains: "azs", MinAmount: amountPtr(1000)}, exp: Expense{Name: "AZS-42", Amount: 500}},
+		{name: "all conditions hold", rule: CategoryRule{NameContains: "azs", Pattern: `\d+`, MinAmount: amountPtr(1000)}, exp: Expense{Name: "AZS-42", Amount: 1500}, want: true},
+	}
+	for _, tt := range tests {
+		if err := tt.rule.compile(); err != nil {
+			t.Fatalf("%s: compile: %v", tt.name, err)
+		}
+		if got := tt.rule.matches(&tt.exp); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	// Правила уже в порядке проверки, как их возвращает loadRules
+	rules := []CategoryRule{
+		{ID: 10, Priority: 0, NameContains: "azs", Tags: []string{"car"}},
+		{ID: 11, Priority: 1, NameContains: "azs", MinAmount: amountPtr(1000), CategoryID: 2, Tags: []string{"Fuel", "big"}},
+		{ID: 12, Priority: 2, NameContains: "azs", CategoryID: 3, Tags: []string{"fuel", "CAR"}},
+		{ID: 13, Priority: 3, Pattern: `^Pharmacy`, CategoryID: 4},
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		exp        Expense
+		override   bool
+		wantRule   int
+		wantCat    int
+		wantTagged []string
+	}{
+		// Первое подходящее правило с категорией побеждает, теги добавляют все
+		{name: "first rule with category wins", exp: Expense{Name: "AZS-42", Amount: 1500}, wantRule: 11, wantCat: 2, wantTagged: []string{"car", "Fuel", "big"}},
+		{name: "later rule when earlier does not match", exp: Expense{Name: "AZS-42", Amount: 500}, wantRule: 12, wantCat: 3, wantTagged: []string{"car", "fuel"}},
+		{name: "existing tags are kept", exp: Expense{Name: "AZS-42", Amount: 500, Tags: []string{"Trip", "FUEL"}}, wantRule: 12, wantCat: 3, wantTagged: []string{"Trip", "FUEL", "car"}},
+		{name: "category set without override", exp: Expense{Name: "AZS-42", Amount: 1500, CategoryID: 7}, wantCat: 7, wantTagged: []string{"car", "Fuel", "big"}},
+		{name: "category set with override", exp: Expense{Name: "AZS-42", Amount: 1500, CategoryID: 7}, override: true, wantRule: 11, wantCat: 2, wantTagged: []string{"car", "Fuel", "big"}},
+		{name: "no match", exp: Expense{Name: "Bakery", Amount: 100, CategoryID: 7}, override: true, wantCat: 7},
+		{name: "category only rule", exp: Expense{Name: "Pharmacy 36.6"}, wantRule: 13, wantCat: 4},
+	}
+	for _, tt := range tests {
+		exp := tt.exp
+		assigned := applyRules(rules, &exp, tt.override)
+		gotRule := 0
+		if assigned != nil {
+			gotRule = assigned.ID
+		}
+		if gotRule != tt.wantRule || exp.CategoryID != tt.wantCat {
+			t.Errorf("%s: rule %d, category %d; want rule %d, category %d", tt.name, gotRule, exp.CategoryID, tt.wantRule, tt.wantCat)
+		}
+		if !reflect.DeepEqual(exp.Tags, tt.wantTagged) {
+			t.Errorf("%s: tags = %q, want %q", tt.name, exp.Tags, tt.wantTagged)
+		}
+	}
+}
+
+func TestCategoryRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    CategoryRule
+		wantErr string
+	}{
+		{name: "valid", rule: CategoryRule{NameContains: "azs", CategoryID: 1}},
+		{name: "tags only", rule: CategoryRule{Payee: "Uber", Tags: []string{"taxi"}}},
+		{name: "no conditions", rule: CategoryRule{CategoryID: 1}, wantErr: "rule must have at least one condition"},
+		{name: "no action", rule: CategoryRule{NameContains: "azs"}, wantErr: "rule must assign a category or tags"},
+		{name: "inverted range", rule: CategoryRule{MinAmount: amountPtr(10), MaxAmount: amountPtr(5), CategoryID: 1}, wantErr: "minAmount must not exceed maxAmount"},
+		{name: "bad pattern", rule: CategoryRule{Pattern: "(", CategoryID: 1}, wantErr: "invalid pattern: error parsing regexp: missing closing ): `(`"},
+	}
+	for _, tt := range tests {
+		err := tt.rule.validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// Правила проверяются по возрастанию приоритета, при равном - по ID;
+// выключенные и правила с категорией из корзины не загружаются
+func TestLoadRulesOrder(t *testing.T) {
+	ctx, tx := testTx(t)
+	_, householdID := createTestUser(t, ctx, tx)
+	categoryID := createTestCategory(t, ctx, tx, householdID, "Fuel")
+	trashedID := createTestCategory(t, ctx, tx, householdID, "Old")
+	if _, err := tx.ExecContext(ctx, "UPDATE categories SET deleted_at = NOW() WHERE id = $1", trashedID); err != nil {
+		t.Fatal(err)
+	}
+
+	insert := func(name string, priority, categoryID int, enabled bool) int {
+		var id int
+		err := tx.QueryRowContext(ctx, "INSERT INTO category_rules (name, priority, name_contains, category_id, tags, enabled, household_id) VALUES ($1, $2, 'azs', $3, '[]', $4, $5) RETURNING id",
+			name, priority, categoryID, enabled, householdID).Scan(&id)
+		if err != nil {
+			t.Fatalf("insert rule: %v", err)
+		}
+		return id
+	}
+	late := insert("late", 5, categoryID, true)
+	first := insert("first", 1, categoryID, true)
+	second := insert("second", 1, categoryID, true)
+	insert("disabled", 0, categoryID, false)
+	insert("trashed", 0, trashedID, true)
+
+	rules, err := loadRules(ctx, tx, householdID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, rule := range rules {
+		ids = append(ids, rule.ID)
+	}
+	if want := []int{first, second, late}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("rules = %v, want %v", ids, want)
+	}
+
+	exp := Expense{Name: "AZS-42"}
+	if rule := applyRules(rules, &exp, false); rule == nil || rule.ID != first {
+		t.Errorf("assigned rule = %+v, want %d", rule, first)
+	}
+}
@@ -29,6 +29,21 @@ import theme from './theme';
 
 const API_URL = process.env.REACT_APP_API_URL || 'http://localhost:8081/api';
 
+// 412: запись изменили в другом окне или другим участником, версия устарела
+const errorDescription = (error, fallback) =>
+  error.response && error.response.status === 412
+    ? 'Данные изменились, пока вы их редактировали. Обновите страницу и повторите.'
+    : fallback;
+
+// Токен доступа к API (выдается командой issue-token)
+axios.interceptors.request.use((config) => {
+  const token = localStorage.getItem('authToken');
+  if (token) {
+    config.headers.Authorization = `Bearer ${token}`;
+  }
+  return config;
+});
+
 function App() {
   const [categories, setCategories] = useState([]);
   const [selectedCategory, setSelectedCategory] = useState(null);
@@ -189,7 +204,7 @@ function App() {
       console.error('Error submitting category:', error);
       toast({
         title: 'Ошибка',
-        description: 'Не удалось сохранить категорию',
+        description: errorDescription(error, 'Не удалось сохранить категорию'),
         status: 'error',
         duration: 3000,
         isClosable: true,
@@ -202,9 +217,13 @@ function App() {
     onCategoryFormClose();
   };
 
-  const handleCategoryDelete = async (categoryId) => {
+  const handleCategoryDelete = async (categoryId, force = false) => {
     try {
-      const response = await axios.delete(`${API_URL}/categories/${categoryId}`);
+      // Версия защищает от удаления категории, которую кто-то уже изменил
+      const category = categories.find((cat) => cat.id === categoryId);
+      const response = await axios.delete(`${API_URL}/categories/${categoryId}`, {
+        params: { version: category && category.version, force: force || undefined },
+      });
       if (response.data.status === 'success') {
         toast({
           title: 'Категория удалена',
@@ -217,10 +236,17 @@ function App() {
         fetchData();
       }
     } catch (error) {
+      // Непустую категорию удаляем вместе с расходами только после подтверждения
+      if (!force && error.response && error.response.status === 409) {
+        if (window.confirm(`${error.response.data.message}\n\nУдалить категорию вместе с расходами?`)) {
+          await handleCategoryDelete(categoryId, true);
+        }
+        return;
+      }
       console.error('Error deleting category:', error);
       toast({
         title: 'Ошибка',
-        description: 'Не удалось удалить категорию',
+        description: errorDescription(error, 'Не удалось удалить категорию'),
         status: 'error',
         duration: 3000,
         isClosable: true,
@@ -281,7 +307,7 @@ function App() {
       console.error('Error submitting expense:', error);
       toast({
         title: 'Ошибка',
-        description: 'Не удалось сохранить расход',
+        description: errorDescription(error, 'Не удалось сохранить расход'),
         status: 'error',
         duration: 3000,
         isClosable: true,
@@ -296,7 +322,10 @@ function App() {
 
   const handleExpenseDelete = async (expenseId) => {
     try {
-      const response = await axios.delete(`${API_URL}/expenses/${expenseId}`);
+      const expense = expenses.find((exp) => exp.id === expenseId);
+      const response = await axios.delete(`${API_URL}/expenses/${expenseId}`, {
+        params: { version: expense && expense.version },
+      });
       if (response.data.status === 'success') {
         toast({
           title: 'Расход удален',
@@ -310,7 +339,7 @@ function App() {
       console.error('Error deleting expense:', error);
       toast({
         title: 'Ошибка',
-        description: 'Не удалось удалить расход',
+        description: errorDescription(error, 'Не удалось удалить расход'),
         status: 'error',
         duration: 3000,
         isClosable: true,
@@ -18,8 +18,7 @@ import {
 const CategoryForm = ({ isOpen, onClose, onSubmit, initialData }) => {
   const [formData, setFormData] = useState({
     name: '',
-    description: '',
-    monthlyStats: {}
+    description: ''
   });
 
   useEffect(() => {
@@ -28,13 +27,12 @@ const CategoryForm = ({ isOpen, onClose, onSubmit, initialData }) => {
         id: initialData.id,
         name: initialData.name,
         description: initialData.description,
-        monthlyStats: initialData.monthlyStats || {}
+        version: initialData.version
       });
     } else {
       setFormData({
         name: '',
-        description: '',
-        monthlyStats: {}
+        description: ''
       });
     }
   }, [initialData, isOpen]);
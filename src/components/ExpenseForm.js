@@ -17,11 +17,18 @@ import {
   Box,
 } from '@chakra-ui/react';
 
+// Дата для поля ввода в местном времени: toISOString дал бы день по UTC
+const toDateInput = (value) => {
+  const date = value ? new Date(value) : new Date();
+  const pad = (n) => String(n).padStart(2, '0');
+  return `${date.getFullYear()}-${pad(date.getMonth() + 1)}-${pad(date.getDate())}`;
+};
+
 const ExpenseForm = ({ isOpen, onClose, onSubmit, initialData, categoryName }) => {
   const [formData, setFormData] = useState({
     name: '',
     amount: '',
-    date: new Date().toISOString().split('T')[0],
+    date: toDateInput(),
     description: '',
   });
 
@@ -32,14 +39,15 @@ const ExpenseForm = ({ isOpen, onClose, onSubmit, initialData, categoryName }) =
         categoryId: initialData.categoryId,
         name: initialData.name,
         amount: initialData.amount,
-        date: initialData.date ? new Date(initialData.date).toISOString().split('T')[0] : new Date().toISOString().split('T')[0],
+        date: toDateInput(initialData.date),
         description: initialData.description || '',
+        version: initialData.version,
       });
     } else {
       setFormData({
         name: '',
         amount: '',
-        date: new Date().toISOString().split('T')[0],
+        date: toDateInput(),
         description: '',
       });
     }
@@ -54,8 +62,8 @@ const ExpenseForm = ({ isOpen, onClose, onSubmit, initialData, categoryName }) =
   };
 
   const handleSubmit = () => {
-    // Преобразуем дату в ISO формат для отправки на сервер
-    const dateObj = new Date(formData.date);
+    // Полночь выбранного дня по местному времени, в ISO формате для сервера
+    const dateObj = new Date(`${formData.date}T00:00:00`);
     const submissionData = {
       ...formData,
       date: dateObj.toISOString(),
@@ -1,4 +1,4 @@
-import React, { useState } from 'react';
+import React, { useState, useEffect } from 'react';
 import {
   Box,
   Heading,
@@ -18,6 +18,7 @@ import {
   Td,
   Badge,
   Select,
+  Input,
 } from '@chakra-ui/react';
 import { 
   BarChart, 
@@ -31,35 +32,69 @@ import {
   Legend, 
   ResponsiveContainer 
 } from 'recharts';
+import axios from 'axios';
+
+const API_URL = process.env.REACT_APP_API_URL || 'http://localhost:8081/api';
+
+const granularityOptions = [
+  { value: 'day', label: 'По дням' },
+  { value: 'week', label: 'По неделям' },
+  { value: 'month', label: 'По месяцам' },
+  { value: 'quarter', label: 'По кварталам' },
+  { value: 'year', label: 'По годам' },
+];
 
 const Statistics = ({ statistics, categories }) => {
   const [selectedCategory, setSelectedCategory] = useState('all');
-  
-  const getMonthNames = () => {
-    if (!statistics || !statistics.monthlyTotals) return [];
-    return Object.keys(statistics.monthlyTotals).sort();
+  const [from, setFrom] = useState('');
+  const [to, setTo] = useState('');
+  const [granularity, setGranularity] = useState('month');
+  const [periodStatistics, setPeriodStatistics] = useState(null);
+
+  // Статистику за выбранный период считает сервер; без выбора показываем общую
+  useEffect(() => {
+    if (!from && !to && granularity === 'month') {
+      setPeriodStatistics(null);
+      return;
+    }
+    const params = { granularity };
+    if (from) params.from = from;
+    if (to) params.to = to;
+    axios.get(`${API_URL}/statistics`, { params })
+      .then((response) => {
+        if (response.data.status === 'success') {
+          setPeriodStatistics(response.data.data);
+        }
+      })
+      .catch((error) => console.error('Error fetching statistics:', error));
+  }, [from, to, granularity, statistics]);
+
+  const data = periodStatistics || statistics;
+
+  const formatBucket = (bucket) => {
+    // Месяцы с 1-го числа подписываем названием, финансовые (с другого дня) - интервалом
+    if ((data.granularity || 'month') === 'month' && bucket.label.length === 7) {
+      return new Date(bucket.start).toLocaleDateString('ru-RU', { month: 'long', year: 'numeric' });
+    }
+    return bucket.label;
   };
-  
+
   const prepareChartData = () => {
-    if (!statistics || !statistics.monthlyTotals) return [];
-    
-    const months = getMonthNames();
-    
-    return months.map(month => {
-      const monthName = new Date(month + '-01').toLocaleDateString('ru-RU', { month: 'long', year: 'numeric' });
-      
-      let data = {
-        name: monthName,
-        month: month,
-        total: statistics.monthlyTotals[month] || 0
+    if (!data || !data.buckets) return [];
+
+    return data.buckets.map((bucket, index) => {
+      let row = {
+        name: formatBucket(bucket),
+        month: bucket.label,
+        total: bucket.total
       };
-      
+
       // Добавляем данные по категориям
-      statistics.categoryStats.forEach(cat => {
-        data[cat.name] = cat.monthlyStats?.[month] || 0;
+      (data.categoryStats || []).forEach(cat => {
+        row[cat.name] = cat.buckets?.[index] || 0;
       });
-      
-      return data;
+
+      return row;
     });
   };
   
@@ -104,6 +139,40 @@ const Statistics = ({ statistics, categories }) => {
             </option>
           ))}
         </Select>
+        <Select
+          value={granularity}
+          onChange={(e) => setGranularity(e.target.value)}
+          width="auto"
+          mr={4}
+          bg="whiteAlpha.200"
+          color="white"
+          borderColor="whiteAlpha.400"
+        >
+          {granularityOptions.map(option => (
+            <option key={option.value} value={option.value} style={{color: 'black'}}>
+              {option.label}
+            </option>
+          ))}
+        </Select>
+        <Input
+          type="date"
+          value={from}
+          onChange={(e) => setFrom(e.target.value)}
+          width="auto"
+          mr={2}
+          bg="whiteAlpha.200"
+          color="white"
+          borderColor="whiteAlpha.400"
+        />
+        <Input
+          type="date"
+          value={to}
+          onChange={(e) => setTo(e.target.value)}
+          width="auto"
+          bg="whiteAlpha.200"
+          color="white"
+          borderColor="whiteAlpha.400"
+        />
       </Flex>
       
       <Tabs isFitted variant="enclosed" mb={6}>
@@ -222,7 +291,7 @@ const Statistics = ({ statistics, categories }) => {
               <Table variant="simple">
                 <Thead>
                   <Tr>
-                    <Th color="white" borderColor="whiteAlpha.300">Месяц</Th>
+                    <Th color="white" borderColor="whiteAlpha.300">Период</Th>
                     {selectedCategory === 'all' ? (
                       <>
                         {categories.map(cat => (
@@ -275,7 +344,7 @@ const Statistics = ({ statistics, categories }) => {
       </Tabs>
 
       <SimpleGrid columns={{ base: 1, md: 2, lg: 3 }} spacing={4} mt={8}>
-        {statistics?.categoryStats.map((cat, index) => (
+        {(data?.categoryStats || []).map((cat, index) => (
           <Box 
             key={cat.id} 
             p={4} 
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Шаг разбивки статистики по периодам
+const (
+	granularityDay     = "day"
+	granularityWeek    = "week"
+	granularityMonth   = "month"
+	granularityQuarter = "quarter"
+	granularityYear    = "year"
+)
+
+// Больше периодов в одном ответе не отдаем: это ~13 лет по дням
+const maxStatisticsBuckets = 5000
+
+// Параметры статистики: период включительно по датам, шаг и категории (?categoryId=1&categoryId=2)
+type StatisticsFilter struct {
+	From        string `form:"from"`
+	To          string `form:"to"`
+	Granularity string `form:"granularity"`
+	CategoryIDs []int  `form:"categoryId"`
+}
+
+// Сумма за один период. End - последний день периода включительно.
+type StatisticsBucket struct {
+	Label string  `json:"label"`
+	Start string  `json:"start"`
+	End   string  `json:"end"`
+	Total float64 `json:"total"`
+}
+
+// Параметры сравнения: период from-to и период сравнения. Без compareFrom/compareTo
+// он выбирается по compare: previous - предыдущий такой же период, year - тот же годом раньше.
+type CompareFilter struct {
+	From        string `form:"from" binding:"required"`
+	To          string `form:"to" binding:"required"`
+	CompareFrom string `form:"compareFrom"`
+	CompareTo   string `form:"compareTo"`
+	Compare     string `form:"compare" binding:"omitempty,oneof=previous year"`
+	CategoryIDs []int  `form:"categoryId"`
+}
+
+// Период сравнения с итогом; даты включительно
+type ComparePeriod struct {
+	From  string  `json:"from"`
+	To    string  `json:"to"`
+	Total float64 `json:"total"`
+}
+
+// Состояние категории при сравнении периодов
+const (
+	compareAppeared    = "appeared"
+	compareDisappeared = "disappeared"
+	compareChanged     = "changed"
+	compareUnchanged   = "unchanged"
+)
+
+// Суммы категории в двух периодах. DeltaPercent нет, если в периоде сравнения расходов не было.
+type CategoryComparison struct {
+	ID            int      `json:"id"`
+	Name          string   `json:"name"`
+	Amount        float64  `json:"amount"`
+	CompareAmount float64  `json:"compareAmount"`
+	Delta         float64  `json:"delta"`
+	DeltaPercent  *float64 `json:"deltaPercent"`
+	Status        string   `json:"status"`
+}
+
+type CategoryStat struct {
+	ID           int                `json:"id"`
+	Name         string             `json:"name"`
+	TotalAmount  float64            `json:"totalAmount"`
+	MonthlyStats map[string]float64 `json:"monthlyStats"`
+	// Суммы по периодам в порядке buckets ответа, пустые периоды - нули
+	Buckets []float64 `json:"buckets"`
+}
+
+func validGranularity(g string) bool {
+	switch g {
+	case granularityDay, granularityWeek, granularityMonth, granularityQuarter, granularityYear:
+		return true
+	}
+	return false
+}
+
+// Границы периодов домохозяйства. Месяц начинается в день MonthStartDay (1-28, чтобы
+// он был в каждом месяце), неделя - в WeekStartDay, финансовый год - в первый день
+// финансового месяца FiscalYearStartMonth. Кварталы - по три месяца от начала года.
+type periodCalendar struct {
+	Location             *time.Location
+	MonthStartDay        int
+	WeekStartDay         time.Weekday
+	FiscalYearStartMonth time.Month
+}
+
+// Календарные месяцы, недели ISO и год с января
+var defaultCalendar = periodCalendar{
+	Location:             time.UTC,
+	MonthStartDay:        1,
+	WeekStartDay:         time.Monday,
+	FiscalYearStartMonth: time.January,
+}
+
+// Число месяцев между началами двух месячных периодов
+func monthsBetween(from, to time.Time) int {
+	return (to.Year()-from.Year())*12 + int(to.Month()-from.Month())
+}
+
+// Начало финансового месяца, в который попадает день
+func (cal periodCalendar) monthStart(day time.Time) time.Time {
+	start := time.Date(day.Year(), day.Month(), cal.MonthStartDay, 0, 0, 0, 0, time.UTC)
+	if day.Day() < cal.MonthStartDay {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// Начало финансового года, в который попадает день
+func (cal periodCalendar) yearStart(day time.Time) time.Time {
+	month := cal.monthStart(day)
+	return month.AddDate(0, -((int(month.Month()-cal.FiscalYearStartMonth) + 12) % 12), 0)
+}
+
+// Начало периода, в который попадает день (дата в UTC, без времени)
+func (cal periodCalendar) bucketStart(t time.Time, granularity string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch granularity {
+	case granularityWeek:
+		return day.AddDate(0, 0, -((int(day.Weekday()-cal.WeekStartDay) + 7) % 7))
+	case granularityMonth:
+		return cal.monthStart(day)
+	case granularityQuarter:
+		year := cal.yearStart(day)
+		n := monthsBetween(year, cal.monthStart(day))
+		return year.AddDate(0, n-n%3, 0)
+	case granularityYear:
+		return cal.yearStart(day)
+	}
+	return day
+}
+
+// Начало следующего периода
+func nextBucket(start time.Time, granularity string) time.Time {
+	switch granularity {
+	case granularityWeek:
+		return start.AddDate(0, 0, 7)
+	case granularityMonth:
+		return start.AddDate(0, 1, 0)
+	case granularityQuarter:
+		return start.AddDate(0, 3, 0)
+	case granularityYear:
+		return start.AddDate(1, 0, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// Подпись периода. Для стандартных границ: 2024-01-15, 2024-W03 (год недели ISO), 2024-01,
+// 2024-Q1, 2024. Неделя не с понедельника и месяц не с 1-го числа подписываются
+// интервалом ISO 8601 (2024-01-25/2024-02-24), финансовый год не с 1 января - FY2024/25.
+func (cal periodCalendar) bucketLabel(start time.Time, granularity string) string {
+	switch granularity {
+	case granularityWeek:
+		if cal.WeekStartDay != time.Monday {
+			return intervalLabel(start, nextBucket(start, granularity))
+		}
+		year, week := start.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case granularityMonth:
+		if cal.MonthStartDay != 1 {
+			return intervalLabel(start, nextBucket(start, granularity))
+		}
+		return start.Format("2006-01")
+	case granularityQuarter:
+		year := cal.yearStart(start)
+		return fmt.Sprintf("%s-Q%d", fiscalYearLabel(year), monthsBetween(year, start)/3+1)
+	case granularityYear:
+		return fiscalYearLabel(start)
+	}
+	return start.Format("2006-01-02")
+}
+
+// Интервал от start до дня перед next включительно
+func intervalLabel(start, next time.Time) string {
+	return start.Format("2006-01-02") + "/" + next.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+// Год с 1 января - просто номер года, иначе оба календарных года, на которые он приходится
+func fiscalYearLabel(start time.Time) string {
+	if start.Month() == time.January && start.Day() == 1 {
+		return strconv.Itoa(start.Year())
+	}
+	return fmt.Sprintf("FY%d/%02d", start.Year(), (start.Year()+1)%100)
+}
+
+// Ключ месячной статистики категории для момента времени
+func (cal periodCalendar) monthLabel(t time.Time) string {
+	return cal.bucketLabel(cal.bucketStart(t.In(cal.Location), granularityMonth), granularityMonth)
+}
+
+// Периоды от from до to включительно, с нулевыми суммами
+func (cal periodCalendar) buildBuckets(from, to time.Time, granularity string) ([]StatisticsBucket, error) {
+	buckets := []StatisticsBucket{}
+	for start := cal.bucketStart(from, granularity); !start.After(to); start = nextBucket(start, granularity) {
+		if len(buckets) == maxStatisticsBuckets {
+			return nil, fmt.Errorf("period is too long for granularity %s: at most %d buckets", granularity, maxStatisticsBuckets)
+		}
+		buckets = append(buckets, StatisticsBucket{
+			Label: cal.bucketLabel(start, granularity),
+			Start: start.Format("2006-01-02"),
+			End:   nextBucket(start, granularity).AddDate(0, 0, -1).Format("2006-01-02"),
+		})
+	}
+	return buckets, nil
+}
+
+// Номер периода для дня; дни вне buckets дают -1
+func (cal periodCalendar) bucketIndex(buckets []StatisticsBucket, day time.Time, granularity string) int {
+	if len(buckets) == 0 {
+		return -1
+	}
+	first, _ := time.Parse("2006-01-02", buckets[0].Start)
+	start := cal.bucketStart(day, granularity)
+	var i int
+	switch granularity {
+	case granularityDay:
+		i = int(start.Sub(first).Hours() / 24)
+	case granularityWeek:
+		i = int(start.Sub(first).Hours() / (24 * 7))
+	case granularityMonth:
+		i = monthsBetween(first, start)
+	case granularityQuarter:
+		i = monthsBetween(first, start) / 3
+	case granularityYear:
+		i = monthsBetween(first, start) / 12
+	}
+	if i < 0 || i >= len(buckets) {
+		return -1
+	}
+	return i
+}
+
+// Сумма расходов категории за день в часовом поясе домохозяйства
+type dayTotal struct {
+	day        time.Time
+	categoryID int
+	amount     float64
+}
+
+// Условия запросов статистики: домохозяйство, корзина и фильтр по категориям
+func statisticsConditions(householdID int, categoryIDs []int) ([]string, []interface{}) {
+	args := []interface{}{householdID}
+	conditions := []string{"household_id = $1", "deleted_at IS NULL"}
+	if len(categoryIDs) > 0 {
+		args = append(args, pq.Array(categoryIDs))
+		conditions = append(conditions, "category_id = ANY($2)")
+	}
+	return conditions, args
+}
+
+// Категории, попавшие в фильтр, и их позиции по id. Пустой фильтр - все категории домохозяйства.
+func loadStatisticsCategories(ctx context.Context, householdID int, categoryIDs []int) ([]CategoryStat, map[int]int, error) {
+	_, args := statisticsConditions(householdID, categoryIDs)
+	categoryQuery := "SELECT id, name, monthly_stats FROM categories WHERE household_id = $1 AND deleted_at IS NULL"
+	if len(categoryIDs) > 0 {
+		categoryQuery += " AND id = ANY($2)"
+	}
+	rows, err := db.QueryContext(ctx, categoryQuery+" ORDER BY id", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	categoryStats := []CategoryStat{}
+	categoryIndex := make(map[int]int)
+	for rows.Next() {
+		var cat CategoryStat
+		var monthlyStatsJSON []byte
+		if err := rows.Scan(&cat.ID, &cat.Name, &monthlyStatsJSON); err != nil {
+			return nil, nil, err
+		}
+
+		// Разбор JSON строки для monthlyStats
+		cat.MonthlyStats = make(map[string]float64)
+		if len(monthlyStatsJSON) > 0 {
+			if err := json.Unmarshal(monthlyStatsJSON, &cat.MonthlyStats); err != nil {
+				log.Printf("Error parsing monthly stats for category %d: %v", cat.ID, err)
+			}
+		}
+
+		categoryIndex[cat.ID] = len(categoryStats)
+		categoryStats = append(categoryStats, cat)
+	}
+	return categoryStats, categoryIndex, rows.Err()
+}
+
+// Суммы по дням и категориям от from до to включительно, по возрастанию дня.
+// Нулевая граница не ограничивает период.
+func queryDailyTotals(ctx context.Context, householdID int, categoryIDs []int, from, to time.Time) ([]dayTotal, error) {
+	conditions, args := statisticsConditions(householdID, categoryIDs)
+	if !from.IsZero() {
+		args = append(args, from.Format("2006-01-02"))
+		conditions = append(conditions, fmt.Sprintf("date >= ($%d::timestamp AT TIME ZONE %s)", len(args), householdTimezoneSQL))
+	}
+	if !to.IsZero() {
+		args = append(args, to.AddDate(0, 0, 1).Format("2006-01-02"))
+		conditions = append(conditions, fmt.Sprintf("date < ($%d::timestamp AT TIME ZONE %s)", len(args), householdTimezoneSQL))
+	}
+	rows, err := db.QueryContext(ctx, "SELECT (date AT TIME ZONE "+householdTimezoneSQL+")::date, category_id, SUM(amount) FROM expenses WHERE "+
+		strings.Join(conditions, " AND ")+" GROUP BY 1, 2 ORDER BY 1", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []dayTotal
+	for rows.Next() {
+		var d dayTotal
+		var categoryID sql.NullInt64
+		if err := rows.Scan(&d.day, &categoryID, &d.amount); err != nil {
+			return nil, err
+		}
+		d.categoryID = int(categoryID.Int64)
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+// Тот же день на years лет раньше или позже; 29 февраля в невисокосном году - 28-е, а не 1 марта
+func addYears(t time.Time, years int) time.Time {
+	shifted := t.AddDate(years, 0, 0)
+	if shifted.Day() != t.Day() {
+		shifted = shifted.AddDate(0, 0, -shifted.Day())
+	}
+	return shifted
+}
+
+// Период сравнения по умолчанию. Период из целых финансовых месяцев (месяц, квартал, год)
+// сдвигается на столько же месяцев, остальные - на свою длину в днях.
+func (cal periodCalendar) comparePeriod(from, to time.Time, mode string) (time.Time, time.Time) {
+	end := to.AddDate(0, 0, 1)
+	if mode == "year" {
+		return addYears(from, -1), end.AddDate(-1, 0, -1)
+	}
+	if cal.bucketStart(from, granularityMonth).Equal(from) && cal.bucketStart(end, granularityMonth).Equal(end) {
+		n := monthsBetween(from, end)
+		return from.AddDate(0, -n, 0), from.AddDate(0, 0, -1)
+	}
+	days := int(end.Sub(from).Hours() / 24)
+	return from.AddDate(0, 0, -days), from.AddDate(0, 0, -1)
+}
+
+// Суммы с точностью до копеек, чтобы разности не накапливали ошибку float
+func roundAmount(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// Разность двух сумм в процентах от base; при base = 0 процент не определен
+func deltaPercent(amount, base float64) *float64 {
+	if base == 0 {
+		return nil
+	}
+	p := math.Round((amount-base)/base*10000) / 100
+	return &p
+}
+
+// Итог периода и суммы по категориям
+func sumDailyTotals(days []dayTotal) (float64, map[int]float64) {
+	var total float64
+	byCategory := make(map[int]float64)
+	for _, d := range days {
+		total += d.amount
+		byCategory[d.categoryID] += d.amount
+	}
+	return roundAmount(total), byCategory
+}
+
+func parseCompareDates(fromStr, toStr, prefix string) (time.Time, time.Time, error) {
+	from, err := time.Parse("2006-01-02", fromStr)
+	if err != nil {
+		return from, from, fmt.Errorf("invalid %sfrom date: %s", prefix, fromStr)
+	}
+	to, err := time.Parse("2006-01-02", toStr)
+	if err != nil {
+		return from, to, fmt.Errorf("invalid %sto date: %s", prefix, toStr)
+	}
+	if to.Before(from) {
+		return from, to, fmt.Errorf("%sto must not be before %sfrom", prefix, prefix)
+	}
+	return from, to, nil
+}
+
+// Сравнение расходов за два периода: по категориям, с разностями и
+// категориями, которые появились или пропали
+func compareStatistics(c *gin.Context) {
+	var filter CompareFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, to, err := parseCompareDates(filter.From, filter.To, "")
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if (filter.CompareFrom == "") != (filter.CompareTo == "") {
+		respondWithError(c, http.StatusBadRequest, "compareFrom and compareTo must be set together")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	householdID := currentHouseholdID(c)
+	cal, err := householdCalendar(ctx, db, householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var compareFrom, compareTo time.Time
+	if filter.CompareFrom != "" {
+		compareFrom, compareTo, err = parseCompareDates(filter.CompareFrom, filter.CompareTo, "compare")
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		compareFrom, compareTo = cal.comparePeriod(from, to, filter.Compare)
+	}
+
+	categories, categoryIndex, err := loadStatisticsCategories(ctx, householdID, filter.CategoryIDs)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, id := range filter.CategoryIDs {
+		if _, ok := categoryIndex[id]; !ok {
+			respondWithError(c, http.StatusBadRequest, fmt.Sprintf("Category %d not found", id))
+			return
+		}
+	}
+
+	days, err := queryDailyTotals(ctx, householdID, filter.CategoryIDs, from, to)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	compareDays, err := queryDailyTotals(ctx, householdID, filter.CategoryIDs, compareFrom, compareTo)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	total, amounts := sumDailyTotals(days)
+	compareTotal, compareAmounts := sumDailyTotals(compareDays)
+
+	// Категории без расходов в обоих периодах в ответ не попадают
+	comparisons := []CategoryComparison{}
+	appeared := []int{}
+	disappeared := []int{}
+	for _, cat := range categories {
+		amount := roundAmount(amounts[cat.ID])
+		compareAmount := roundAmount(compareAmounts[cat.ID])
+		if amount == 0 && compareAmount == 0 {
+			continue
+		}
+		cmp := CategoryComparison{
+			ID:            cat.ID,
+			Name:          cat.Name,
+			Amount:        amount,
+			CompareAmount: compareAmount,
+			Delta:         roundAmount(amount - compareAmount),
+			DeltaPercent:  deltaPercent(amount, compareAmount),
+		}
+		switch {
+		case compareAmount == 0:
+			cmp.Status = compareAppeared
+			appeared = append(appeared, cat.ID)
+		case amount == 0:
+			cmp.Status = compareDisappeared
+			disappeared = append(disappeared, cat.ID)
+		case cmp.Delta == 0:
+			cmp.Status = compareUnchanged
+		default:
+			cmp.Status = compareChanged
+		}
+		comparisons = append(comparisons, cmp)
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data: map[string]interface{}{
+			"period":        ComparePeriod{From: from.Format("2006-01-02"), To: to.Format("2006-01-02"), Total: total},
+			"comparePeriod": ComparePeriod{From: compareFrom.Format("2006-01-02"), To: compareTo.Format("2006-01-02"), Total: compareTotal},
+			"delta":         roundAmount(total - compareTotal),
+			"deltaPercent":  deltaPercent(total, compareTotal),
+			"categories":    comparisons,
+			"appeared":      appeared,
+			"disappeared":   disappeared,
+		},
+	})
+}
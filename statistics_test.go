@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func mustDate(t *testing.T, s string) time.Time {
+	t.Helper()
+	d, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestPeriodCalendarBuckets(t *testing.T) {
+	sundayWeeks := defaultCalendar
+	sundayWeeks.WeekStartDay = time.Sunday
+	salaryMonths := defaultCalendar
+	salaryMonths.MonthStartDay = 25
+	aprilYears := defaultCalendar
+	aprilYears.FiscalYearStartMonth = time.April
+	salaryAprilYears := aprilYears
+	salaryAprilYears.MonthStartDay = 25
+
+	tests := []struct {
+		name        string
+		cal         periodCalendar
+		day         string
+		granularity string
+		wantStart   string
+		wantLabel   string
+	}{
+		{"day", defaultCalendar, "2024-01-15", granularityDay, "2024-01-15", "2024-01-15"},
+		{"ISO week", defaultCalendar, "2024-01-17", granularityWeek, "2024-01-15", "2024-W03"},
+		{"ISO week of previous year", defaultCalendar, "2024-12-31", granularityWeek, "2024-12-30", "2025-W01"},
+		{"calendar month", defaultCalendar, "2024-02-29", granularityMonth, "2024-02-01", "2024-02"},
+		{"calendar quarter", defaultCalendar, "2024-05-20", granularityQuarter, "2024-04-01", "2024-Q2"},
+		{"calendar year", defaultCalendar, "2024-05-20", granularityYear, "2024-01-01", "2024"},
+
+		{"week from Sunday", sundayWeeks, "2024-01-17", granularityWeek, "2024-01-14", "2024-01-14/2024-01-20"},
+		{"week from Sunday on Sunday", sundayWeeks, "2024-01-14", granularityWeek, "2024-01-14", "2024-01-14/2024-01-20"},
+
+		{"month from 25th before start day", salaryMonths, "2024-01-10", granularityMonth, "2023-12-25", "2023-12-25/2024-01-24"},
+		{"month from 25th on start day", salaryMonths, "2024-01-25", granularityMonth, "2024-01-25", "2024-01-25/2024-02-24"},
+		{"month from 25th across February", salaryMonths, "2024-03-01", granularityMonth, "2024-02-25", "2024-02-25/2024-03-24"},
+
+		{"fiscal year before April", aprilYears, "2024-03-31", granularityYear, "2023-04-01", "FY2023/24"},
+		{"fiscal year from April", aprilYears, "2024-04-01", granularityYear, "2024-04-01", "FY2024/25"},
+		{"last fiscal quarter", aprilYears, "2024-03-31", granularityQuarter, "2024-01-01", "FY2023/24-Q4"},
+		{"first fiscal quarter", aprilYears, "2024-06-30", granularityQuarter, "2024-04-01", "FY2024/25-Q1"},
+
+		{"fiscal year of salary months", salaryAprilYears, "2024-04-10", granularityYear, "2023-04-25", "FY2023/24"},
+		{"fiscal quarter of salary months", salaryAprilYears, "2024-04-10", granularityQuarter, "2024-01-25", "FY2023/24-Q4"},
+		{"new fiscal year of salary months", salaryAprilYears, "2024-04-25", granularityQuarter, "2024-04-25", "FY2024/25-Q1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := tt.cal.bucketStart(mustDate(t, tt.day), tt.granularity)
+			if got := start.Format("2006-01-02"); got != tt.wantStart {
+				t.Errorf("bucketStart(%s) = %s, want %s", tt.day, got, tt.wantStart)
+			}
+			if got := tt.cal.bucketLabel(start, tt.granularity); got != tt.wantLabel {
+				t.Errorf("bucketLabel = %s, want %s", got, tt.wantLabel)
+			}
+		})
+	}
+}
+
+func TestPeriodCalendarMonthLabel(t *testing.T) {
+	vladivostok, err := time.LoadLocation("Asia/Vladivostok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 31 января 15:00 UTC - уже 1 февраля во Владивостоке (UTC+10)
+	moment := time.Date(2024, time.January, 31, 15, 0, 0, 0, time.UTC)
+
+	local := defaultCalendar
+	local.Location = vladivostok
+	salary := local
+	salary.MonthStartDay = 25
+
+	tests := []struct {
+		name string
+		cal  periodCalendar
+		want string
+	}{
+		{"UTC", defaultCalendar, "2024-01"},
+		{"household timezone", local, "2024-02"},
+		{"household timezone and month start day", salary, "2024-01-25/2024-02-24"},
+	}
+	for _, tt := range tests {
+		if got := tt.cal.monthLabel(moment); got != tt.want {
+			t.Errorf("%s: monthLabel = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPeriodCalendarBuildBuckets(t *testing.T) {
+	cal := defaultCalendar
+	cal.MonthStartDay = 25
+
+	buckets, err := cal.buildBuckets(mustDate(t, "2024-01-10"), mustDate(t, "2024-03-01"), granularityMonth)
+	if err != nil {
+		t.Fatalf("buildBuckets: %v", err)
+	}
+	want := []StatisticsBucket{
+		{Label: "2023-12-25/2024-01-24", Start: "2023-12-25", End: "2024-01-24"},
+		{Label: "2024-01-25/2024-02-24", Start: "2024-01-25", End: "2024-02-24"},
+		{Label: "2024-02-25/2024-03-24", Start: "2024-02-25", End: "2024-03-24"},
+	}
+	if len(buckets) != len(want) {
+		t.Fatalf("buckets = %v, want %v", buckets, want)
+	}
+	for i := range want {
+		if buckets[i].Label != want[i].Label || buckets[i].Start != want[i].Start || buckets[i].End != want[i].End {
+			t.Errorf("bucket %d = %+v, want %+v", i, buckets[i], want[i])
+		}
+	}
+
+	indexes := map[string]int{
+		"2023-12-24": -1,
+		"2023-12-25": 0,
+		"2024-02-24": 1,
+		"2024-02-25": 2,
+		"2024-03-24": 2,
+		"2024-03-25": -1,
+	}
+	for day, want := range indexes {
+		if got := cal.bucketIndex(buckets, mustDate(t, day), granularityMonth); got != want {
+			t.Errorf("bucketIndex(%s) = %d, want %d", day, got, want)
+		}
+	}
+
+	weeks, err := defaultCalendar.buildBuckets(mustDate(t, "2024-01-03"), mustDate(t, "2024-01-15"), granularityWeek)
+	if err != nil {
+		t.Fatalf("buildBuckets: %v", err)
+	}
+	if len(weeks) != 3 || weeks[0].Start != "2024-01-01" || weeks[2].End != "2024-01-21" {
+		t.Errorf("weeks = %+v", weeks)
+	}
+	if got := defaultCalendar.bucketIndex(weeks, mustDate(t, "2024-01-14"), granularityWeek); got != 1 {
+		t.Errorf("bucketIndex(2024-01-14) = %d, want 1", got)
+	}
+
+	if _, err := defaultCalendar.buildBuckets(mustDate(t, "2000-01-01"), mustDate(t, "2024-01-01"), granularityDay); err == nil {
+		t.Error("buildBuckets accepted more than maxStatisticsBuckets days")
+	}
+}
+
+func TestComparePeriod(t *testing.T) {
+	salaryMonths := defaultCalendar
+	salaryMonths.MonthStartDay = 25
+
+	tests := []struct {
+		name     string
+		cal      periodCalendar
+		from, to string
+		mode     string
+		wantFrom string
+		wantTo   string
+	}{
+		{"month", defaultCalendar, "2024-03-01", "2024-03-31", "previous", "2024-02-01", "2024-02-29"},
+		{"quarter", defaultCalendar, "2024-04-01", "2024-06-30", "previous", "2024-01-01", "2024-03-31"},
+		{"days", defaultCalendar, "2024-03-10", "2024-03-16", "previous", "2024-03-03", "2024-03-09"},
+		{"month to date", defaultCalendar, "2024-03-01", "2024-03-15", "previous", "2024-02-15", "2024-02-29"},
+		{"financial month", salaryMonths, "2024-01-25", "2024-02-24", "previous", "2023-12-25", "2024-01-24"},
+		{"calendar month in financial calendar", salaryMonths, "2024-03-01", "2024-03-31", "previous", "2024-01-30", "2024-02-29"},
+		{"year over year", defaultCalendar, "2024-02-01", "2024-02-29", "year", "2023-02-01", "2023-02-28"},
+		{"year over year days", defaultCalendar, "2024-03-10", "2024-03-16", "year", "2023-03-10", "2023-03-16"},
+		{"year over year from leap day", defaultCalendar, "2024-02-29", "2024-03-10", "year", "2023-02-28", "2023-03-10"},
+		{"leap day year over year", defaultCalendar, "2024-02-29", "2024-02-29", "year", "2023-02-28", "2023-02-28"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := tt.cal.comparePeriod(mustDate(t, tt.from), mustDate(t, tt.to), tt.mode)
+			if got := from.Format("2006-01-02") + ".." + to.Format("2006-01-02"); got != tt.wantFrom+".."+tt.wantTo {
+				t.Errorf("comparePeriod = %s, want %s..%s", got, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestDeltaPercent(t *testing.T) {
+	tests := []struct {
+		amount, base float64
+		want         *float64
+	}{
+		{150, 100, floatPtr(50)},
+		{0, 100, floatPtr(-100)},
+		{1, 3, floatPtr(-66.67)},
+		{100, 0, nil},
+		{0, 0, nil},
+	}
+	for _, tt := range tests {
+		got := deltaPercent(tt.amount, tt.base)
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("deltaPercent(%v, %v) = %v, want %v", tt.amount, tt.base, formatPercent(got), formatPercent(tt.want))
+		}
+	}
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+func formatPercent(p *float64) string {
+	if p == nil {
+		return "nil"
+	}
+	return strconv.FormatFloat(*p, 'f', -1, 64)
+}
+
+func TestParseCompareDates(t *testing.T) {
+	if _, _, err := parseCompareDates("2024-03-01", "2024-03-31", ""); err != nil {
+		t.Errorf("valid period: %v", err)
+	}
+	if _, _, err := parseCompareDates("2024-03-01", "2024-03-01", ""); err != nil {
+		t.Errorf("single day: %v", err)
+	}
+	for _, period := range [][2]string{{"2024-03-31", "2024-03-01"}, {"03/01/2024", "2024-03-31"}, {"2024-03-01", ""}} {
+		if _, _, err := parseCompareDates(period[0], period[1], "compare"); err == nil {
+			t.Errorf("parseCompareDates(%q, %q) accepted an invalid period", period[0], period[1])
+		}
+	}
+}
+
+func TestGetStatisticsFilters(t *testing.T) {
+	var user *User
+	var householdID, food, cafe, foreign int
+	day := func(s string) time.Time { return mustDate(t, s).Add(12 * time.Hour) }
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, householdID = createTestUser(t, ctx, tx)
+		if _, err := tx.ExecContext(ctx, "UPDATE households SET timezone = 'UTC', month_start_day = 1 WHERE id = $1", householdID); err != nil {
+			t.Fatal(err)
+		}
+		food = createTestCategory(t, ctx, tx, householdID, "Food")
+		cafe = createTestCategory(t, ctx, tx, householdID, "Cafe")
+		_, otherHousehold := createTestUser(t, ctx, tx)
+		foreign = createTestCategory(t, ctx, tx, otherHousehold, "Foreign")
+		createTestExpense(t, ctx, tx, otherHousehold, foreign, "Foreign", 1000, day("2024-01-10"))
+
+		createTestExpense(t, ctx, tx, householdID, food, "Bread", 50, day("2024-01-10"))
+		createTestExpense(t, ctx, tx, householdID, food, "Milk", 100, day("2024-02-10"))
+		createTestExpense(t, ctx, tx, householdID, cafe, "Latte", 200, day("2024-01-20"))
+		createTestExpense(t, ctx, tx, householdID, cafe, "Espresso", 300, day("2024-03-05"))
+		// Расход в корзине в статистику не попадает
+		trashed := createTestExpense(t, ctx, tx, householdID, food, "Trashed", 70, day("2024-01-15"))
+		if _, err := tx.ExecContext(ctx, "UPDATE expenses SET deleted_at = NOW() WHERE id = $1", trashed.ID); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	router := testRouter(user.ID, householdID)
+	router.GET("/api/statistics", getStatistics)
+
+	type statistics struct {
+		TotalAmount   float64            `json:"totalAmount"`
+		CategoryStats []CategoryStat     `json:"categoryStats"`
+		From          string             `json:"from"`
+		To            string             `json:"to"`
+		Granularity   string             `json:"granularity"`
+		Buckets       []StatisticsBucket `json:"buckets"`
+	}
+	get := func(t *testing.T, query string) statistics {
+		t.Helper()
+		w := doJSON(router, http.MethodGet, "/api/statistics?"+query, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+		var resp struct {
+			Data statistics `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Data
+	}
+	labels := func(buckets []StatisticsBucket) ([]string, []float64) {
+		var names []string
+		var totals []float64
+		for _, b := range buckets {
+			names = append(names, b.Label)
+			totals = append(totals, b.Total)
+		}
+		return names, totals
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		wantTotal   float64
+		wantLabels  []string
+		wantTotals  []float64
+		wantByCat   map[int][]float64
+		granularity string
+	}{
+		{
+			name:        "from and to by month",
+			query:       "from=2024-01-01&to=2024-02-29",
+			wantTotal:   350,
+			wantLabels:  []string{"2024-01", "2024-02"},
+			wantTotals:  []float64{250, 100},
+			wantByCat:   map[int][]float64{food: {50, 100}, cafe: {200, 0}},
+			granularity: granularityMonth,
+		},
+		{
+			// Без from период начинается с первого расхода домохозяйства
+			name:        "only to",
+			query:       "to=2024-01-31&granularity=month",
+			wantTotal:   250,
+			wantLabels:  []string{"2024-01"},
+			wantTotals:  []float64{250},
+			wantByCat:   map[int][]float64{food: {50}, cafe: {200}},
+			granularity: granularityMonth,
+		},
+		{
+			name:        "category filter",
+			query:       fmt.Sprintf("from=2024-01-01&to=2024-03-31&categoryId=%d", food),
+			wantTotal:   150,
+			wantLabels:  []string{"2024-01", "2024-02", "2024-03"},
+			wantTotals:  []float64{50, 100, 0},
+			wantByCat:   map[int][]float64{food: {50, 100, 0}},
+			granularity: granularityMonth,
+		},
+		{
+			name:        "several categories by quarter",
+			query:       fmt.Sprintf("from=2024-01-01&to=2024-03-31&granularity=quarter&categoryId=%d&categoryId=%d", food, cafe),
+			wantTotal:   650,
+			wantLabels:  []string{"2024-Q1"},
+			wantTotals:  []float64{650},
+			wantByCat:   map[int][]float64{food: {150}, cafe: {500}},
+			granularity: granularityQuarter,
+		},
+		{
+			name:        "weeks",
+			query:       "from=2024-01-08&to=2024-01-21&granularity=week",
+			wantTotal:   250,
+			wantLabels:  []string{"2024-W02", "2024-W03"},
+			wantTotals:  []float64{50, 200},
+			wantByCat:   map[int][]float64{food: {50, 0}, cafe: {0, 200}},
+			granularity: granularityWeek,
+		},
+		{
+			name:        "days",
+			query:       "from=2024-01-19&to=2024-01-20&granularity=day",
+			wantTotal:   200,
+			wantLabels:  []string{"2024-01-19", "2024-01-20"},
+			wantTotals:  []float64{0, 200},
+			wantByCat:   map[int][]float64{food: {0, 0}, cafe: {0, 200}},
+			granularity: granularityDay,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := get(t, tt.query)
+			if stats.TotalAmount != tt.wantTotal || stats.Granularity != tt.granularity {
+				t.Errorf("total %v, granularity %q; want %v, %q", stats.TotalAmount, stats.Granularity, tt.wantTotal, tt.granularity)
+			}
+			gotLabels, gotTotals := labels(stats.Buckets)
+			if !reflect.DeepEqual(gotLabels, tt.wantLabels) || !reflect.DeepEqual(gotTotals, tt.wantTotals) {
+				t.Errorf("buckets %v %v, want %v %v", gotLabels, gotTotals, tt.wantLabels, tt.wantTotals)
+			}
+			byCat := make(map[int][]float64)
+			for _, cat := range stats.CategoryStats {
+				byCat[cat.ID] = cat.Buckets
+			}
+			if !reflect.DeepEqual(byCat, tt.wantByCat) {
+				t.Errorf("category buckets = %v, want %v", byCat, tt.wantByCat)
+			}
+		})
+	}
+
+	t.Run("invalid filters", func(t *testing.T) {
+		for _, query := range []string{
+			"granularity=hour",
+			"from=01.01.2024",
+			"to=2024-13-01",
+			"from=2024-02-01&to=2024-01-31",
+			"categoryId=abc",
+			fmt.Sprintf("categoryId=%d", foreign),
+		} {
+			if w := doJSON(router, http.MethodGet, "/api/statistics?"+query, nil); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: status = %d, want 400: %s", query, w.Code, w.Body)
+			}
+		}
+	})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Удаленные записи хранятся в корзине столько дней; TRASH_RETENTION_DAYS=0 отключает очистку
+const defaultTrashRetentionDays = 30
+
+// Как часто сервер очищает корзину
+const trashPurgeInterval = time.Hour
+
+func trashRetentionDays() int {
+	if v := os.Getenv("TRASH_RETENTION_DAYS"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil && days >= 0 {
+			return days
+		}
+		log.Printf("Invalid TRASH_RETENTION_DAYS %q, using %d", v, defaultTrashRetentionDays)
+	}
+	return defaultTrashRetentionDays
+}
+
+type TrashedCategory struct {
+	Category
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+type TrashedExpense struct {
+	Expense
+	DeletedAt time.Time `json:"deletedAt"`
+	// Расход удален вместе с категорией и восстанавливается вместе с ней
+	WithCategory bool `json:"withCategory"`
+}
+
+type Trash struct {
+	Categories    []TrashedCategory `json:"categories"`
+	Expenses      []TrashedExpense  `json:"expenses"`
+	RetentionDays int               `json:"retentionDays"`
+}
+
+// Окончательно удаляет записи, пролежавшие в корзине дольше срока хранения.
+// Расходы удаленной категории уходят вместе с ней каскадом.
+func purgeTrash(ctx context.Context, days int) (int64, int64, error) {
+	if days <= 0 {
+		return 0, 0, nil
+	}
+	interval := fmt.Sprintf("%d days", days)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM expenses WHERE deleted_at < NOW() - $1::interval", interval)
+	if err != nil {
+		return 0, 0, err
+	}
+	expenses, _ := res.RowsAffected()
+
+	res, err = tx.ExecContext(ctx, "DELETE FROM categories WHERE deleted_at < NOW() - $1::interval", interval)
+	if err != nil {
+		return 0, 0, err
+	}
+	categories, _ := res.RowsAffected()
+
+	return categories, expenses, tx.Commit()
+}
+
+// Периодическая очистка корзины в фоне, пока работает сервер
+func startTrashPurger() {
+	days := trashRetentionDays()
+	if days == 0 {
+		log.Println("Trash purge disabled")
+		return
+	}
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			categories, expenses, err := purgeTrash(ctx, days)
+			cancel()
+			if err != nil {
+				log.Printf("Error purging trash: %v", err)
+			} else if categories > 0 || expenses > 0 {
+				log.Printf("Purged %d categories and %d expenses older than %d days from trash", categories, expenses, days)
+			}
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
+
+func getTrash(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	householdID := currentHouseholdID(c)
+	trash := Trash{
+		Categories:    []TrashedCategory{},
+		Expenses:      []TrashedExpense{},
+		RetentionDays: trashRetentionDays(),
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, name, COALESCE(description, ''), monthly_stats, deleted_at FROM categories WHERE household_id = $1 AND deleted_at IS NOT NULL ORDER BY deleted_at DESC, id",
+		householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for rows.Next() {
+		var cat TrashedCategory
+		var monthlyStatsJSON []byte
+		if err := rows.Scan(&cat.ID, &cat.Name, &cat.Description, &monthlyStatsJSON, &cat.DeletedAt); err != nil {
+			rows.Close()
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		cat.MonthlyStats = make(map[string]float64)
+		if len(monthlyStatsJSON) > 0 {
+			if err := json.Unmarshal(monthlyStatsJSON, &cat.MonthlyStats); err != nil {
+				log.Printf("Error parsing monthly stats for category %d: %v", cat.ID, err)
+			}
+		}
+		trash.Categories = append(trash.Categories, cat)
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(ctx, "SELECT e.id, e.category_id, e.name, e.amount, e.date, COALESCE(e.description, ''), e.tags, e.deleted_at, COALESCE(c.deleted_at = e.deleted_at, FALSE) FROM expenses e LEFT JOIN categories c ON c.id = e.category_id WHERE e.household_id = $1 AND e.deleted_at IS NOT NULL ORDER BY e.deleted_at DESC, e.id",
+		householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var exp TrashedExpense
+		var tagsJSON []byte
+		if err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &exp.DeletedAt, &exp.WithCategory); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		exp.Tags = decodeTags(tagsJSON)
+		trash.Expenses = append(trash.Expenses, exp)
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status: "success",
+		Data:   trash,
+	})
+}
+
+// Возвращает расход из корзины и снова учитывает его в месячной статистике
+func restoreExpense(c *gin.Context) {
+	householdID := currentHouseholdID(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	var exp Expense
+	var tagsJSON []byte
+	var categoryDeleted bool
+	err = tx.QueryRowContext(ctx, "SELECT e.id, e.category_id, e.name, e.amount, e.date, COALESCE(e.description, ''), e.tags, c.deleted_at IS NOT NULL FROM expenses e LEFT JOIN categories c ON c.id = e.category_id WHERE e.id = $1 AND e.household_id = $2 AND e.deleted_at IS NOT NULL FOR UPDATE OF e",
+		c.Param("id"), householdID).Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON, &categoryDeleted)
+	if err == sql.ErrNoRows {
+		respondWithError(c, http.StatusNotFound, "Expense not found in trash")
+		return
+	}
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if categoryDeleted {
+		respondWithError(c, http.StatusConflict, "Expense category is in the trash; restore the category first")
+		return
+	}
+	exp.Tags = decodeTags(tagsJSON)
+
+	if _, err := tx.ExecContext(ctx, "UPDATE expenses SET deleted_at = NULL, version = version + 1 WHERE id = $1", exp.ID); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := updateMonthlyStatsWithTx(ctx, tx, exp.CategoryID, exp.Amount, exp.Date); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := recordAudit(ctx, tx, auditActorFrom(c), auditRestore, auditEntityExpense, exp.ID, nil, exp); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	classifier.Add(householdID, &exp)
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: "Expense restored successfully",
+		Data:    exp,
+	})
+}
+
+// Возвращает категорию вместе с расходами, удаленными одновременно с ней.
+// Расходы, удаленные раньше по отдельности, остаются в корзине.
+func restoreCategory(c *gin.Context) {
+	householdID := currentHouseholdID(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	var categoryID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM categories WHERE id = $1 AND household_id = $2 AND deleted_at IS NOT NULL FOR UPDATE",
+		c.Param("id"), householdID).Scan(&categoryID)
+	if err == sql.ErrNoRows {
+		respondWithError(c, http.StatusNotFound, "Category not found in trash")
+		return
+	}
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Метка удаления у категории и ее расходов одна: время транзакции удаления
+	rows, err := tx.QueryContext(ctx, "SELECT e.id, e.category_id, e.name, e.amount, e.date, COALESCE(e.description, ''), e.tags FROM expenses e JOIN categories c ON c.id = e.category_id WHERE c.id = $1 AND e.deleted_at = c.deleted_at ORDER BY e.id FOR UPDATE OF e",
+		categoryID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var expenses []Expense
+	for rows.Next() {
+		var exp Expense
+		var tagsJSON []byte
+		if err := rows.Scan(&exp.ID, &exp.CategoryID, &exp.Name, &exp.Amount, &exp.Date, &exp.Description, &tagsJSON); err != nil {
+			rows.Close()
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		exp.Tags = decodeTags(tagsJSON)
+		expenses = append(expenses, exp)
+	}
+	rows.Close()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE expenses e SET deleted_at = NULL, version = e.version + 1 FROM categories c WHERE c.id = e.category_id AND c.id = $1 AND e.deleted_at = c.deleted_at", categoryID); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE categories SET deleted_at = NULL, version = version + 1 WHERE id = $1", categoryID); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	actor := auditActorFrom(c)
+	for _, exp := range expenses {
+		if err := updateMonthlyStatsWithTx(ctx, tx, exp.CategoryID, exp.Amount, exp.Date); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := recordAudit(ctx, tx, actor, auditRestore, auditEntityExpense, exp.ID, nil, exp); err != nil {
+			respondWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	restored, err := loadCategoryForAudit(ctx, tx, strconv.Itoa(categoryID), householdID)
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := recordAudit(ctx, tx, actor, auditRestore, auditEntityCategory, categoryID, nil, restored); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for i := range expenses {
+		classifier.Add(householdID, &expenses[i])
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Status:  "success",
+		Message: fmt.Sprintf("Category restored with %d expenses", len(expenses)),
+		Data:    restored,
+	})
+}
+
+// expense-tracker purge-trash [-days N]
+func runPurgeTrashCommand(args []string) error {
+	fs := flag.NewFlagSet("purge-trash", flag.ExitOnError)
+	days := fs.Int("days", trashRetentionDays(), "delete items trashed more than this many days ago")
+	fs.Parse(args)
+
+	if *days <= 0 {
+		return fmt.Errorf("-days must be positive")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	categories, expenses, err := purgeTrash(ctx, *days)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d categories and %d expenses\n", categories, expenses)
+	return nil
+}
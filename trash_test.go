@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRestoreFromTrash(t *testing.T) {
+	t.Setenv("REQUIRE_IF_MATCH", "false")
+	var user *User
+	var householdID, food int
+	var bread, milk, cheese Expense
+	january := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+	february := time.Date(2024, time.February, 10, 12, 0, 0, 0, time.UTC)
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		user, householdID = createTestUser(t, ctx, tx)
+		if _, err := tx.ExecContext(ctx, "UPDATE households SET timezone = 'UTC', month_start_day = 1 WHERE id = $1", householdID); err != nil {
+			t.Fatal(err)
+		}
+		food = createTestCategory(t, ctx, tx, householdID, "Food")
+		bread = createTestExpense(t, ctx, tx, householdID, food, "Bread", 50, january)
+		milk = createTestExpense(t, ctx, tx, householdID, food, "Milk", 80, january)
+		cheese = createTestExpense(t, ctx, tx, householdID, food, "Cheese", 100, february)
+	})
+
+	router := testRouter(user.ID, householdID)
+	router.GET("/api/trash", getTrash)
+	router.POST("/api/trash/expenses/:id/restore", restoreExpense)
+	router.POST("/api/trash/categories/:id/restore", restoreCategory)
+	router.DELETE("/api/expenses/:id", deleteExpense)
+	router.DELETE("/api/categories/:id", deleteCategory)
+	ctx := context.Background()
+
+	request := func(method, target string, want int) {
+		t.Helper()
+		if w := doJSON(router, method, target, nil); w.Code != want {
+			t.Fatalf("%s %s: status = %d, want %d: %s", method, target, w.Code, want, w.Body)
+		}
+	}
+	restoreExpenseURL := fmt.Sprintf("/api/trash/expenses/%d/restore", cheese.ID)
+	restoreCategoryURL := fmt.Sprintf("/api/trash/categories/%d/restore", food)
+
+	t.Run("expense", func(t *testing.T) {
+		request(http.MethodDelete, fmt.Sprintf("/api/expenses/%d", cheese.ID), http.StatusOK)
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), map[string]float64{"2024-01": 130, "2024-02": 0})
+
+		request(http.MethodPost, restoreExpenseURL, http.StatusOK)
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), map[string]float64{"2024-01": 130, "2024-02": 100})
+		request(http.MethodPost, restoreExpenseURL, http.StatusNotFound)
+	})
+
+	t.Run("category with its expenses", func(t *testing.T) {
+		// Сыр удален раньше категории и останется в корзине после ее восстановления
+		request(http.MethodDelete, fmt.Sprintf("/api/expenses/%d", cheese.ID), http.StatusOK)
+		if _, err := db.ExecContext(ctx, "UPDATE expenses SET deleted_at = deleted_at - INTERVAL '1 minute' WHERE id = $1", cheese.ID); err != nil {
+			t.Fatal(err)
+		}
+		request(http.MethodDelete, fmt.Sprintf("/api/categories/%d?force=true", food), http.StatusOK)
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), map[string]float64{"2024-01": 0, "2024-02": 0})
+
+		// Пока категория в корзине, ее расход не восстановить
+		request(http.MethodPost, restoreExpenseURL, http.StatusConflict)
+
+		w := doJSON(router, http.MethodGet, "/api/trash", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("trash: status = %d: %s", w.Code, w.Body)
+		}
+		var resp struct {
+			Data Trash `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Data.Categories) != 1 || resp.Data.Categories[0].ID != food {
+			t.Errorf("trashed categories = %+v, want only %d", resp.Data.Categories, food)
+		}
+		withCategory := make(map[int]bool)
+		for _, exp := range resp.Data.Expenses {
+			withCategory[exp.ID] = exp.WithCategory
+		}
+		want := map[int]bool{bread.ID: true, milk.ID: true, cheese.ID: false}
+		if fmt.Sprint(withCategory) != fmt.Sprint(want) {
+			t.Errorf("trashed expenses with category = %v, want %v", withCategory, want)
+		}
+
+		request(http.MethodPost, restoreCategoryURL, http.StatusOK)
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), map[string]float64{"2024-01": 130, "2024-02": 0})
+		var inTrash []int
+		rows, err := db.QueryContext(ctx, "SELECT id FROM expenses WHERE category_id = $1 AND deleted_at IS NOT NULL", food)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				t.Fatal(err)
+			}
+			inTrash = append(inTrash, id)
+		}
+		if len(inTrash) != 1 || inTrash[0] != cheese.ID {
+			t.Errorf("expenses left in trash = %v, want only %d", inTrash, cheese.ID)
+		}
+		request(http.MethodPost, restoreCategoryURL, http.StatusNotFound)
+
+		// Теперь отдельно удаленный расход восстанавливается в уже живую категорию
+		request(http.MethodPost, restoreExpenseURL, http.StatusOK)
+		assertMonthlyStats(t, loadTestMonthlyStats(t, ctx, db, food), map[string]float64{"2024-01": 130, "2024-02": 100})
+	})
+}
+
+func TestPurgeTrash(t *testing.T) {
+	var householdID, oldCategory, recentCategory int
+	var oldExpense, oldCategoryExpense, recentExpense Expense
+	date := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+	commitTestTx(t, func(ctx context.Context, tx *sql.Tx) {
+		_, householdID = createTestUser(t, ctx, tx)
+		oldCategory = createTestCategory(t, ctx, tx, householdID, "Old")
+		recentCategory = createTestCategory(t, ctx, tx, householdID, "Recent")
+		oldExpense = createTestExpense(t, ctx, tx, householdID, recentCategory, "Old expense", 10, date)
+		recentExpense = createTestExpense(t, ctx, tx, householdID, recentCategory, "Recent expense", 20, date)
+		oldCategoryExpense = createTestExpense(t, ctx, tx, householdID, oldCategory, "Old category expense", 30, date)
+
+		exec := func(query string, id int) {
+			if _, err := tx.ExecContext(ctx, query, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		exec("UPDATE expenses SET deleted_at = NOW() - INTERVAL '40 days' WHERE id = $1", oldExpense.ID)
+		exec("UPDATE expenses SET deleted_at = NOW() - INTERVAL '10 days' WHERE id = $1", recentExpense.ID)
+		exec("UPDATE expenses SET deleted_at = NOW() - INTERVAL '40 days' WHERE id = $1", oldCategoryExpense.ID)
+		exec("UPDATE categories SET deleted_at = NOW() - INTERVAL '40 days' WHERE id = $1", oldCategory)
+	})
+
+	ctx := context.Background()
+	exists := func(table string, id int) bool {
+		t.Helper()
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE id = $1", id).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n == 1
+	}
+
+	// Без срока хранения ничего не удаляется
+	if categories, expenses, err := purgeTrash(ctx, 0); err != nil || categories != 0 || expenses != 0 {
+		t.Fatalf("purgeTrash(0) = %d, %d, %v", categories, expenses, err)
+	}
+	if !exists("expenses", oldExpense.ID) {
+		t.Fatal("purgeTrash(0) deleted an expense")
+	}
+
+	categories, expenses, err := purgeTrash(ctx, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if categories < 1 || expenses < 2 {
+		t.Errorf("purged %d categories and %d expenses, want at least 1 and 2", categories, expenses)
+	}
+	if exists("expenses", oldExpense.ID) || exists("expenses", oldCategoryExpense.ID) || exists("categories", oldCategory) {
+		t.Error("items older than the retention period are still stored")
+	}
+	if !exists("expenses", recentExpense.ID) || !exists("categories", recentCategory) {
+		t.Error("recently trashed or live items were purged")
+	}
+}